@@ -0,0 +1,77 @@
+package embedded
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/tasks"
+	"vu/benchmark/queue/typed"
+)
+
+const (
+	poolSize = 8
+	capacity = 10_000
+)
+
+// BenchmarkIQueueSum runs sum tasks the way a program embedding IQueue
+// does: it marshals the input, the worker looks the handler up by type and
+// unmarshals it, and the caller unmarshals the result.
+func BenchmarkIQueueSum(b *testing.B) {
+	queue := internal.NewQueue(capacity, poolSize, true)
+	defer queue.Shutdown()
+
+	var seq atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(seq.Add(1))
+			input, err := json.Marshal(tasks.SumTaskInput{A: i, B: 1})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			ch, err := queue.Put(&tasks.Task{Id: strconv.Itoa(i), Type: tasks.SumTaskType, Input: input})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			output := <-ch
+			var res tasks.SumTaskOutput
+			if err := json.Unmarshal(output.Res, &res); err != nil || res.Res != i+1 {
+				b.Errorf("task %d: %s, %v", i, output.Res, output.Err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkTypedSum runs the same sums through a typed.Queue.
+func BenchmarkTypedSum(b *testing.B) {
+	queue := typed.New(typed.Config{Capacity: capacity, Workers: poolSize, LogDisabled: true},
+		func(ctx context.Context, in tasks.SumTaskInput) (int, error) {
+			return in.A + in.B, nil
+		})
+	defer queue.Shutdown()
+
+	var seq atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(seq.Add(1))
+			future, err := queue.Submit(tasks.SumTaskInput{A: i, B: 1})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if res, err := future.Wait(context.Background()); err != nil || res != i+1 {
+				b.Errorf("task %d: %d, %v", i, res, err)
+				return
+			}
+		}
+	})
+}
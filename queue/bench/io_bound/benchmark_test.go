@@ -2,24 +2,42 @@ package io_bound
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/pkg/profile"
 	"strconv"
 	"testing"
 	"time"
-	"vu/benchmark/queue/helpers"
 	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/mockserver"
 	"vu/benchmark/queue/tasks"
 )
 
+// mockLatency matches the mock server the recorded bench_io_*.txt results
+// were taken against: a 1s sleep plus up to 200ms of jitter.
+var mockLatency = mockserver.Latency{
+	Distribution: mockserver.Uniform,
+	Base:         time.Second,
+	Jitter:       200 * time.Millisecond,
+}
+
+// startMockServer serves SlowAPITask calls in-process on an ephemeral
+// loopback port, so the benchmark runs offline.
+func startMockServer(tb testing.TB) string {
+	server, err := mockserver.Start(mockserver.Config{Latency: mockLatency, LogDisabled: true})
+	if err != nil {
+		tb.Fatalf("start mock server: %v", err)
+	}
+	tb.Cleanup(func() { server.Close() })
+	return server.Addr()
+}
+
 func BenchmarkTestIOBound(b *testing.B) {
 	defer profile.Start(profile.TraceProfile, profile.ProfilePath(".")).Stop()
 	poolSize := 128
 	capacity := 1_000
 
-	ip, _ := helpers.GetOutboundIP()
+	addr := startMockServer(b)
 
-	payload, err := json.Marshal(tasks.SlowAPITaskInput{Addr: fmt.Sprintf("%s:%d", ip, 8082)})
+	payload, err := json.Marshal(tasks.SlowAPITaskInput{Addr: addr})
 	if err != nil {
 		b.Fatalf("marshal hash input: %v", err)
 	}
@@ -72,9 +90,9 @@ func TestIOBound(t *testing.T) {
 	poolSize := 8
 	capacity := 1_000
 
-	ip, _ := helpers.GetOutboundIP()
+	addr := startMockServer(t)
 
-	payload, err := json.Marshal(tasks.SlowAPITaskInput{Addr: fmt.Sprintf("%s:%d", ip, 8082)})
+	payload, err := json.Marshal(tasks.SlowAPITaskInput{Addr: addr})
 	if err != nil {
 		t.Fatalf("marshal hash input: %v", err)
 	}
@@ -0,0 +1,298 @@
+// Package blob is a content-addressed store for task inputs and results too
+// large to carry inline. Blobs are files in a local directory named by the
+// hex SHA-256 of their content; they are written once and never change.
+//
+// Large blobs are uploaded in chunks: Begin an upload, Append chunks at
+// increasing offsets and Commit it, which moves it into place under its
+// hash. Servers sharing work should share the directory, e.g. over NFS, so
+// a task can read its input on whichever node runs it.
+//
+// Nothing is removed on its own: Sweep discards abandoned uploads and the
+// blobs unused for a while.
+package blob
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound       = errors.New("blob not found")
+	ErrInvalidHash    = errors.New("invalid blob hash")
+	ErrHashMismatch   = errors.New("blob hash mismatch")
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrBadOffset      = errors.New("chunk offset does not match upload size")
+)
+
+// Store is a directory of blobs. It is safe for concurrent use.
+type Store struct {
+	dir     string
+	mutex   sync.Mutex
+	uploads map[string]*upload
+}
+
+type upload struct {
+	mutex sync.Mutex
+	file  *os.File
+	hash  hash.Hash
+	size  int64
+	// touched is when the upload began or was last appended to.
+	touched time.Time
+	// swept is set once Sweep discarded the upload.
+	swept bool
+}
+
+// NewStore opens the store in dir, creating it if needed.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "uploads"), 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, uploads: make(map[string]*upload)}, nil
+}
+
+// ValidHash reports whether hash is a hex SHA-256, the only names blobs
+// have. Anything else could escape the store's directory.
+func ValidHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Put stores everything read from r and returns its hash and size.
+func (s *Store) Put(r io.Reader) (string, int64, error) {
+	file, err := os.CreateTemp(filepath.Join(s.dir, "uploads"), "put-*")
+	if err != nil {
+		return "", 0, err
+	}
+	u := &upload{file: file, hash: sha256.New()}
+	if u.size, err = io.Copy(io.MultiWriter(file, u.hash), r); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+	return s.commit(u, "")
+}
+
+// Open returns the content of a blob. It counts as a use of the blob for
+// Sweep.
+func (s *Store) Open(hash string) (*os.File, error) {
+	if !ValidHash(hash) {
+		return nil, ErrInvalidHash
+	}
+	file, err := os.Open(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err == nil {
+		now := time.Now()
+		os.Chtimes(file.Name(), now, now)
+	}
+	return file, err
+}
+
+// Size returns the size of a blob.
+func (s *Store) Size(hash string) (int64, error) {
+	if !ValidHash(hash) {
+		return 0, ErrInvalidHash
+	}
+	info, err := os.Stat(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Begin starts a chunked upload and returns its id.
+func (s *Store) Begin() (string, error) {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	file, err := os.Create(filepath.Join(s.dir, "uploads", id))
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.uploads[id] = &upload{file: file, hash: sha256.New(), touched: time.Now()}
+	return id, nil
+}
+
+// Append writes chunk at offset, which must be the number of bytes
+// appended so far, and returns the new size. Resending the last chunk after
+// a lost reply therefore fails with ErrBadOffset instead of duplicating it.
+func (s *Store) Append(id string, offset int64, chunk []byte) (int64, error) {
+	s.mutex.Lock()
+	u, ok := s.uploads[id]
+	s.mutex.Unlock()
+	if !ok {
+		return 0, ErrUploadNotFound
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.swept {
+		return 0, ErrUploadNotFound
+	}
+	if offset != u.size {
+		return u.size, fmt.Errorf("%w: offset %d, size %d", ErrBadOffset, offset, u.size)
+	}
+	n, err := u.file.Write(chunk)
+	u.hash.Write(chunk[:n])
+	u.size += int64(n)
+	u.touched = time.Now()
+	return u.size, err
+}
+
+// Commit finishes an upload and returns the hash and size of the blob. If
+// want is not empty the content must hash to it.
+func (s *Store) Commit(id string, want string) (string, int64, error) {
+	u, err := s.take(id)
+	if err != nil {
+		return "", 0, err
+	}
+	return s.commit(u, want)
+}
+
+// Abort discards an upload.
+func (s *Store) Abort(id string) error {
+	u, err := s.take(id)
+	if err != nil {
+		return err
+	}
+	u.file.Close()
+	return os.Remove(u.file.Name())
+}
+
+func (s *Store) take(id string) (*upload, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, ErrUploadNotFound
+	}
+	delete(s.uploads, id)
+	return u, nil
+}
+
+// commit moves a finished upload into place under its hash. Blobs with the
+// same content are stored once.
+func (s *Store) commit(u *upload, want string) (string, int64, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	name := u.file.Name()
+	if err := u.file.Close(); err != nil {
+		os.Remove(name)
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(u.hash.Sum(nil))
+	if want != "" && want != hash {
+		os.Remove(name)
+		return "", 0, fmt.Errorf("%w: got %s, want %s", ErrHashMismatch, hash, want)
+	}
+
+	path := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		os.Remove(name)
+		return "", 0, err
+	}
+	if err := os.Rename(name, path); err != nil {
+		os.Remove(name)
+		return "", 0, err
+	}
+	return hash, u.size, nil
+}
+
+// Sweep discards, unless uploadTimeout is zero, the uploads nothing was
+// appended to for uploadTimeout, including the files of uploads a previous
+// process left, and, unless ttl is zero, the blobs neither stored nor
+// opened for ttl. A blob is stored again by Put or Commit of the same
+// content. It returns how many uploads and blobs it removed.
+func (s *Store) Sweep(uploadTimeout, ttl time.Duration) (uploads, blobs int, err error) {
+	now := time.Now()
+	if uploadTimeout > 0 {
+		if uploads, err = s.sweepUploads(now, uploadTimeout); err != nil {
+			return uploads, 0, err
+		}
+	}
+	if ttl == 0 {
+		return uploads, 0, nil
+	}
+	err = filepath.WalkDir(s.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == "uploads" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !ValidHash(entry.Name()) {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > ttl {
+			if os.Remove(path) == nil {
+				blobs++
+			}
+		}
+		return nil
+	})
+	return uploads, blobs, err
+}
+
+func (s *Store) sweepUploads(now time.Time, timeout time.Duration) (int, error) {
+	removed := 0
+	s.mutex.Lock()
+	for id, u := range s.uploads {
+		u.mutex.Lock()
+		if now.Sub(u.touched) > timeout {
+			delete(s.uploads, id)
+			u.swept = true
+			u.file.Close()
+			os.Remove(u.file.Name())
+			removed++
+		}
+		u.mutex.Unlock()
+	}
+	s.mutex.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, "uploads"))
+	if err != nil {
+		return removed, err
+	}
+	for _, entry := range entries {
+		s.mutex.Lock()
+		_, active := s.uploads[entry.Name()]
+		s.mutex.Unlock()
+		if info, err := entry.Info(); err == nil && !active && now.Sub(info.ModTime()) > timeout {
+			if os.Remove(filepath.Join(s.dir, "uploads", entry.Name())) == nil {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,167 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPutOpen(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("blob"), 1000)
+	sum := sha256.Sum256(data)
+	hash, size, err := store.Put(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hex.EncodeToString(sum[:]) || size != int64(len(data)) {
+		t.Fatalf("Put: %s %d", hash, size)
+	}
+
+	// The same content again is the same blob.
+	if again, _, err := store.Put(bytes.NewReader(data)); err != nil || again != hash {
+		t.Fatalf("second Put: %s %v", again, err)
+	}
+
+	file, err := store.Open(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if got, _ := io.ReadAll(file); !bytes.Equal(got, data) {
+		t.Error("content differs")
+	}
+
+	missing := hex.EncodeToString(make([]byte, sha256.Size))
+	if _, err := store.Open(missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing blob: %v", err)
+	}
+	if _, err := store.Open("../../etc/passwd"); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("path as hash: %v", err)
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	id, err := store.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(data); offset += 300 {
+		end := min(offset+300, len(data))
+		if size, err := store.Append(id, int64(offset), data[offset:end]); err != nil || size != int64(end) {
+			t.Fatalf("Append at %d: %d %v", offset, size, err)
+		}
+	}
+	// A resent chunk is refused rather than appended twice.
+	if _, err := store.Append(id, 0, data[:300]); !errors.Is(err, ErrBadOffset) {
+		t.Errorf("resent chunk: %v", err)
+	}
+
+	hash, size, err := store.Commit(id, want)
+	if err != nil || hash != want || size != int64(len(data)) {
+		t.Fatalf("Commit: %s %d %v", hash, size, err)
+	}
+	if got, err := store.Size(hash); err != nil || got != int64(len(data)) {
+		t.Errorf("Size: %d %v", got, err)
+	}
+	if _, err := store.Append(id, size, []byte("more")); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("append after commit: %v", err)
+	}
+
+	// A corrupted upload never becomes a blob.
+	id, _ = store.Begin()
+	store.Append(id, 0, []byte("corrupted"))
+	if _, _, err := store.Commit(id, want); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("mismatched commit: %v", err)
+	}
+
+	id, _ = store.Begin()
+	store.Append(id, 0, []byte("abandoned"))
+	if err := store.Abort(id); err != nil {
+		t.Error(err)
+	}
+	if leftovers, _ := os.ReadDir(filepath.Join(dir, "uploads")); len(leftovers) != 0 {
+		t.Errorf("%d upload files left behind", len(leftovers))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+
+	expired, _, _ := store.Put(bytes.NewReader([]byte("expired")))
+	os.Chtimes(store.path(expired), old, old)
+	read, _, _ := store.Put(bytes.NewReader([]byte("read")))
+	os.Chtimes(store.path(read), old, old)
+	file, err := store.Open(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	fresh, _, _ := store.Put(bytes.NewReader([]byte("fresh")))
+
+	active, _ := store.Begin()
+	store.Append(active, 0, []byte("active"))
+	abandoned, _ := store.Begin()
+	store.Append(abandoned, 0, []byte("abandoned"))
+	store.uploads[abandoned].touched = old
+	// Left by a previous process.
+	orphan := filepath.Join(dir, "uploads", "orphan")
+	os.WriteFile(orphan, []byte("orphan"), 0o644)
+	os.Chtimes(orphan, old, old)
+
+	uploads, blobs, err := store.Sweep(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 2 || blobs != 1 {
+		t.Errorf("swept %d uploads and %d blobs, want 2 and 1", uploads, blobs)
+	}
+	if _, err := store.Size(expired); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired blob: %v", err)
+	}
+	for _, hash := range []string{read, fresh} {
+		if _, err := store.Size(hash); err != nil {
+			t.Errorf("blob in use: %v", err)
+		}
+	}
+	if _, err := store.Append(abandoned, 9, []byte("more")); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("append to an abandoned upload: %v", err)
+	}
+	if _, err := store.Append(active, 6, []byte("more")); err != nil {
+		t.Errorf("append to an active upload: %v", err)
+	}
+	if leftovers, _ := os.ReadDir(filepath.Join(dir, "uploads")); len(leftovers) != 1 {
+		t.Errorf("%d upload files left, want the active one", len(leftovers))
+	}
+
+	// Zero keeps everything.
+	os.Chtimes(store.path(fresh), old, old)
+	if uploads, blobs, err := store.Sweep(0, 0); uploads != 0 || blobs != 0 || err != nil {
+		t.Errorf("sweep without limits: %d uploads, %d blobs, %v", uploads, blobs, err)
+	}
+}
@@ -0,0 +1,244 @@
+// Package breaker protects callers from backends that are down or
+// overloaded. A circuit breaker counts the consecutive failures of the calls
+// to a target; after too many it opens and calls fail at once, without
+// touching the target, until a cooldown passes. Then it lets a few probe
+// calls through, half-open, and closes again if they succeed.
+//
+// A bulkhead caps the calls in flight to a target, so one slow backend
+// cannot tie up every worker; calls over the cap fail at once too.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOpen         = errors.New("circuit open")
+	ErrBulkheadFull = errors.New("too many calls in flight")
+)
+
+// State is the state of a circuit.
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Config collects the tunables of the breakers of a Set.
+type Config struct {
+	// Failures is how many calls in a row must fail to open a circuit, 5 by
+	// default.
+	Failures int
+	// Cooldown is how long a circuit stays open before probing, 5s by
+	// default.
+	Cooldown time.Duration
+	// Probes is how many calls a half-open circuit lets through at once, 1
+	// by default.
+	Probes int
+	// MaxConcurrent caps the calls in flight per target, no cap if zero.
+	MaxConcurrent int
+	// Timeout bounds every call; one that takes longer counts as failed,
+	// so a backend that hangs opens its circuit. No bound if zero.
+	Timeout     time.Duration
+	LogDisabled bool
+}
+
+// Stats describe the breaker of one target.
+type Stats struct {
+	Target   string `json:"target"`
+	State    State  `json:"state"`
+	InFlight int    `json:"inFlight"`
+	// Rejected counts the calls failed by the open circuit and Shed those
+	// failed by the bulkhead.
+	Rejected int64 `json:"rejected"`
+	Shed     int64 `json:"shed"`
+}
+
+// Set is a breaker and a bulkhead per target, e.g. per address. It is safe
+// for concurrent use.
+type Set struct {
+	cfg     Config
+	mutex   sync.Mutex
+	targets map[string]*circuit
+}
+
+type circuit struct {
+	state    State
+	failures int
+	// openedAt is when the circuit last opened.
+	openedAt time.Time
+	probing  int
+	inFlight int
+	rejected int64
+	shed     int64
+}
+
+func NewSet(cfg Config) *Set {
+	if cfg.Failures <= 0 {
+		cfg.Failures = 5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 5 * time.Second
+	}
+	if cfg.Probes <= 0 {
+		cfg.Probes = 1
+	}
+	return &Set{cfg: cfg, targets: make(map[string]*circuit)}
+}
+
+func (s *Set) logf(format string, args ...any) {
+	if s.cfg.LogDisabled {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// Do runs call unless the target's circuit is open or its bulkhead full,
+// and records whether it failed. call gets ctx with the Timeout of the Set,
+// and should give up once it is done. Errors after ctx is cancelled are the
+// caller giving up, not the target failing, and are not counted; a missed
+// deadline is counted, as the target being too slow, even if call returns
+// no error. A nil Set runs every call.
+func (s *Set) Do(ctx context.Context, target string, call func(ctx context.Context) error) error {
+	if s == nil {
+		return call(ctx)
+	}
+	probe, err := s.acquire(target)
+	if err != nil {
+		return err
+	}
+	callCtx := ctx
+	if s.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, s.cfg.Timeout)
+		defer cancel()
+	}
+	err = call(callCtx)
+	slow := errors.Is(callCtx.Err(), context.DeadlineExceeded)
+	cancelled := errors.Is(ctx.Err(), context.Canceled)
+	s.release(target, probe, err == nil && !slow, (err != nil || slow) && !cancelled)
+	return err
+}
+
+func (s *Set) acquire(target string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, ok := s.targets[target]
+	if !ok {
+		c = &circuit{}
+		s.targets[target] = c
+	}
+
+	if c.state == Open && time.Since(c.openedAt) >= s.cfg.Cooldown {
+		c.state = HalfOpen
+		s.logf("circuit to %s half-open, probing\n", target)
+	}
+	probe := false
+	switch {
+	case c.state == Open:
+		c.rejected++
+		return false, fmt.Errorf("%s: %w", target, ErrOpen)
+	case c.state == HalfOpen && c.probing >= s.cfg.Probes:
+		c.rejected++
+		return false, fmt.Errorf("%s: %w", target, ErrOpen)
+	case c.state == HalfOpen:
+		probe = true
+	}
+	if s.cfg.MaxConcurrent > 0 && c.inFlight >= s.cfg.MaxConcurrent {
+		c.shed++
+		return false, fmt.Errorf("%s: %w", target, ErrBulkheadFull)
+	}
+
+	c.inFlight++
+	if probe {
+		c.probing++
+	}
+	return probe, nil
+}
+
+func (s *Set) release(target string, probe, succeeded, failed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.targets[target]
+	c.inFlight--
+	if probe {
+		c.probing--
+	}
+
+	switch {
+	case succeeded:
+		c.failures = 0
+		if c.state == HalfOpen && probe {
+			c.state = Closed
+			s.logf("circuit to %s closed\n", target)
+		}
+	case failed:
+		c.failures++
+		// A failed probe reopens the circuit for another cooldown. Calls
+		// started before it opened do not restart the cooldown.
+		if (c.state == HalfOpen && probe) || (c.state == Closed && c.failures >= s.cfg.Failures) {
+			c.state = Open
+			c.openedAt = time.Now()
+			s.logf("circuit to %s open after %d failures, retrying in %v\n", target, c.failures, s.cfg.Cooldown)
+		}
+	}
+}
+
+// State returns the state of the target's circuit.
+func (s *Set) State(target string) State {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, ok := s.targets[target]
+	if !ok {
+		return Closed
+	}
+	if c.state == Open && time.Since(c.openedAt) >= s.cfg.Cooldown {
+		return HalfOpen
+	}
+	return c.state
+}
+
+// Stats returns the breakers of every target called so far, by target.
+func (s *Set) Stats() []Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := make([]Stats, 0, len(s.targets))
+	for target, c := range s.targets {
+		stats = append(stats, Stats{
+			Target:   target,
+			State:    c.state,
+			InFlight: c.inFlight,
+			Rejected: c.rejected,
+			Shed:     c.shed,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Target < stats[j].Target })
+	return stats
+}
@@ -0,0 +1,159 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("down")
+
+func TestOpensAndRecovers(t *testing.T) {
+	set := NewSet(Config{Failures: 3, Cooldown: 50 * time.Millisecond, LogDisabled: true})
+	ctx := context.Background()
+	calls := 0
+	fail := func(context.Context) error { calls++; return errDown }
+	succeed := func(context.Context) error { calls++; return nil }
+
+	// A success resets the count of failures in a row.
+	set.Do(ctx, "a", fail)
+	set.Do(ctx, "a", fail)
+	set.Do(ctx, "a", succeed)
+	set.Do(ctx, "a", fail)
+	set.Do(ctx, "a", fail)
+	if state := set.State("a"); state != Closed {
+		t.Fatalf("%v after 2 failures in a row", state)
+	}
+	set.Do(ctx, "a", fail)
+	if state := set.State("a"); state != Open {
+		t.Fatalf("%v after 3 failures in a row", state)
+	}
+
+	before := calls
+	if err := set.Do(ctx, "a", succeed); !errors.Is(err, ErrOpen) {
+		t.Fatalf("call to open circuit: %v", err)
+	}
+	if calls != before {
+		t.Error("open circuit called the target")
+	}
+	if err := set.Do(ctx, "b", succeed); err != nil {
+		t.Errorf("other target: %v", err)
+	}
+
+	// A failed probe reopens it, a successful one closes it.
+	time.Sleep(60 * time.Millisecond)
+	if err := set.Do(ctx, "a", fail); !errors.Is(err, errDown) {
+		t.Fatalf("probe: %v", err)
+	}
+	if state := set.State("a"); state != Open {
+		t.Fatalf("%v after a failed probe", state)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := set.Do(ctx, "a", succeed); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if state := set.State("a"); state != Closed {
+		t.Fatalf("%v after a successful probe", state)
+	}
+	if stats := set.Stats(); len(stats) != 2 || stats[0].Rejected != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestHalfOpenLetsOneProbeThrough(t *testing.T) {
+	set := NewSet(Config{Failures: 1, Cooldown: 10 * time.Millisecond, LogDisabled: true})
+	ctx := context.Background()
+	set.Do(ctx, "a", func(context.Context) error { return errDown })
+	time.Sleep(20 * time.Millisecond)
+
+	probing := make(chan struct{})
+	finish := make(chan struct{})
+	go set.Do(ctx, "a", func(context.Context) error {
+		close(probing)
+		<-finish
+		return nil
+	})
+	<-probing
+	if err := set.Do(ctx, "a", func(context.Context) error { return nil }); !errors.Is(err, ErrOpen) {
+		t.Errorf("second call while probing: %v", err)
+	}
+	close(finish)
+}
+
+func TestCancelledCallsDoNotCount(t *testing.T) {
+	set := NewSet(Config{Failures: 1, LogDisabled: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	set.Do(ctx, "a", func(ctx context.Context) error { return ctx.Err() })
+	if state := set.State("a"); state != Closed {
+		t.Errorf("%v after a cancelled call", state)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	set.Do(ctx, "a", func(ctx context.Context) error { return ctx.Err() })
+	if state := set.State("a"); state != Open {
+		t.Errorf("%v after a call missed its deadline", state)
+	}
+}
+
+func TestBulkheadCapsCallsInFlight(t *testing.T) {
+	set := NewSet(Config{MaxConcurrent: 2, LogDisabled: true})
+	ctx := context.Background()
+
+	var started, wg sync.WaitGroup
+	finish := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			set.Do(ctx, "a", func(context.Context) error {
+				started.Done()
+				<-finish
+				return nil
+			})
+		}()
+	}
+	started.Wait()
+
+	if err := set.Do(ctx, "a", func(context.Context) error { return nil }); !errors.Is(err, ErrBulkheadFull) {
+		t.Errorf("third call: %v", err)
+	}
+	if err := set.Do(ctx, "b", func(context.Context) error { return nil }); err != nil {
+		t.Errorf("other target: %v", err)
+	}
+	close(finish)
+	wg.Wait()
+
+	if err := set.Do(ctx, "a", func(context.Context) error { return nil }); err != nil {
+		t.Errorf("call after the others finished: %v", err)
+	}
+	if stats := set.Stats(); stats[0].Shed != 1 || stats[0].InFlight != 0 || stats[0].State != Closed {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSlowCallsCountAsFailures(t *testing.T) {
+	set := NewSet(Config{Failures: 2, Timeout: 10 * time.Millisecond, LogDisabled: true})
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	// Ignores its deadline and succeeds late.
+	late := func(ctx context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+
+	if err := set.Do(context.Background(), "a", hang); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("hung call: %v", err)
+	}
+	set.Do(context.Background(), "a", late)
+	if state := set.State("a"); state != Open {
+		t.Errorf("%v after 2 calls over the timeout", state)
+	}
+}
@@ -0,0 +1,505 @@
+// Package client submits tasks to one or more queue servers. It keeps a
+// pool of pipelined connections per server, fails over to the next healthy
+// server when one goes away, follows leader hints from replicated servers
+// and adapts its concurrency when servers report that their queue is full.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/tasks"
+)
+
+// blobChunk is the size of the chunks UploadBlob sends.
+const blobChunk = 1 << 20
+
+var (
+	ErrClosed   = errors.New("client closed")
+	ErrNoServer = errors.New("no healthy server")
+)
+
+// Config collects the tunables of a Client.
+type Config struct {
+	// Addrs are the queue servers to use, in order of preference: TCP
+	// addresses or "unix:" and the path of a Unix socket.
+	Addrs []string
+	// PoolSize is the number of pipelined connections kept per server.
+	PoolSize int
+	// Name scopes task ids on the servers so the client can pick its tasks
+	// up again after reconnecting. A random name is used if empty.
+	Name           string
+	DialTimeout    time.Duration
+	HealthInterval time.Duration
+	// RetryBackoff is how long to wait before resubmitting a task after
+	// backpressure or a lost connection.
+	RetryBackoff time.Duration
+	// InitialConcurrency, MinConcurrency and MaxConcurrency bound the
+	// adaptive limit on in-flight submissions.
+	InitialConcurrency int
+	MinConcurrency     int
+	MaxConcurrency     int
+}
+
+// TaskError is a failure the server reported for a task.
+type TaskError struct {
+	ID      string
+	Message string
+	// Validation is set when the server rejected the task's input.
+	Validation *tasks.ValidationError
+}
+
+func (e *TaskError) Error() string {
+	return "task " + e.ID + ": " + e.Message
+}
+
+type Client struct {
+	cfg     Config
+	limiter *limiter
+	seq     uint64
+
+	mutex   sync.Mutex
+	servers []*serverState
+	// leader is the server a replicated cluster told us to use.
+	leader string
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type serverState struct {
+	addr    string
+	healthy bool
+	pool    []*conn
+	next    int
+}
+
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Addrs) == 0 {
+		return nil, errors.New("client: no server address")
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 4
+	}
+	if cfg.Name == "" {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		cfg.Name = "client-" + hex.EncodeToString(buf)
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = time.Second
+	}
+	if cfg.HealthInterval <= 0 {
+		cfg.HealthInterval = time.Second
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 50 * time.Millisecond
+	}
+	if cfg.MinConcurrency <= 0 {
+		cfg.MinConcurrency = 1
+	}
+	if cfg.MaxConcurrency <= 0 {
+		cfg.MaxConcurrency = 1024
+	}
+	if cfg.InitialConcurrency <= 0 {
+		cfg.InitialConcurrency = min(64, cfg.MaxConcurrency)
+	}
+
+	c := &Client{
+		cfg:     cfg,
+		limiter: newLimiter(cfg.InitialConcurrency, cfg.MinConcurrency, cfg.MaxConcurrency),
+		done:    make(chan struct{}),
+	}
+	for _, addr := range cfg.Addrs {
+		c.servers = append(c.servers, c.newServer(addr))
+	}
+
+	c.wg.Add(1)
+	go c.healthLoop()
+
+	return c, nil
+}
+
+func (c *Client) newServer(addr string) *serverState {
+	return &serverState{
+		addr:    addr,
+		healthy: true,
+		pool:    make([]*conn, c.cfg.PoolSize),
+	}
+}
+
+// Submit runs task on a server and returns its result. An empty task id is
+// filled in. Submit retries on backpressure and failover until ctx is done.
+func (c *Client) Submit(ctx context.Context, task tasks.Task) ([]byte, error) {
+	return c.SubmitStream(ctx, task, nil)
+}
+
+// SubmitStream is Submit, passing the updates the task streams to emitter
+// before returning its result. A task that is resubmitted after failover
+// may stream the same progress again; one only waited for after a lost
+// connection streams nothing more.
+func (c *Client) SubmitStream(ctx context.Context, task tasks.Task, emitter tasks.Emitter) ([]byte, error) {
+	if task.Id == "" {
+		task.Id = strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 10)
+	}
+
+	if err := c.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+
+	op := ""
+	for {
+		server, cn, err := c.pick()
+		if errors.Is(err, ErrClosed) {
+			return nil, err
+		}
+		if err != nil {
+			if err := c.sleep(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var streamTo tasks.Emitter
+		if op == "" {
+			streamTo = emitter
+		}
+		ch, err := cn.send(protocol.Request{Op: op, Client: c.cfg.Name, Task: task}, streamTo)
+		if err != nil {
+			c.markDown(server)
+			continue
+		}
+
+		var resp response
+		select {
+		case resp = <-ch:
+		case <-ctx.Done():
+			cn.forget("", task.Id)
+			cn.notify(protocol.Request{Op: protocol.OpCancel, Client: c.cfg.Name, Task: tasks.Task{Id: task.Id}})
+			return nil, ctx.Err()
+		}
+
+		switch {
+		case resp.lost:
+			// The task may still run there; resubmitting with the same id
+			// either picks it up again or runs it elsewhere.
+			c.markDown(server)
+		case resp.Leader != "":
+			c.setLeader(resp.Leader)
+			continue
+		case strings.HasPrefix(resp.Error, "not leader"):
+			// An election is in progress.
+		case resp.Error == internal.ErrQueueFull.Error(), resp.Error == internal.ErrRateLimited.Error():
+			c.limiter.backpressure()
+		case resp.Error == internal.ErrDuplicateID.Error() && op == "":
+			// Already queued from an earlier attempt; wait for it instead.
+			op = protocol.OpWait
+			continue
+		case op == protocol.OpWait && (resp.Error == internal.ErrTaskNotFound.Error() || strings.HasPrefix(resp.Error, "op \"wait\" is not supported")):
+			// The earlier attempt finished before we could wait for it, or
+			// the server cannot wait; run the task again under a fresh id.
+			task.Id += "~" + strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 10)
+			op = ""
+			continue
+		case resp.Error != "":
+			return nil, &TaskError{ID: task.Id, Message: resp.Error, Validation: resp.Validation}
+		case resp.Blob != "":
+			c.limiter.succeeded()
+			var result bytes.Buffer
+			if err := c.fetch(ctx, server, cn, resp.Blob, &result); err != nil {
+				return nil, err
+			}
+			return result.Bytes(), nil
+		default:
+			c.limiter.succeeded()
+			return resp.Result, nil
+		}
+
+		if err := c.sleep(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// UploadBlob stores everything read from r on the preferred server and
+// returns its hash, to submit tasks with it as their InputBlob. Servers
+// sharing work must share their blob directory for such tasks to run
+// elsewhere.
+func (c *Client) UploadBlob(ctx context.Context, r io.Reader) (string, error) {
+	server, cn, err := c.pick()
+	if err != nil {
+		return "", err
+	}
+
+	id := "blob-" + strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 10)
+	upload := ""
+	var offset int64
+	buf := make([]byte, blobChunk)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 || upload == "" {
+			resp, err := c.call(ctx, server, cn, protocol.Request{Op: protocol.OpUpload, Task: tasks.Task{Id: id}, Upload: upload, Offset: offset, Chunk: buf[:n]})
+			if err != nil {
+				return "", err
+			}
+			upload, offset = resp.Upload, resp.Size
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+
+	resp, err := c.call(ctx, server, cn, protocol.Request{Op: protocol.OpCommit, Task: tasks.Task{Id: id}, Upload: upload})
+	if err != nil {
+		return "", err
+	}
+	return resp.Blob, nil
+}
+
+// FetchBlob writes the content of a blob on the preferred server to w.
+// Submit already fetches results stored as blobs.
+func (c *Client) FetchBlob(ctx context.Context, hash string, w io.Writer) error {
+	server, cn, err := c.pick()
+	if err != nil {
+		return err
+	}
+	return c.fetch(ctx, server, cn, hash, w)
+}
+
+func (c *Client) fetch(ctx context.Context, server *serverState, cn *conn, hash string, w io.Writer) error {
+	id := "blob-" + strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 10)
+	var offset int64
+	for {
+		resp, err := c.call(ctx, server, cn, protocol.Request{Op: protocol.OpDownload, Task: tasks.Task{Id: id}, Blob: hash, Offset: offset})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(resp.Chunk); err != nil {
+			return err
+		}
+		offset += int64(len(resp.Chunk))
+		if offset >= resp.Size {
+			return nil
+		}
+		if len(resp.Chunk) == 0 {
+			return fmt.Errorf("blob %s: truncated at %d of %d bytes", hash, offset, resp.Size)
+		}
+	}
+}
+
+// call sends req over cn and waits for its response. Blob operations are
+// not retried elsewhere: uploads and blobs live on one server.
+func (c *Client) call(ctx context.Context, server *serverState, cn *conn, req protocol.Request) (response, error) {
+	ch, err := cn.send(req, nil)
+	if err != nil {
+		c.markDown(server)
+		return response{}, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.lost {
+			c.markDown(server)
+			return response{}, errConnClosed
+		}
+		if resp.Error != "" {
+			return response{}, fmt.Errorf("%s %s: %s", req.Op, req.Id, resp.Error)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		cn.forget(req.Op, req.Id)
+		return response{}, ctx.Err()
+	}
+}
+
+// Concurrency reports the current adaptive limit on in-flight submissions.
+func (c *Client) Concurrency() int {
+	return c.limiter.current()
+}
+
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for _, server := range c.servers {
+		closePool(server)
+	}
+	c.mutex.Unlock()
+
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Client) sleep(ctx context.Context) error {
+	select {
+	case <-time.After(c.cfg.RetryBackoff):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// pick returns a connection to the preferred healthy server: the leader if
+// known, otherwise the first healthy one in configuration order.
+func (c *Client) pick() (*serverState, *conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, nil, ErrClosed
+	}
+
+	for _, server := range c.ordered() {
+		if !server.healthy {
+			continue
+		}
+
+		slot := server.next % len(server.pool)
+		server.next++
+		cn := server.pool[slot]
+		if cn == nil || cn.isBroken() {
+			var err error
+			cn, err = dial(server.addr, c.cfg.DialTimeout)
+			if err != nil {
+				server.healthy = false
+				closePool(server)
+				continue
+			}
+			server.pool[slot] = cn
+		}
+		return server, cn, nil
+	}
+	return nil, nil, ErrNoServer
+}
+
+// ordered lists servers by preference. The caller must hold c.mutex.
+func (c *Client) ordered() []*serverState {
+	servers := make([]*serverState, 0, len(c.servers))
+	for _, server := range c.servers {
+		if server.addr == c.leader {
+			servers = append(servers, server)
+		}
+	}
+	for _, server := range c.servers {
+		if server.addr != c.leader {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func (c *Client) setLeader(addr string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.leader = addr
+	for _, server := range c.servers {
+		if server.addr == addr {
+			server.healthy = true
+			return
+		}
+	}
+	c.servers = append(c.servers, c.newServer(addr))
+}
+
+func (c *Client) markDown(server *serverState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	server.healthy = false
+	closePool(server)
+	if c.leader == server.addr {
+		c.leader = ""
+	}
+}
+
+// closePool closes every connection to server. The caller must hold
+// c.mutex.
+func closePool(server *serverState) {
+	for i, cn := range server.pool {
+		if cn != nil {
+			cn.close()
+			server.pool[i] = nil
+		}
+	}
+}
+
+// healthLoop probes every server with a stats request so servers marked
+// down come back once they answer again, and sends heartbeats over the
+// pooled connections.
+func (c *Client) healthLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.cfg.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.Lock()
+		servers := append([]*serverState(nil), c.servers...)
+		c.mutex.Unlock()
+
+		for _, server := range servers {
+			healthy := c.probe(server.addr)
+
+			c.mutex.Lock()
+			if !healthy && server.healthy {
+				closePool(server)
+			}
+			server.healthy = healthy
+			pool := append([]*conn(nil), server.pool...)
+			c.mutex.Unlock()
+
+			// Heartbeats keep the pooled connections from timing out idle,
+			// and break those the server stopped answering on.
+			for _, cn := range pool {
+				if cn != nil {
+					cn.heartbeat()
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) probe(addr string) bool {
+	netConn, err := DialNet(addr, c.cfg.DialTimeout)
+	if err != nil {
+		return false
+	}
+	defer netConn.Close()
+
+	netConn.SetDeadline(time.Now().Add(c.cfg.DialTimeout))
+	if err := json.NewEncoder(netConn).Encode(protocol.Request{Op: protocol.OpStats}); err != nil {
+		return false
+	}
+	var resp response
+	return json.NewDecoder(netConn).Decode(&resp) == nil && resp.Error == ""
+}
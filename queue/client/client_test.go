@@ -0,0 +1,425 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"vu/benchmark/queue/blob"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/server"
+	"vu/benchmark/queue/tasks"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func startServer(t *testing.T, queue internal.IQueue) string {
+	t.Helper()
+	return startServerConfig(t, queue, server.Config{})
+}
+
+func startServerConfig(t *testing.T, queue internal.IQueue, cfg server.Config) string {
+	t.Helper()
+
+	addr := freeAddr(t)
+	cfg.Addr = addr
+	done := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.ServeConfig(cfg, queue, done)
+	}()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		close(done)
+		<-served
+		queue.Shutdown()
+	})
+	return addr
+}
+
+func sumTask(a int) tasks.Task {
+	input, _ := json.Marshal(tasks.SumTaskInput{A: a, B: 1})
+	return tasks.Task{Type: tasks.SumTaskType, Input: input}
+}
+
+func submitAll(t *testing.T, c *Client, n int) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, err := c.Submit(ctx, sumTask(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			var out tasks.SumTaskOutput
+			if err := json.Unmarshal(res, &out); err != nil || out.Res != i+1 {
+				t.Errorf("task %d: unexpected result %s", i, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("submit: %v", err)
+	}
+}
+
+func TestSubmitPipelinesOverPool(t *testing.T) {
+	addr := startServer(t, internal.NewQueue(1000, 4, true))
+	c, err := New(Config{Addrs: []string{addr}, PoolSize: 2})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	submitAll(t, c, 200)
+}
+
+func TestFailsOverToNextServer(t *testing.T) {
+	// Nothing listens on the first address.
+	down := freeAddr(t)
+	up := startServer(t, internal.NewQueue(100, 2, true))
+
+	c, err := New(Config{Addrs: []string{down, up}})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	submitAll(t, c, 20)
+}
+
+func TestBacksOffWhenQueueIsFull(t *testing.T) {
+	queue := internal.NewQueue(2, 1, true)
+	queue.Pause()
+	addr := startServer(t, queue)
+
+	c, err := New(Config{Addrs: []string{addr}, InitialConcurrency: 16})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		queue.Resume()
+	}()
+	submitAll(t, c, 16)
+
+	if limit := c.Concurrency(); limit >= 16 {
+		t.Fatalf("concurrency limit stayed at %d despite backpressure", limit)
+	}
+}
+
+func TestBacksOffWhenRateLimited(t *testing.T) {
+	addr := startServerConfig(t, internal.NewQueue(100, 2, true), server.Config{Limiter: server.NewLimiter(100, 2)})
+	c, err := New(Config{Addrs: []string{addr}, InitialConcurrency: 16})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	submitAll(t, c, 20)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("20 tasks at 100/s took %v", elapsed)
+	}
+	if limit := c.Concurrency(); limit >= 16 {
+		t.Fatalf("concurrency limit stayed at %d despite the rate limit", limit)
+	}
+}
+
+// waitingQueue reports the tasks clients wait for.
+type waitingQueue struct {
+	internal.IQueue
+	waits chan string
+}
+
+func (q *waitingQueue) Wait(id string) (<-chan internal.Output, error) {
+	ch, err := q.IQueue.(server.Waiter).Wait(id)
+	q.waits <- id
+	return ch, err
+}
+
+func TestResubmitWaitsForQueuedTask(t *testing.T) {
+	queue := internal.NewQueue(10, 1, true)
+	queue.Pause()
+	// An earlier attempt of the client left the task queued.
+	task := sumTask(1)
+	task.Id = "c/1"
+	if _, err := queue.Put(&task); err != nil {
+		t.Fatal(err)
+	}
+	waits := make(chan string, 1)
+	addr := startServer(t, &waitingQueue{IQueue: queue, waits: waits})
+
+	c, err := New(Config{Addrs: []string{addr}, Name: "c"})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	go func() {
+		<-waits
+		queue.Resume()
+	}()
+	resubmitted := sumTask(1)
+	resubmitted.Id = "1"
+	res, err := c.Submit(context.Background(), resubmitted)
+	if err != nil || string(res) != `{"res":2}` {
+		t.Fatalf("submit: %s, %v", res, err)
+	}
+	if ran := queue.Stats().Types[tasks.SumTaskType].Tasks; ran != 1 {
+		t.Errorf("task ran %d times, want once", ran)
+	}
+}
+
+// putQueue reports the tasks put on it, and cannot wait.
+type putQueue struct {
+	internal.IQueue
+	puts chan string
+}
+
+func (q *putQueue) Put(task *tasks.Task) (<-chan internal.Output, error) {
+	ch, err := q.IQueue.Put(task)
+	q.puts <- task.Id
+	return ch, err
+}
+
+func TestResubmitRunsAgainWhenServerCannotWait(t *testing.T) {
+	queue := internal.NewQueue(10, 1, true)
+	queue.Pause()
+	task := sumTask(1)
+	task.Id = "c/1"
+	queue.Put(&task)
+	puts := make(chan string, 2)
+	addr := startServer(t, &putQueue{IQueue: queue, puts: puts})
+
+	c, err := New(Config{Addrs: []string{addr}, Name: "c"})
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close()
+
+	go func() {
+		for id := range puts {
+			if id != "c/1" {
+				queue.Resume()
+				return
+			}
+		}
+	}()
+	resubmitted := sumTask(1)
+	resubmitted.Id = "1"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if res, err := c.Submit(ctx, resubmitted); err != nil || string(res) != `{"res":2}` {
+		t.Fatalf("submit: %s, %v", res, err)
+	}
+}
+
+func TestSubmitStreamDeliversUpdatesBeforeResult(t *testing.T) {
+	addr := startServer(t, internal.NewQueue(10, 2, true))
+	c, err := New(Config{Addrs: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const iterations = 50_000_000
+	input, _ := json.Marshal(tasks.BurnCPUTaskInput{Iteration: iterations})
+	var updates []tasks.Update
+	res, err := c.SubmitStream(context.Background(), tasks.Task{Type: tasks.BurnCPUTaskType, Input: input},
+		tasks.EmitterFunc(func(update tasks.Update) { updates = append(updates, update) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) == 0 {
+		t.Error("empty final result")
+	}
+
+	// Progress rises with a checkpoint chunk at every step.
+	if len(updates) < 5 {
+		t.Fatalf("got %d updates, want about 10", len(updates))
+	}
+	var last int64
+	for _, update := range updates {
+		if update.Progress == nil || update.Progress.Done <= last || update.Progress.Total != iterations {
+			t.Fatalf("update %+v after progress %d", update.Progress, last)
+		}
+		last = update.Progress.Done
+		if len(update.Chunk) == 0 {
+			t.Errorf("update at %d without a chunk", last)
+		}
+	}
+
+	// Without an emitter nothing is streamed.
+	updates = nil
+	if _, err := c.Submit(context.Background(), tasks.Task{Type: tasks.BurnCPUTaskType, Input: input}); err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 0 {
+		t.Errorf("%d updates for a plain submission", len(updates))
+	}
+}
+
+func TestInvalidInputIsRejectedBeforeQueueing(t *testing.T) {
+	queue := internal.NewQueue(10, 1, true)
+	addr := startServer(t, queue)
+	c, err := New(Config{Addrs: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	queue.Pause()
+	_, err = c.Submit(context.Background(), tasks.Task{Type: tasks.SumTaskType, Input: []byte(`{"a": "one", "b": true}`)})
+
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) || taskErr.Validation == nil {
+		t.Fatalf("got %v, want a validation error", err)
+	}
+	if fields := taskErr.Validation.Fields; len(fields) != 2 || fields[0].Field != "a" || fields[1].Field != "b" {
+		t.Errorf("fields %+v", fields)
+	}
+	if stats := queue.Stats(); stats.Size != 0 {
+		t.Errorf("invalid task took a queue slot: %+v", stats)
+	}
+}
+
+func TestBlobInputAndResult(t *testing.T) {
+	store, err := blob.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even a hex digest is a "large" result here.
+	queue := internal.New(internal.Config{Capacity: 10, Workers: 2, LogDisabled: true, Blobs: store, ResultBlobThreshold: 16})
+	addr := startServerConfig(t, queue, server.Config{Blobs: store})
+	c, err := New(Config{Addrs: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	// Several chunks, the last one partial.
+	data := make([]byte, 2*blobChunk+12345)
+	rand.Read(data)
+	hash, err := c.UploadBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+	if hash != want {
+		t.Fatalf("uploaded as %s, want %s", hash, want)
+	}
+
+	result, err := c.Submit(ctx, tasks.Task{Type: tasks.SHA256TaskType, InputBlob: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != want {
+		t.Errorf("sha256 task returned %q, want %s", result, want)
+	}
+	// The result went through the store rather than inline.
+	var fetched bytes.Buffer
+	resultSum := sha256.Sum256(result)
+	if err := c.FetchBlob(ctx, hex.EncodeToString(resultSum[:]), &fetched); err != nil || fetched.String() != want {
+		t.Errorf("result blob: %q %v", fetched.String(), err)
+	}
+
+	missing := strings.Repeat("0", 64)
+	if _, err := c.Submit(ctx, tasks.Task{Type: tasks.SHA256TaskType, InputBlob: missing}); err == nil || !strings.Contains(err.Error(), blob.ErrNotFound.Error()) {
+		t.Errorf("missing input blob: %v", err)
+	}
+}
+
+func TestHeartbeatsKeepPoolOpen(t *testing.T) {
+	addr := startServerConfig(t, internal.NewQueue(100, 2, true), server.Config{IdleTimeout: 150 * time.Millisecond})
+	c, err := New(Config{Addrs: []string{addr}, PoolSize: 1, HealthInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	submitAll(t, c, 5)
+	c.mutex.Lock()
+	cn := c.servers[0].pool[0]
+	c.mutex.Unlock()
+	time.Sleep(400 * time.Millisecond)
+	if cn.isBroken() {
+		t.Fatal("pooled connection closed as idle")
+	}
+	submitAll(t, c, 5)
+}
+
+func TestHeartbeatWithoutReplyBreaksConn(t *testing.T) {
+	// Accepts connections and never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			netConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer netConn.Close()
+		}
+	}()
+
+	cn, err := dial(ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.close()
+	cn.heartbeat()
+	if cn.isBroken() {
+		t.Fatal("broken after the first heartbeat")
+	}
+	cn.heartbeat()
+	if !cn.isBroken() {
+		t.Fatal("heartbeat went unanswered and the connection is still in use")
+	}
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/tasks"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// response is a line read from the server.
+type response struct {
+	protocol.Response
+	// lost is set on the response handed to waiters when the connection
+	// breaks before the server answered.
+	lost bool
+}
+
+// conn is a pipelined connection: many requests can be in flight at once
+// and responses are matched to them by op and task id.
+type conn struct {
+	netConn net.Conn
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	waiters map[string]chan response
+	// emitters receive the updates of streamed submissions, by task id.
+	emitters map[string]tasks.Emitter
+	broken   bool
+	// heartbeatReply receives the answer to the last heartbeat. Only the
+	// health loop uses it.
+	heartbeatReply chan response
+}
+
+// DialNet connects to the server at addr, a TCP address or "unix:" followed
+// by the path of a Unix socket.
+func DialNet(addr string, timeout time.Duration) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return net.DialTimeout("unix", path, timeout)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func dial(addr string, timeout time.Duration) (*conn, error) {
+	netConn, err := DialNet(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conn{
+		netConn:  netConn,
+		encoder:  json.NewEncoder(netConn),
+		waiters:  make(map[string]chan response),
+		emitters: make(map[string]tasks.Emitter),
+	}
+	go c.read()
+	return c, nil
+}
+
+func waiterKey(op string, id string) string {
+	return op + "|" + id
+}
+
+func (c *conn) read() {
+	decoder := json.NewDecoder(c.netConn)
+	for {
+		var resp response
+		if err := decoder.Decode(&resp); err != nil {
+			break
+		}
+
+		if resp.Op == protocol.OpUpdate {
+			c.mutex.Lock()
+			emitter := c.emitters[resp.ID]
+			c.mutex.Unlock()
+			if emitter != nil {
+				emitter.Emit(tasks.Update{Progress: resp.Progress, Chunk: resp.Chunk})
+			}
+			continue
+		}
+
+		// Task results come back without an op; errors echo the op that
+		// failed. Either way a submission or wait has a single waiter.
+		op := resp.Op
+		if op == protocol.OpWait {
+			op = ""
+		}
+
+		c.mutex.Lock()
+		key := waiterKey(op, resp.ID)
+		if ch, ok := c.waiters[key]; ok {
+			delete(c.waiters, key)
+			if op == "" {
+				delete(c.emitters, resp.ID)
+			}
+			ch <- resp
+		}
+		c.mutex.Unlock()
+	}
+
+	c.close()
+}
+
+// send writes req and returns the channel its response arrives on. The
+// channel receives a lost response if the connection breaks first. If
+// emitter is set the task is streamed and its updates passed to emitter,
+// on the reading goroutine, so it must not block for long.
+func (c *conn) send(req protocol.Request, emitter tasks.Emitter) (chan response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.broken {
+		return nil, errConnClosed
+	}
+
+	op := req.Op
+	if op == protocol.OpWait {
+		op = ""
+	}
+	ch := make(chan response, 1)
+	key := waiterKey(op, req.Id)
+	c.waiters[key] = ch
+	if emitter != nil {
+		req.Stream = true
+		c.emitters[req.Id] = emitter
+	}
+	if err := c.encoder.Encode(req); err != nil {
+		delete(c.waiters, key)
+		delete(c.emitters, req.Id)
+		c.netConn.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// notify writes req without waiting for a response.
+func (c *conn) notify(req protocol.Request) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.broken {
+		return errConnClosed
+	}
+	return c.encoder.Encode(req)
+}
+
+// heartbeat sends a heartbeat. If the server has not answered the previous
+// one by now, the connection is closed as broken instead.
+func (c *conn) heartbeat() {
+	if c.heartbeatReply != nil {
+		select {
+		case <-c.heartbeatReply:
+		default:
+			c.close()
+			return
+		}
+	}
+	c.heartbeatReply, _ = c.send(protocol.Request{Op: protocol.OpHeartbeat}, nil)
+}
+
+func (c *conn) forget(op string, id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.waiters, waiterKey(op, id))
+	if op == "" {
+		delete(c.emitters, id)
+	}
+}
+
+func (c *conn) isBroken() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.broken
+}
+
+func (c *conn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.broken {
+		return
+	}
+	c.broken = true
+	c.netConn.Close()
+	for key, ch := range c.waiters {
+		delete(c.waiters, key)
+		ch <- response{lost: true}
+	}
+	clear(c.emitters)
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter caps the number of in-flight submissions with an AIMD limit:
+// every success raises it by about one per round trip, every "queue full"
+// from the server cuts it down, so clients settle at what the servers can
+// absorb instead of hammering them with retries.
+type limiter struct {
+	mutex    sync.Mutex
+	limit    float64
+	min      float64
+	max      float64
+	inFlight int
+	// changed is closed and replaced whenever a slot may have freed up.
+	changed chan struct{}
+}
+
+const backoffFactor = 0.7
+
+func newLimiter(initial int, min int, max int) *limiter {
+	return &limiter{
+		limit:   float64(initial),
+		min:     float64(min),
+		max:     float64(max),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mutex.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mutex.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *limiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inFlight--
+	l.notify()
+}
+
+func (l *limiter) succeeded() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.limit = min(l.max, l.limit+1/l.limit)
+	l.notify()
+}
+
+func (l *limiter) backpressure() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.limit = max(l.min, l.limit*backoffFactor)
+}
+
+// current reports the current concurrency limit.
+func (l *limiter) current() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return int(l.limit)
+}
+
+// notify wakes goroutines waiting in acquire. The caller must hold l.mutex.
+func (l *limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
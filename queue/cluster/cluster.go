@@ -0,0 +1,291 @@
+// Package cluster lets several queue servers share work. A node forwards
+// submissions to its peers when its own queue is full, and an idle node
+// steals queued tasks from busy peers. Nodes talk to each other with the
+// same TCP protocol clients use, see server.Serve.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/tasks"
+)
+
+// Config collects the tunables of a cluster node.
+type Config struct {
+	// Peers are the addresses of the other nodes' queue servers.
+	Peers []string
+	// StealInterval is how often an idle node asks its peers for work.
+	StealInterval time.Duration
+	// RequestTimeout bounds how long a node waits for a peer to answer.
+	RequestTimeout time.Duration
+	// StealVisibility is the lease of a stolen task, extended while it
+	// runs. If the node stops extending it, the owner runs it again.
+	StealVisibility time.Duration
+	LogDisabled     bool
+}
+
+// Queue is an internal.IQueue that spreads work over a static set of peers.
+// Serve it with server.Serve so peers can reach it.
+type Queue struct {
+	internal.IQueue
+
+	cfg   Config
+	peers []*peer
+	// nextPeer rotates the first peer tried when forwarding.
+	nextPeer  uint64
+	stealSeq  uint64
+	forwarded sync.Map // task id -> *peer
+	done      chan struct{}
+	// stealing tracks the steal loop and the goroutines reporting stolen
+	// tasks back to their owner.
+	stealing sync.WaitGroup
+}
+
+// NewQueue wraps local and starts stealing from peers.
+func NewQueue(local internal.IQueue, cfg Config) *Queue {
+	if cfg.StealInterval <= 0 {
+		cfg.StealInterval = 100 * time.Millisecond
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 5 * time.Second
+	}
+	if cfg.StealVisibility <= 0 {
+		cfg.StealVisibility = 30 * time.Second
+	}
+
+	q := &Queue{
+		IQueue: local,
+		cfg:    cfg,
+		done:   make(chan struct{}),
+	}
+	for _, addr := range cfg.Peers {
+		q.peers = append(q.peers, newPeer(addr))
+	}
+
+	q.stealing.Add(1)
+	go q.stealLoop()
+
+	return q
+}
+
+// Put queues the task locally, or on the first peer with room if the local
+// queue is full and the task has no key.
+func (q *Queue) Put(task *tasks.Task) (<-chan internal.Output, error) {
+	return q.put(task, q.IQueue.Put)
+}
+
+// PutStream is Put with streamed updates. Only tasks that run locally
+// stream; forwarded tasks just report their final output.
+func (q *Queue) PutStream(task *tasks.Task, emitter tasks.Emitter) (<-chan internal.Output, error) {
+	streamer, ok := q.IQueue.(internal.Streamer)
+	if !ok {
+		return q.Put(task)
+	}
+	return q.put(task, func(task *tasks.Task) (<-chan internal.Output, error) {
+		return streamer.PutStream(task, emitter)
+	})
+}
+
+func (q *Queue) put(task *tasks.Task, putLocal func(*tasks.Task) (<-chan internal.Output, error)) (<-chan internal.Output, error) {
+	ch, err := putLocal(task)
+	// Keyed tasks stay where the earlier tasks of their key are ordered.
+	if !errors.Is(err, internal.ErrQueueFull) || len(q.peers) == 0 || task.Key != "" {
+		return ch, err
+	}
+
+	start := atomic.AddUint64(&q.nextPeer, 1)
+	for i := range q.peers {
+		p := q.peers[(int(start)+i)%len(q.peers)]
+		ch, err := p.forward(task, q.cfg.RequestTimeout)
+		if err != nil {
+			q.logf("forward %s to %s: %v\n", task.Id, p.addr, err)
+			continue
+		}
+
+		q.forwarded.Store(task.Id, p)
+		return q.untrackForward(task.Id, ch), nil
+	}
+
+	return nil, internal.ErrQueueFull
+}
+
+// PutLocal queues a task forwarded by a peer without forwarding it again.
+func (q *Queue) PutLocal(task *tasks.Task) (<-chan internal.Output, error) {
+	return q.IQueue.Put(task)
+}
+
+// Pull hands tasks of the local queue to remote workers.
+func (q *Queue) Pull(ctx context.Context, types []string) (*internal.Claim, error) {
+	puller, ok := q.IQueue.(internal.Puller)
+	if !ok {
+		return nil, internal.ErrPullUnsupported
+	}
+	return puller.Pull(ctx, types)
+}
+
+// Lease is Pull with a visibility timeout, see internal.Puller.
+func (q *Queue) Lease(ctx context.Context, types []string, visibility time.Duration) (*internal.Claim, error) {
+	puller, ok := q.IQueue.(internal.Puller)
+	if !ok {
+		return nil, internal.ErrPullUnsupported
+	}
+	return puller.Lease(ctx, types, visibility)
+}
+
+// Wait waits for a task queued locally. Tasks forwarded to a peer are not
+// found; the client submits them again.
+func (q *Queue) Wait(id string) (<-chan internal.Output, error) {
+	waiter, ok := q.IQueue.(interface {
+		Wait(id string) (<-chan internal.Output, error)
+	})
+	if !ok {
+		return nil, internal.ErrTaskNotFound
+	}
+	return waiter.Wait(id)
+}
+
+// Cancel cancels the task locally or on the peer it was forwarded to.
+func (q *Queue) Cancel(id string) error {
+	err := q.IQueue.Cancel(id)
+	if !errors.Is(err, internal.ErrTaskNotFound) {
+		return err
+	}
+
+	value, ok := q.forwarded.Load(id)
+	if !ok {
+		return err
+	}
+	_, err = value.(*peer).call(protocol.Request{Op: protocol.OpCancel, Task: tasks.Task{Id: id}}, q.cfg.RequestTimeout)
+	return err
+}
+
+// Shutdown stops stealing, drains the local queue and reports every stolen
+// task back to its owner before closing the peer connections.
+func (q *Queue) Shutdown() error {
+	close(q.done)
+	err := q.IQueue.Shutdown()
+	q.stealing.Wait()
+
+	for _, p := range q.peers {
+		p.close()
+	}
+	return err
+}
+
+func (q *Queue) untrackForward(id string, ch <-chan internal.Output) <-chan internal.Output {
+	channel := make(chan internal.Output, 1)
+	go func() {
+		output := <-ch
+		q.forwarded.Delete(id)
+		channel <- output
+		close(channel)
+	}()
+	return channel
+}
+
+func (q *Queue) stealLoop() {
+	defer q.stealing.Done()
+
+	ticker := time.NewTicker(q.cfg.StealInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+
+		// Keep stealing while there is a free worker and nothing queued.
+		for q.idle() {
+			stolen := false
+			for _, p := range q.peers {
+				if q.steal(p) {
+					stolen = true
+					break
+				}
+			}
+			if !stolen {
+				break
+			}
+		}
+	}
+}
+
+func (q *Queue) idle() bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	stats := q.IQueue.Stats()
+	return !stats.Paused && stats.Size < stats.Workers
+}
+
+// steal asks p for one queued task and runs it locally. It reports whether
+// a task was stolen.
+func (q *Queue) steal(p *peer) bool {
+	id := "steal-" + strconv.FormatUint(atomic.AddUint64(&q.stealSeq, 1), 10)
+	resp, err := p.call(protocol.Request{Op: protocol.OpSteal, Task: tasks.Task{Id: id}, Visibility: q.cfg.StealVisibility}, q.cfg.RequestTimeout)
+	if err != nil || resp.Task == nil {
+		return false
+	}
+
+	remoteID := resp.Task.Id
+	task := *resp.Task
+	task.Id = fmt.Sprintf("stolen/%s/%s", p.addr, remoteID)
+
+	ch, err := q.IQueue.Put(&task)
+	if err != nil {
+		// Hand it back so the owner runs it.
+		p.send(protocol.Request{Op: protocol.OpRelease, Task: tasks.Task{Id: remoteID}})
+		return false
+	}
+	q.logf("stole task %s from %s\n", remoteID, p.addr)
+
+	// A task the owner cancels is stopped here, and reported cancelled.
+	forget := p.onCancel(remoteID, func() { q.IQueue.Cancel(task.Id) })
+
+	q.stealing.Add(1)
+	go func() {
+		defer q.stealing.Done()
+		defer forget()
+
+		// Keep the lease while the task runs.
+		ticker := time.NewTicker(q.cfg.StealVisibility / 3)
+		defer ticker.Stop()
+		var output internal.Output
+		for waiting := true; waiting; {
+			select {
+			case output = <-ch:
+				waiting = false
+			case <-ticker.C:
+				p.send(protocol.Request{Op: protocol.OpExtend, Task: tasks.Task{Id: remoteID}, Visibility: q.cfg.StealVisibility})
+			}
+		}
+		req := protocol.Request{Op: protocol.OpComplete, Task: tasks.Task{Id: remoteID}, Result: output.Res, Blob: output.Blob}
+		if output.Err != nil {
+			req.Result, req.Blob = nil, ""
+			req.Error = output.Err.Error()
+		}
+		if _, err := p.send(req); err != nil {
+			q.logf("report stolen task %s to %s: %v\n", remoteID, p.addr, err)
+		}
+	}()
+	return true
+}
+
+func (q *Queue) logf(format string, args ...any) {
+	if q.cfg.LogDisabled {
+		return
+	}
+	fmt.Printf(format, args...)
+}
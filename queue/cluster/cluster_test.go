@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/server"
+	"vu/benchmark/queue/tasks"
+)
+
+// freeAddr reserves a loopback port so nodes can list each other as peers
+// before any of them is listening.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func startNode(t *testing.T, addr string, capacity int, workers int, peers []string) *Queue {
+	t.Helper()
+
+	local := internal.NewQueue(capacity, workers, true)
+	queue := NewQueue(local, Config{Peers: peers, StealInterval: 10 * time.Millisecond, LogDisabled: true})
+	done := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.Serve(addr, queue, done)
+	}()
+
+	// Wait until the node accepts connections.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("node %s did not start: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		close(done)
+		<-served
+		queue.Shutdown()
+	})
+	return queue
+}
+
+type testClient struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testClient{conn: conn, encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}
+}
+
+func (c *testClient) submitSum(t *testing.T, id int) {
+	t.Helper()
+
+	input, _ := json.Marshal(tasks.SumTaskInput{A: id, B: id})
+	task := tasks.Task{Id: strconv.Itoa(id), Type: tasks.SumTaskType, Input: input}
+	if err := c.encoder.Encode(protocol.Request{Task: task}); err != nil {
+		t.Fatalf("submit %d: %v", id, err)
+	}
+}
+
+func (c *testClient) receive(t *testing.T) protocol.Response {
+	t.Helper()
+
+	var resp protocol.Response
+	if err := c.decoder.Decode(&resp); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	return resp
+}
+
+func checkSum(t *testing.T, resp protocol.Response) {
+	t.Helper()
+
+	if resp.Error != "" {
+		t.Fatalf("task %s failed: %s", resp.ID, resp.Error)
+	}
+	id, _ := strconv.Atoi(resp.ID)
+	var out tasks.SumTaskOutput
+	if err := json.Unmarshal(resp.Result, &out); err != nil || out.Res != 2*id {
+		t.Fatalf("task %s: unexpected result %s", resp.ID, resp.Result)
+	}
+}
+
+// A node without workers can only finish tasks if its peer steals them.
+func TestIdleNodeStealsQueuedTasks(t *testing.T) {
+	busy, idle := freeAddr(t), freeAddr(t)
+	startNode(t, busy, 10, 0, []string{idle})
+	startNode(t, idle, 10, 2, []string{busy})
+
+	client := dial(t, busy)
+	for i := 1; i <= 5; i++ {
+		client.submitSum(t, i)
+	}
+	for i := 1; i <= 5; i++ {
+		checkSum(t, client.receive(t))
+	}
+}
+
+// Cancelling a stolen task stops it on the node that stole it.
+func TestCancelStolenTaskStopsIt(t *testing.T) {
+	busy, idle := freeAddr(t), freeAddr(t)
+	busyQueue := startNode(t, busy, 10, 0, []string{idle})
+	idleQueue := startNode(t, idle, 10, 1, []string{busy})
+
+	// Far longer than the test, unless it is stopped.
+	input, _ := json.Marshal(tasks.BurnCPUTaskInput{Iteration: 1 << 50})
+	client := dial(t, busy)
+	if err := client.encoder.Encode(protocol.Request{Task: tasks.Task{Id: "1", Type: tasks.BurnCPUTaskType, Input: input}}); err != nil {
+		t.Fatal(err)
+	}
+	for idleQueue.Stats().Running == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.encoder.Encode(protocol.Request{Op: protocol.OpCancel, Task: tasks.Task{Id: "1"}}); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		resp := client.receive(t)
+		if resp.Op == "" && resp.Error != internal.ErrCancelled.Error() {
+			t.Fatalf("expected task 1 to be cancelled, got %+v", resp)
+		}
+	}
+	if stats := busyQueue.Stats(); stats.Size != 0 {
+		t.Errorf("busy node still has the task: %+v", stats)
+	}
+	for idleQueue.Stats().Size != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Once the first node is full, submissions run on its peer.
+func TestFullNodeForwardsToPeer(t *testing.T) {
+	full, peer := freeAddr(t), freeAddr(t)
+	// The peer has no peers of its own so it never steals; only forwarding
+	// can get tasks to it.
+	startNode(t, full, 1, 0, []string{peer})
+	peerQueue := startNode(t, peer, 10, 2, nil)
+
+	client := dial(t, full)
+	for i := 1; i <= 4; i++ {
+		client.submitSum(t, i)
+	}
+
+	// Task 1 took the only local slot and stays there; the rest are
+	// forwarded and complete.
+	for i := 2; i <= 4; i++ {
+		resp := client.receive(t)
+		if resp.ID == "1" {
+			t.Fatalf("task 1 should still be queued, got %+v", resp)
+		}
+		checkSum(t, resp)
+	}
+	if stats := peerQueue.Stats(); stats.Size != 0 {
+		t.Fatalf("peer should be drained, got %+v", stats)
+	}
+
+	if err := client.encoder.Encode(protocol.Request{Op: protocol.OpCancel, Task: tasks.Task{Id: "1"}}); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		resp := client.receive(t)
+		if resp.Op == "" && resp.Error != internal.ErrCancelled.Error() {
+			t.Fatalf("expected task 1 to be cancelled, got %+v", resp)
+		}
+	}
+}
+
+func TestCancelForwardedTaskReportsPeerError(t *testing.T) {
+	// A peer that queues forwarded tasks but cannot cancel them.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder, encoder := json.NewDecoder(conn), json.NewEncoder(conn)
+		for {
+			var req protocol.Request
+			if err := decoder.Decode(&req); err != nil {
+				return
+			}
+			resp := protocol.Response{ID: req.Id, Op: req.Op}
+			if req.Op == protocol.OpCancel {
+				resp.Error = "cancel failed"
+			}
+			encoder.Encode(resp)
+		}
+	}()
+
+	// Full from the start, so every task is forwarded.
+	queue := NewQueue(internal.NewQueue(0, 0, true), Config{Peers: []string{ln.Addr().String()}, StealInterval: time.Hour, LogDisabled: true})
+	defer queue.Shutdown()
+	if _, err := queue.Put(&tasks.Task{Id: "a", Type: tasks.SumTaskType}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Cancel("a"); err == nil || err.Error() != "cancel failed" {
+		t.Errorf("cancel: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/tasks"
+)
+
+var errPeerClosed = errors.New("peer connection closed")
+
+// peer is a multiplexed connection to another node. Responses are routed to
+// waiters by op and task id; the connection is dialed lazily and redialed
+// after it breaks.
+type peer struct {
+	addr    string
+	mutex   sync.Mutex
+	conn    net.Conn
+	encoder *json.Encoder
+	waiters map[string]chan protocol.Response
+	// cancels stop the tasks stolen from the peer by their id there, when
+	// the peer says they were cancelled.
+	cancels map[string]func()
+	closed  bool
+}
+
+func newPeer(addr string) *peer {
+	return &peer{addr: addr, cancels: make(map[string]func())}
+}
+
+func waiterKey(op string, id string) string {
+	return op + "|" + id
+}
+
+// connect dials the peer if needed. The caller must hold p.mutex.
+func (p *peer) connect() error {
+	if p.closed {
+		return errPeerClosed
+	}
+	if p.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", p.addr, time.Second)
+	if err != nil {
+		return err
+	}
+	// Introduce ourselves, so the peer lets us steal. Its answer matches
+	// no waiter and is dropped.
+	encoder := json.NewEncoder(conn)
+	if err := encoder.Encode(protocol.Request{Op: protocol.OpPeer}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	p.encoder = encoder
+	p.waiters = make(map[string]chan protocol.Response)
+	go p.read(conn, p.waiters)
+	return nil
+}
+
+func (p *peer) read(conn net.Conn, waiters map[string]chan protocol.Response) {
+	decoder := json.NewDecoder(conn)
+	for {
+		var resp protocol.Response
+		if err := decoder.Decode(&resp); err != nil {
+			break
+		}
+
+		if resp.Op == protocol.OpCancel && resp.Error == internal.ErrCancelled.Error() {
+			// Not an answer: a task stolen from the peer was cancelled.
+			p.mutex.Lock()
+			cancel := p.cancels[resp.ID]
+			p.mutex.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+			continue
+		}
+
+		p.mutex.Lock()
+		key := waiterKey(resp.Op, resp.ID)
+		if ch, ok := waiters[key]; ok {
+			delete(waiters, key)
+			ch <- resp
+		}
+		p.mutex.Unlock()
+	}
+
+	// Fail everyone still waiting on this connection.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conn.Close()
+	for key, ch := range waiters {
+		delete(waiters, key)
+		ch <- protocol.Response{Error: errPeerClosed.Error()}
+	}
+	if p.conn == conn {
+		p.conn = nil
+	}
+}
+
+// send writes req and registers a waiter for each of the given ops on
+// req.Id. The returned channels are in the same order as ops.
+func (p *peer) send(req protocol.Request, ops ...string) ([]chan protocol.Response, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+
+	chans := make([]chan protocol.Response, len(ops))
+	for i, op := range ops {
+		chans[i] = make(chan protocol.Response, 1)
+		p.waiters[waiterKey(op, req.Id)] = chans[i]
+	}
+
+	if err := p.encoder.Encode(req); err != nil {
+		for _, op := range ops {
+			delete(p.waiters, waiterKey(op, req.Id))
+		}
+		p.conn.Close()
+		return nil, err
+	}
+	return chans, nil
+}
+
+// onCancel calls cancel should the peer cancel the task id stolen from it,
+// until the returned function is called.
+func (p *peer) onCancel(id string, cancel func()) func() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.cancels[id] = cancel
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		delete(p.cancels, id)
+	}
+}
+
+// forget drops the waiter for op on id, e.g. after a timeout.
+func (p *peer) forget(op string, id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.waiters, waiterKey(op, id))
+}
+
+// call sends req and waits for the response with the same op and id.
+func (p *peer) call(req protocol.Request, timeout time.Duration) (protocol.Response, error) {
+	chans, err := p.send(req, req.Op)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	select {
+	case resp := <-chans[0]:
+		if resp.Error != "" {
+			return resp, errors.New(resp.Error)
+		}
+		return resp, nil
+	case <-time.After(timeout):
+		p.forget(req.Op, req.Id)
+		return protocol.Response{}, fmt.Errorf("peer %s: %s timed out", p.addr, req.Op)
+	}
+}
+
+// forward submits task to the peer and waits until the peer has queued it.
+// The returned channel receives the task's output once the peer is done.
+func (p *peer) forward(task *tasks.Task, timeout time.Duration) (<-chan internal.Output, error) {
+	chans, err := p.send(protocol.Request{Op: protocol.OpForward, Task: *task}, protocol.OpForward, "")
+	if err != nil {
+		return nil, err
+	}
+	ack, result := chans[0], chans[1]
+
+	select {
+	case resp := <-ack:
+		if resp.Error != "" {
+			p.forget("", task.Id)
+			return nil, errors.New(resp.Error)
+		}
+	case <-time.After(timeout):
+		p.forget(protocol.OpForward, task.Id)
+		p.forget("", task.Id)
+		// The peer may still queue it later; make sure it does not run.
+		p.send(protocol.Request{Op: protocol.OpCancel, Task: tasks.Task{Id: task.Id}})
+		return nil, fmt.Errorf("peer %s: forward timed out", p.addr)
+	}
+
+	channel := make(chan internal.Output, 1)
+	go func() {
+		resp := <-result
+		output := internal.Output{Res: resp.Result, Blob: resp.Blob}
+		if resp.Error != "" {
+			output = internal.Output{Err: errors.New(resp.Error)}
+		}
+		channel <- output
+		close(channel)
+	}()
+	return channel, nil
+}
+
+func (p *peer) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
@@ -4,22 +4,28 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"vu/benchmark/queue/runner"
 )
 
 func main() {
-	addr := flag.String("addr", ":8080", "queue server address")
+	addr := flag.String("addr", ":8080", "queue server address, comma-separated for several servers")
 	total := flag.Int("total", 1000, "total tasks to run")
 	concurrency := flag.Int("concurrency", 8, "concurrent client workers")
 	iterations := flag.Int("iterations", 100000, "hash iterations per tasks")
+	profilePath := flag.String("profile", "", "JSON load profile to replay open-loop instead of a fixed number of tasks")
+	name := flag.String("name", "", "label for this run in its report, e.g. the commit")
+	jsonOut := flag.String("json", "", "write the run report as JSON to this file")
+	csvOut := flag.String("csv", "", "write the per-second time series as CSV to this file")
 	flag.Parse()
 
-	err := runner.RunClient(runner.ClientConfig{
-		Addr:        *addr,
+	err := runner.RunBench(runner.ClientConfig{
+		Addrs:       strings.Split(*addr, ","),
 		Total:       *total,
 		Concurrency: *concurrency,
 		Iterations:  *iterations,
-	})
+		Output:      runner.OutputConfig{Name: *name, JSONPath: *jsonOut, CSVPath: *csvOut},
+	}, *profilePath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseBenchWithInterleavedLogs(t *testing.T) {
+	output := `goos: darwin
+pkg: vu/benchmark/queue
+BenchmarkQueueHashFixedIterations-8   	2025/12/15 15:13:18 profile: cpu profiling enabled, cpu.pprof
+2025/12/15 15:13:20 profile: cpu profiling disabled, cpu.pprof
+       4	 253199010 ns/op
+BenchmarkTestIOBound-8   	       1	14376943375 ns/op	  129008 B/op	    2536 allocs/op
+BenchmarkTestIOBound-8   	       1	14269710167 ns/op	  116896 B/op	    2509 allocs/op
+PASS
+`
+	s := make(samples)
+	if err := parseBench([]byte(output), s); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[key][]float64{
+		{"BenchmarkQueueHashFixedIterations-8", "ns/op"}: {253199010},
+		{"BenchmarkTestIOBound-8", "ns/op"}:              {14376943375, 14269710167},
+		{"BenchmarkTestIOBound-8", "B/op"}:               {129008, 116896},
+		{"BenchmarkTestIOBound-8", "allocs/op"}:          {2536, 2509},
+	}
+	if len(s) != len(want) {
+		t.Fatalf("parsed %v, want %v", s, want)
+	}
+	for k, values := range want {
+		got := s[k]
+		if len(got) != len(values) {
+			t.Fatalf("%v = %v, want %v", k, got, values)
+		}
+		for i := range values {
+			if got[i] != values[i] {
+				t.Errorf("%v = %v, want %v", k, got, values)
+			}
+		}
+	}
+}
+
+func TestDeltaInterval(t *testing.T) {
+	old := summarize([]float64{100, 102, 98, 101, 99})
+	same := summarize([]float64{101, 99, 100, 103, 97})
+	slower := summarize([]float64{120, 122, 118, 121, 119})
+
+	if diff, half, ok := delta(old, same); !ok || math.Abs(diff) > half {
+		t.Errorf("noise looks significant: diff %v ± %v", diff, half)
+	}
+	if diff, half, ok := delta(old, slower); !ok || diff-half <= 0 {
+		t.Errorf("20%% slowdown not significant: diff %v ± %v", diff, half)
+	}
+	if _, _, ok := delta(summarize([]float64{100}), slower); ok {
+		t.Error("interval from a single run")
+	}
+}
+
+func TestJudge(t *testing.T) {
+	old := summarize([]float64{100, 102, 98, 101, 99})
+	cases := []struct {
+		name       string
+		metric     string
+		new        []float64
+		verdict    string
+		regression bool
+	}{
+		{"noise", "ns/op", []float64{101, 99, 100, 103, 97}, "~", false},
+		{"20% slower", "ns/op", []float64{120, 122, 118, 121, 119}, "REGRESSION", true},
+		{"20% faster", "ns/op", []float64{80, 82, 78, 81, 79}, "better", false},
+		// 6% slower is beyond 5%, but its interval reaches back below it.
+		{"just beyond the threshold", "ns/op", []float64{106, 108, 104, 107, 105}, "worse", false},
+		{"lower throughput", "tasks/s", []float64{80, 82, 78, 81, 79}, "REGRESSION", true},
+		{"single run", "ns/op", []float64{150}, "worse (single run, no interval)", false},
+	}
+	for _, c := range cases {
+		verdict, regression := judge(c.metric, old, summarize(c.new), 5)
+		if verdict != c.verdict || regression != c.regression {
+			t.Errorf("%s: %s, %v; want %s, %v", c.name, verdict, regression, c.verdict, c.regression)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Command benchcmp compares benchmark results and fails on regressions.
+//
+//	benchcmp [-threshold=5] 'old/*.txt' 'new/*.txt' ...
+//
+// Each argument is a glob naming one set of results; files in a set are
+// repeated runs of the same benchmark. A file is either a JSON report written
+// by the benchmark client (-json) or the output of `go test -bench`, where
+// -count=N gives N runs in one file. Every set after the first is compared
+// with the first, and the exit status is 1 when any metric got worse by more
+// than the threshold with 95% confidence, that is when the whole 95% interval
+// of its change lies beyond the threshold. Sets of a single run have no
+// interval; their changes are shown but never fail the comparison.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	threshold := flag.Float64("threshold", 5, "percentage by which a metric may get worse before it counts as a regression")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] baseline-glob other-glob...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sets := make([]samples, flag.NArg())
+	for i, pattern := range flag.Args() {
+		set, err := readSet(pattern)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		sets[i] = set
+	}
+
+	regressions := 0
+	for i := 1; i < len(sets); i++ {
+		fmt.Printf("%s vs %s\n", flag.Arg(0), flag.Arg(i))
+		regressions += compare(sets[0], sets[i], *threshold)
+		fmt.Println()
+	}
+	if regressions > 0 {
+		fmt.Printf("%d regression(s) beyond %.1f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
+
+func readSet(pattern string) (samples, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no such files", pattern)
+	}
+
+	set := make(samples)
+	for _, path := range paths {
+		if err := readFile(path, set); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// compare prints one row per metric found in both sets and returns the
+// number of regressions.
+func compare(old, new samples, threshold float64) int {
+	keys := make([]key, 0, len(old))
+	for k := range old {
+		if _, ok := new[k]; ok {
+			keys = append(keys, k)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s %s: missing from the new results\n", k.name, k.metric)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].metric < keys[j].metric
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "name\tmetric\told\tnew\tdelta\t")
+
+	regressions := 0
+	for _, k := range keys {
+		o, n := summarize(old[k]), summarize(new[k])
+		diff, half, ok := delta(o, n)
+
+		change := "n/a"
+		if o.mean != 0 {
+			change = fmt.Sprintf("%+.2f%%", diff/o.mean*100)
+			if ok {
+				change += fmt.Sprintf(" ±%.2f%%", half/math.Abs(o.mean)*100)
+			}
+		}
+		verdict, regression := judge(k.metric, o, n, threshold)
+		if regression {
+			regressions++
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s %s\t\n",
+			k.name, k.metric, format(k.metric, o), format(k.metric, n), change, verdict)
+	}
+	w.Flush()
+	return regressions
+}
+
+// judge classifies the change of metric from o to n. It is a regression
+// when it is for the worse and even the near end of its 95% interval is
+// more than threshold percent of the old mean away.
+func judge(metric string, o, n summary, threshold float64) (verdict string, regression bool) {
+	diff, half, ok := delta(o, n)
+	worse := diff > 0
+	if higherIsBetter(metric) {
+		worse = diff < 0
+	}
+
+	switch {
+	case diff == 0:
+		return "~", false
+	case !ok && worse:
+		return "worse (single run, no interval)", false
+	case !ok:
+		return "better (single run, no interval)", false
+	case math.Abs(diff) <= half:
+		return "~", false
+	case !worse:
+		return "better", false
+	case math.Abs(diff)-half > threshold/100*math.Abs(o.mean):
+		return "REGRESSION", true
+	default:
+		return "worse", false
+	}
+}
+
+func format(metric string, s summary) string {
+	var value string
+	if isDuration(metric) {
+		value = time.Duration(s.mean).Round(time.Microsecond).String()
+		if s.mean < float64(time.Microsecond) {
+			value = time.Duration(s.mean).String()
+		}
+	} else {
+		value = strconv.FormatFloat(s.mean, 'g', 4, 64)
+	}
+
+	if s.n < 2 || s.mean == 0 {
+		return fmt.Sprintf("%s (n=%d)", value, s.n)
+	}
+	return fmt.Sprintf("%s ±%.1f%% (n=%d)", value, s.ci95()/math.Abs(s.mean)*100, s.n)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"vu/benchmark/queue/metrics"
+)
+
+// key identifies one measured quantity, e.g. ("BenchmarkTestIOBound-8",
+// "ns/op") or ("client", "p99").
+type key struct {
+	name   string
+	metric string
+}
+
+// samples holds every observation of each key across the files of a set.
+type samples map[key][]float64
+
+func (s samples) add(k key, v float64) {
+	s[k] = append(s[k], v)
+}
+
+// readFile adds the results in path to s. JSON files are reports written by
+// the benchmark client; anything else is parsed as `go test -bench` output.
+func readFile(path string, s samples) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		report, err := metrics.ReadReport(path)
+		if err != nil {
+			return err
+		}
+		addReport(report, s)
+		return nil
+	}
+	if err := parseBench(data, s); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// addReport adds a client report. Its Name labels the run (a commit, say),
+// so it is not part of the key: runs of different builds must line up.
+func addReport(report *metrics.Report, s samples) {
+	const name = "client"
+	l := report.Latency
+	s.add(key{name, "tasks/s"}, report.Throughput)
+	s.add(key{name, "failed"}, float64(report.Failed))
+	s.add(key{name, "mean"}, float64(l.Mean))
+	s.add(key{name, "p50"}, float64(l.P50))
+	s.add(key{name, "p90"}, float64(l.P90))
+	s.add(key{name, "p99"}, float64(l.P99))
+	s.add(key{name, "p99.9"}, float64(l.P999))
+}
+
+// parseBench reads `go test -bench` output. Benchmarks that log while they
+// run get the log line spliced between their name and their numbers, as in
+// bench/cpu_bound, so a name without numbers is kept until the numbers turn
+// up on a later line.
+func parseBench(data []byte, s samples) error {
+	var pending string
+	found := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := pending
+		if strings.HasPrefix(fields[0], "Benchmark") {
+			name = fields[0]
+			fields = fields[1:]
+			if len(fields) == 0 || !isInt(fields[0]) {
+				pending = name
+				continue
+			}
+		}
+		if name == "" || len(fields) < 3 || !isInt(fields[0]) {
+			continue
+		}
+		pending = ""
+
+		// fields[0] is the iteration count, then value/unit pairs.
+		for i := 1; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				break
+			}
+			s.add(key{name, fields[i+1]}, v)
+			found = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no benchmark results")
+	}
+	return nil
+}
+
+func isInt(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// higherIsBetter reports the direction of a metric: throughputs improve
+// upwards, times, sizes and failure counts downwards.
+func higherIsBetter(metric string) bool {
+	return strings.HasSuffix(metric, "/s")
+}
+
+// isDuration reports metrics stored in nanoseconds.
+func isDuration(metric string) bool {
+	switch metric {
+	case "ns/op", "mean", "p50", "p90", "p99", "p99.9":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import "math"
+
+type summary struct {
+	n        int
+	mean     float64
+	variance float64
+}
+
+func summarize(values []float64) summary {
+	s := summary{n: len(values)}
+	for _, v := range values {
+		s.mean += v
+	}
+	s.mean /= float64(s.n)
+	if s.n > 1 {
+		for _, v := range values {
+			s.variance += (v - s.mean) * (v - s.mean)
+		}
+		s.variance /= float64(s.n - 1)
+	}
+	return s
+}
+
+// ci95 is the half-width of the 95% confidence interval of the mean.
+func (s summary) ci95() float64 {
+	if s.n < 2 {
+		return 0
+	}
+	return tCritical(float64(s.n-1)) * math.Sqrt(s.variance/float64(s.n))
+}
+
+// delta compares two sets of runs. It returns the difference of the means
+// and the half-width of its 95% confidence interval (Welch's t-interval, so
+// the two sets may have different variances and sizes). ok is false when
+// either side has a single run and no interval can be computed.
+func delta(old, new summary) (diff, half float64, ok bool) {
+	diff = new.mean - old.mean
+	if old.n < 2 || new.n < 2 {
+		return diff, 0, false
+	}
+
+	vo := old.variance / float64(old.n)
+	vn := new.variance / float64(new.n)
+	se := math.Sqrt(vo + vn)
+	if se == 0 {
+		return diff, 0, true
+	}
+	df := (vo + vn) * (vo + vn) / (vo*vo/float64(old.n-1) + vn*vn/float64(new.n-1))
+	return diff, tCritical(df) * se, true
+}
+
+// tTable holds two-sided 95% critical values of Student's t for 1 to 30
+// degrees of freedom.
+var tTable = [...]float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tCritical returns the two-sided 95% critical value for df degrees of
+// freedom, rounding df down so the interval errs on the wide side.
+func tCritical(df float64) float64 {
+	switch d := int(df); {
+	case d < 1:
+		return tTable[0]
+	case d <= len(tTable):
+		return tTable[d-1]
+	case d < 40:
+		return tTable[len(tTable)-1]
+	case d < 60:
+		return 2.021
+	case d < 120:
+		return 2.000
+	default:
+		return 1.980
+	}
+}
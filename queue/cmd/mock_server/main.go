@@ -1,60 +1,72 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"flag"
 	"log"
-	"math/rand"
-	"net"
 	"os"
+	"os/signal"
 	"strconv"
-	"sync/atomic"
+	"syscall"
 	"time"
+	"vu/benchmark/queue/mockserver"
 )
 
-var count int64
-
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatalf("usage: %s <listen_addr> <sleep_ms>", os.Args[0])
+	dist := flag.String("dist", mockserver.Uniform, "latency distribution: fixed, uniform, normal or longtail")
+	jitter := flag.Duration("jitter", 200*time.Millisecond, "spread of the latency around the base sleep")
+	maxLatency := flag.Duration("max-latency", 0, "cap on any single delay (0 for none)")
+	fault := flag.String("fault", "", "fault to inject: close, refuse, reset, partial, hang or trickle; none if empty")
+	failurePercent := flag.Float64("failure-percent", 100, "percentage of requests that get -fault, like the control port's fault command (refuse applies to all)")
+	trickle := flag.Duration("trickle-interval", 500*time.Millisecond, "pause between reply bytes under the trickle fault")
+	control := flag.String("control", "", "address of a control port to change faults and latency at runtime")
+	maxConns := flag.Int("max-conns", 0, "connections served at once (0 for unlimited)")
+	flag.Usage = func() {
+		log.Printf("usage: %s [flags] <listen_addr> <sleep_ms>", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	addr := os.Args[1]
-	sleepMs, err := strconv.Atoi(os.Args[2])
+	addr := flag.Arg(0)
+	sleepMs, err := strconv.Atoi(flag.Arg(1))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	errorRate := *failurePercent / 100
+	if *fault == "" {
+		errorRate = 0
+	}
+	server, err := mockserver.Start(mockserver.Config{
+		Addr: addr,
+		Latency: mockserver.Latency{
+			Distribution: *dist,
+			Base:         time.Duration(sleepMs) * time.Millisecond,
+			Jitter:       *jitter,
+			Max:          *maxLatency,
+		},
+		Fault:           *fault,
+		ErrorRate:       errorRate,
+		TrickleInterval: *trickle,
+		MaxConns:        *maxConns,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Mock TCP server listening on %s, sleep=%dms", addr, sleepMs)
-
-	for {
-		conn, err := ln.Accept()
+	if *control != "" {
+		controlAddr, err := server.StartControl(*control)
 		if err != nil {
-			log.Println("accept error:", err)
-			continue
+			log.Fatal(err)
 		}
-
-		go handleConn(conn, time.Duration(sleepMs)*time.Millisecond)
+		log.Printf("Control port listening on %s", controlAddr)
 	}
-}
-
-func handleConn(conn net.Conn, sleep time.Duration) {
-	defer conn.Close()
-
-	curCount := atomic.AddInt64(&count, 1)
-	fmt.Printf("Receive connection %d\n", curCount)
-	// Optional read (forces real I/O)
-	reader := bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n')
-
-	// Simulate I/O wait
-	jitter := time.Duration(rand.Intn(200)) * time.Millisecond
-	time.Sleep(sleep + jitter)
 
-	// Small response
-	_, _ = fmt.Fprintln(conn, "OK")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	server.Close()
 }
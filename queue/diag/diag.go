@@ -0,0 +1,181 @@
+// Package diag serves profiling and runtime diagnostics of a live queue
+// server over HTTP:
+//
+//	/debug/pprof/                 net/http/pprof
+//	/debug/runtime                goroutines, heap and GC pauses as JSON
+//	/debug/queue                  the queue's Stats as JSON
+//	/debug/trace/capture?seconds= writes an execution trace to Config.TraceDir
+package diag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/trace"
+	"strconv"
+	"time"
+)
+
+// recentPauses is how many of the last GC pauses /debug/runtime lists.
+const recentPauses = 16
+
+type Config struct {
+	Addr string
+	// TraceDir is where captured traces are written, the working directory
+	// by default.
+	TraceDir string
+	// MaxTrace bounds the duration of one trace capture, 60s by default.
+	MaxTrace time.Duration
+	// Stats, if set, is served as JSON on /debug/queue.
+	Stats func() any
+}
+
+// RuntimeStats is the body of /debug/runtime.
+type RuntimeStats struct {
+	Goroutines  int    `json:"goroutines"`
+	NumCPU      int    `json:"numCPU"`
+	GOMAXPROCS  int    `json:"gomaxprocs"`
+	HeapAlloc   uint64 `json:"heapAlloc"`
+	HeapInuse   uint64 `json:"heapInuse"`
+	HeapObjects uint64 `json:"heapObjects"`
+	Sys         uint64 `json:"sys"`
+	NumGC       uint32 `json:"numGC"`
+	// GCCPUFraction is the share of CPU time used by the GC since start.
+	GCCPUFraction float64         `json:"gcCPUFraction"`
+	PauseTotal    time.Duration   `json:"pauseTotal"`
+	RecentPauses  []time.Duration `json:"recentPauses"`
+}
+
+func readRuntimeStats() RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := RuntimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		NumCPU:        runtime.NumCPU(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		HeapAlloc:     m.HeapAlloc,
+		HeapInuse:     m.HeapInuse,
+		HeapObjects:   m.HeapObjects,
+		Sys:           m.Sys,
+		NumGC:         m.NumGC,
+		GCCPUFraction: m.GCCPUFraction,
+		PauseTotal:    time.Duration(m.PauseTotalNs),
+	}
+	// PauseNs is a circular buffer; the latest pause is at (NumGC+255)%256.
+	for i := uint32(0); i < min(m.NumGC, recentPauses); i++ {
+		index := (m.NumGC - 1 - i) % uint32(len(m.PauseNs))
+		stats.RecentPauses = append(stats.RecentPauses, time.Duration(m.PauseNs[index]))
+	}
+	return stats
+}
+
+// Handler returns the diagnostics endpoints.
+func Handler(cfg Config) http.Handler {
+	if cfg.TraceDir == "" {
+		cfg.TraceDir = "."
+	}
+	if cfg.MaxTrace <= 0 {
+		cfg.MaxTrace = time.Minute
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, readRuntimeStats())
+	})
+	mux.HandleFunc("/debug/queue", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Stats == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, cfg.Stats())
+	})
+	mux.HandleFunc("/debug/trace/capture", func(w http.ResponseWriter, r *http.Request) {
+		captureTrace(w, r, cfg)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// captureTrace records an execution trace for ?seconds= (1 by default) into
+// a new file under cfg.TraceDir and replies with its path once done.
+func captureTrace(w http.ResponseWriter, r *http.Request, cfg Config) {
+	duration := time.Second
+	if s := r.URL.Query().Get("seconds"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "seconds must be a positive number", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	if duration > cfg.MaxTrace {
+		http.Error(w, fmt.Sprintf("traces are limited to %v", cfg.MaxTrace), http.StatusBadRequest)
+		return
+	}
+
+	pattern := fmt.Sprintf("trace-%s-*.out", time.Now().Format("20060102-150405"))
+	file, err := os.CreateTemp(cfg.TraceDir, pattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	path := file.Name()
+
+	// Only one trace can run at a time, including /debug/pprof/trace.
+	if err := trace.Start(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	select {
+	case <-time.After(duration):
+	case <-r.Context().Done():
+	}
+	trace.Stop()
+
+	if err := file.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, path)
+}
+
+// Serve listens on cfg.Addr and serves Handler(cfg) until done is closed.
+func Serve(cfg Config, done <-chan struct{}) error {
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: Handler(cfg)}
+	go func() {
+		<-done
+		server.Close()
+	}()
+
+	fmt.Printf("Debug server listening on %s\n", listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package diag
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestEndpoints(t *testing.T) {
+	server := httptest.NewServer(Handler(Config{
+		Stats: func() any { return map[string]int{"size": 3} },
+	}))
+	defer server.Close()
+
+	runtime.GC()
+	code, body := get(t, server.URL+"/debug/runtime")
+	var stats RuntimeStats
+	if err := json.Unmarshal([]byte(body), &stats); code != http.StatusOK || err != nil {
+		t.Fatalf("/debug/runtime: %d %v %s", code, err, body)
+	}
+	if stats.Goroutines == 0 || stats.NumGC == 0 || len(stats.RecentPauses) == 0 {
+		t.Errorf("runtime stats %+v", stats)
+	}
+
+	if code, body := get(t, server.URL+"/debug/queue"); code != http.StatusOK || !strings.Contains(body, `"size": 3`) {
+		t.Errorf("/debug/queue: %d %s", code, body)
+	}
+	if code, _ := get(t, server.URL+"/debug/pprof/goroutine?debug=1"); code != http.StatusOK {
+		t.Errorf("/debug/pprof/goroutine: %d", code)
+	}
+}
+
+func TestTraceCapture(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(Handler(Config{TraceDir: dir}))
+	defer server.Close()
+
+	if code, _ := get(t, server.URL+"/debug/trace/capture?seconds=3600"); code != http.StatusBadRequest {
+		t.Errorf("hour-long trace: status %d", code)
+	}
+
+	// Two captures at once: one traces, the other is turned away.
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	bodies := make([]string, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i], bodies[i] = get(t, server.URL+"/debug/trace/capture?seconds=0.2")
+		}()
+	}
+	wg.Wait()
+
+	ok := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+			info, err := os.Stat(strings.TrimSpace(bodies[i]))
+			if err != nil || info.Size() == 0 {
+				t.Errorf("trace file %q: %v", bodies[i], err)
+			}
+		case http.StatusConflict:
+		default:
+			t.Errorf("capture: %d %s", code, bodies[i])
+		}
+	}
+	if ok == 0 {
+		t.Error("no capture succeeded")
+	}
+}
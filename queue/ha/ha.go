@@ -0,0 +1,403 @@
+// Package ha replicates the queue across several servers with raft. The
+// leader accepts tasks only once they are committed to the replicated log
+// and records their completion there too, so when the leader dies the new
+// one re-runs every task that was accepted but not yet completed.
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/raft"
+	"vu/benchmark/queue/tasks"
+)
+
+const (
+	cmdAccept   = "accept"
+	cmdComplete = "complete"
+)
+
+// command is the payload of a replicated log entry.
+type command struct {
+	Op     string      `json:"op"`
+	Task   *tasks.Task `json:"task,omitempty"`
+	ID     string      `json:"id,omitempty"`
+	Result []byte      `json:"result,omitempty"`
+	Blob   string      `json:"blob,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Config collects the tunables of a replicated queue.
+type Config struct {
+	// Raft configures the node; its Apply callback is set by NewQueue.
+	Raft raft.Config
+	// ResultRetention is how many completed results are kept for clients
+	// that reconnect and wait for their task again.
+	ResultRetention int
+	// RetryInterval is how long to wait before dispatching tasks the local
+	// queue refused again, or proposing a completion that failed, 1s by
+	// default.
+	RetryInterval time.Duration
+	LogDisabled   bool
+}
+
+// Queue is an internal.IQueue replicated with raft. Only the leader accepts
+// tasks and runs them on its local queue.
+type Queue struct {
+	internal.IQueue
+
+	cfg  Config
+	node *raft.Node
+
+	mutex   sync.Mutex
+	pending map[string]*pendingTask
+	// queued holds the pending tasks this node put into its local queue
+	// while it was leader.
+	queued      map[string]bool
+	results     map[string]internal.Output
+	resultOrder []string
+	waiters     map[string][]chan internal.Output
+	// reserved holds the tasks of Puts being proposed, which take a slot
+	// of the capacity until they are pending.
+	reserved map[string]bool
+	// retry, while set, dispatches again after RetryInterval.
+	retry  *time.Timer
+	closed bool
+}
+
+type pendingTask struct {
+	task  tasks.Task
+	index uint64
+}
+
+// NewQueue starts a raft node replicating the state of local. Register
+// Node() with the transport so peers can reach it.
+func NewQueue(local internal.IQueue, cfg Config) *Queue {
+	if cfg.ResultRetention <= 0 {
+		cfg.ResultRetention = 10_000
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+
+	q := &Queue{
+		IQueue:  local,
+		cfg:     cfg,
+		pending: make(map[string]*pendingTask),
+		queued:  make(map[string]bool),
+		results: make(map[string]internal.Output),
+		waiters: make(map[string][]chan internal.Output),
+
+		reserved: make(map[string]bool),
+	}
+	cfg.Raft.Apply = q.apply
+	q.node = raft.NewNode(cfg.Raft)
+	q.node.Start()
+
+	return q
+}
+
+func (q *Queue) Node() *raft.Node {
+	return q.node
+}
+
+// Put replicates the task and queues it on the leader. Submitting an id that
+// is already known waits for that task instead of running it again, so a
+// client may safely resubmit after failing over.
+func (q *Queue) Put(task *tasks.Task) (<-chan internal.Output, error) {
+	if err := q.checkLeader(); err != nil {
+		return nil, err
+	}
+
+	q.mutex.Lock()
+	ch, err := q.wait(task.Id)
+	if err == nil {
+		q.mutex.Unlock()
+		return ch, nil
+	}
+	if len(q.pending)+len(q.reserved) >= q.IQueue.Stats().Capacity {
+		q.mutex.Unlock()
+		return nil, internal.ErrQueueFull
+	}
+	q.reserved[task.Id] = true
+	waiter := make(chan internal.Output, 1)
+	q.waiters[task.Id] = append(q.waiters[task.Id], waiter)
+	q.mutex.Unlock()
+
+	data, _ := json.Marshal(command{Op: cmdAccept, Task: task})
+	err = q.node.Propose(data)
+
+	// apply released the slot of an accepted task; release a refused one.
+	q.mutex.Lock()
+	delete(q.reserved, task.Id)
+	if err != nil {
+		q.dropWaiter(task.Id, waiter)
+	}
+	q.mutex.Unlock()
+	if err != nil {
+		return nil, q.proposeError(err)
+	}
+	return waiter, nil
+}
+
+// Pull hands tasks the leader queued locally to remote workers. Their
+// outputs are replicated like those of local workers.
+func (q *Queue) Pull(ctx context.Context, types []string) (*internal.Claim, error) {
+	puller, ok := q.IQueue.(internal.Puller)
+	if !ok {
+		return nil, internal.ErrPullUnsupported
+	}
+	return puller.Pull(ctx, types)
+}
+
+// Lease is Pull with a visibility timeout, see internal.Puller.
+func (q *Queue) Lease(ctx context.Context, types []string, visibility time.Duration) (*internal.Claim, error) {
+	puller, ok := q.IQueue.(internal.Puller)
+	if !ok {
+		return nil, internal.ErrPullUnsupported
+	}
+	return puller.Lease(ctx, types, visibility)
+}
+
+// Wait returns a channel receiving the output of an accepted task, whether
+// it is still pending or already completed.
+func (q *Queue) Wait(id string) (<-chan internal.Output, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.wait(id)
+}
+
+// wait registers a waiter for id. The caller must hold q.mutex.
+func (q *Queue) wait(id string) (<-chan internal.Output, error) {
+	waiter := make(chan internal.Output, 1)
+	if output, ok := q.results[id]; ok {
+		waiter <- output
+		close(waiter)
+		return waiter, nil
+	}
+	if _, ok := q.pending[id]; ok {
+		q.waiters[id] = append(q.waiters[id], waiter)
+		return waiter, nil
+	}
+	return nil, internal.ErrTaskNotFound
+}
+
+func (q *Queue) dropWaiter(id string, waiter chan internal.Output) {
+	waiters := q.waiters[id]
+	for i, w := range waiters {
+		if w == waiter {
+			q.waiters[id] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(q.waiters[id]) == 0 {
+		delete(q.waiters, id)
+	}
+}
+
+// Cancel cancels the task on the leader. A task that has not reached the
+// local queue yet is completed as cancelled directly in the log.
+func (q *Queue) Cancel(id string) error {
+	if err := q.checkLeader(); err != nil {
+		return err
+	}
+
+	err := q.IQueue.Cancel(id)
+	if !errors.Is(err, internal.ErrTaskNotFound) {
+		return err
+	}
+
+	q.mutex.Lock()
+	_, ok := q.pending[id]
+	q.mutex.Unlock()
+	if !ok {
+		return err
+	}
+	return q.proposeComplete(id, internal.Output{Err: internal.ErrCancelled})
+}
+
+// Shutdown stops replicating and drains the local queue. Tasks completing
+// after the node stopped are re-run by the next leader.
+func (q *Queue) Shutdown() error {
+	q.mutex.Lock()
+	q.closed = true
+	if q.retry != nil {
+		q.retry.Stop()
+	}
+	q.mutex.Unlock()
+
+	q.node.Stop()
+	return q.IQueue.Shutdown()
+}
+
+func (q *Queue) checkLeader() error {
+	state, _, leader := q.node.Status()
+	if state != raft.Leader {
+		return &internal.NotLeaderError{Leader: leader}
+	}
+	return nil
+}
+
+func (q *Queue) proposeError(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) {
+		_, _, leader := q.node.Status()
+		return &internal.NotLeaderError{Leader: leader}
+	}
+	return err
+}
+
+func (q *Queue) proposeComplete(id string, output internal.Output) error {
+	cmd := command{Op: cmdComplete, ID: id, Result: output.Res, Blob: output.Blob}
+	if output.Err != nil {
+		cmd.Result, cmd.Blob = nil, ""
+		cmd.Error = output.Err.Error()
+	}
+	data, _ := json.Marshal(cmd)
+	return q.proposeError(q.node.Propose(data))
+}
+
+// apply runs committed log entries against the replicated state.
+func (q *Queue) apply(entry raft.Entry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if entry.Data != nil {
+		var cmd command
+		if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+			q.logf("skipping malformed log entry %d: %v\n", entry.Index, err)
+			return
+		}
+
+		switch cmd.Op {
+		case cmdAccept:
+			delete(q.reserved, cmd.Task.Id)
+			_, pending := q.pending[cmd.Task.Id]
+			_, completed := q.results[cmd.Task.Id]
+			if !pending && !completed {
+				q.pending[cmd.Task.Id] = &pendingTask{task: *cmd.Task, index: entry.Index}
+			}
+		case cmdComplete:
+			q.applyComplete(cmd)
+		}
+	}
+
+	q.dispatch()
+}
+
+// applyComplete records a task's output and hands it to its waiters. The
+// caller must hold q.mutex.
+func (q *Queue) applyComplete(cmd command) {
+	if _, ok := q.pending[cmd.ID]; !ok {
+		return
+	}
+	delete(q.pending, cmd.ID)
+	delete(q.queued, cmd.ID)
+
+	output := internal.Output{Res: cmd.Result, Blob: cmd.Blob}
+	if cmd.Error == internal.ErrCancelled.Error() {
+		output = internal.Output{Err: internal.ErrCancelled}
+	} else if cmd.Error != "" {
+		output = internal.Output{Err: errors.New(cmd.Error)}
+	}
+
+	q.results[cmd.ID] = output
+	q.resultOrder = append(q.resultOrder, cmd.ID)
+	if len(q.resultOrder) > q.cfg.ResultRetention {
+		delete(q.results, q.resultOrder[0])
+		q.resultOrder = q.resultOrder[1:]
+	}
+
+	for _, waiter := range q.waiters[cmd.ID] {
+		waiter <- output
+		close(waiter)
+	}
+	delete(q.waiters, cmd.ID)
+}
+
+// dispatch puts pending tasks into the local queue in log order while this
+// node is leader, and cancels them locally once it is not. The caller must
+// hold q.mutex.
+func (q *Queue) dispatch() {
+	if !q.node.IsLeader() {
+		for id := range q.queued {
+			q.IQueue.Cancel(id)
+			delete(q.queued, id)
+		}
+		return
+	}
+
+	var ready []*pendingTask
+	for id, p := range q.pending {
+		if !q.queued[id] {
+			ready = append(ready, p)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].index < ready[j].index })
+
+	for _, p := range ready {
+		task := p.task
+		ch, err := q.IQueue.Put(&task)
+		if err != nil {
+			// Retried on the next applied entry, or after a while on an
+			// idle cluster.
+			q.retryLater()
+			return
+		}
+		q.queued[task.Id] = true
+		go q.report(task.Id, ch)
+	}
+}
+
+// retryLater dispatches again after RetryInterval unless that is already
+// due. The caller must hold q.mutex.
+func (q *Queue) retryLater() {
+	if q.retry != nil || q.closed {
+		return
+	}
+	q.retry = time.AfterFunc(q.cfg.RetryInterval, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		q.retry = nil
+		if !q.closed {
+			q.dispatch()
+		}
+	})
+}
+
+// report replicates the output of a locally run task, retrying while this
+// node is leader and the task pending. Once it is not, the task stays
+// pending for the next leader, which runs it again.
+func (q *Queue) report(id string, ch <-chan internal.Output) {
+	output := <-ch
+	for {
+		err := q.proposeComplete(id, output)
+		if err == nil {
+			return
+		}
+		q.logf("task %s completed but not recorded: %v\n", id, err)
+
+		q.mutex.Lock()
+		_, pending := q.pending[id]
+		if !pending || q.closed || !q.node.IsLeader() {
+			delete(q.queued, id)
+			q.mutex.Unlock()
+			return
+		}
+		q.mutex.Unlock()
+		time.Sleep(q.cfg.RetryInterval)
+	}
+}
+
+func (q *Queue) logf(format string, args ...any) {
+	if q.cfg.LogDisabled {
+		return
+	}
+	fmt.Printf(format, args...)
+}
@@ -0,0 +1,216 @@
+package ha
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/raft"
+	"vu/benchmark/queue/tasks"
+)
+
+const testElectionTimeout = 50 * time.Millisecond
+
+type replica struct {
+	id    string
+	local internal.IQueue
+	queue *Queue
+}
+
+func startReplicas(t *testing.T, network *raft.Network, size int) map[string]*replica {
+	t.Helper()
+	return startReplicasConfig(t, network, size, func() internal.IQueue { return internal.NewQueue(100, 2, true) }, 0)
+}
+
+// startReplicasConfig starts replicas running their tasks on the queues
+// newLocal returns, with retry as Config.RetryInterval.
+func startReplicasConfig(t *testing.T, network *raft.Network, size int, newLocal func() internal.IQueue, retry time.Duration) map[string]*replica {
+	t.Helper()
+
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("node%d", i+1)
+	}
+
+	replicas := make(map[string]*replica)
+	for _, id := range ids {
+		var peers []string
+		for _, other := range ids {
+			if other != id {
+				peers = append(peers, other)
+			}
+		}
+
+		local := newLocal()
+		queue := NewQueue(local, Config{
+			Raft: raft.Config{
+				ID:              id,
+				Peers:           peers,
+				Transport:       network.Transport(id),
+				ElectionTimeout: testElectionTimeout,
+			},
+			RetryInterval: retry,
+			LogDisabled:   true,
+		})
+		network.Register(id, queue.Node())
+		replicas[id] = &replica{id: id, local: local, queue: queue}
+	}
+
+	t.Cleanup(func() {
+		for _, r := range replicas {
+			r.queue.Node().Stop()
+		}
+	})
+	return replicas
+}
+
+func waitLeader(t *testing.T, replicas map[string]*replica) *replica {
+	t.Helper()
+
+	deadline := time.Now().Add(40 * testElectionTimeout)
+	for time.Now().Before(deadline) {
+		for _, r := range replicas {
+			if r.queue.Node().IsLeader() {
+				return r
+			}
+		}
+		time.Sleep(testElectionTimeout / 5)
+	}
+	t.Fatalf("no leader elected")
+	return nil
+}
+
+func sumTask(id int) *tasks.Task {
+	input, _ := json.Marshal(tasks.SumTaskInput{A: id, B: 1})
+	return &tasks.Task{Id: fmt.Sprint(id), Type: tasks.SumTaskType, Input: input}
+}
+
+func checkSum(t *testing.T, id int, ch <-chan internal.Output) {
+	t.Helper()
+
+	select {
+	case output := <-ch:
+		var res tasks.SumTaskOutput
+		if output.Err != nil || json.Unmarshal(output.Res, &res) != nil || res.Res != id+1 {
+			t.Fatalf("task %d: unexpected output %s, %v", id, output.Res, output.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("task %d did not complete", id)
+	}
+}
+
+func TestFollowerPointsToLeader(t *testing.T) {
+	replicas := startReplicas(t, raft.NewNetwork(), 3)
+	leader := waitLeader(t, replicas)
+
+	// Followers learn the leader from its first heartbeat.
+	time.Sleep(2 * testElectionTimeout)
+	for _, r := range replicas {
+		if r == leader {
+			continue
+		}
+
+		_, err := r.queue.Put(sumTask(1))
+		var notLeader *internal.NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader != leader.id {
+			t.Fatalf("put on follower %s: got %v, want redirect to %s", r.id, err, leader.id)
+		}
+	}
+}
+
+func TestAcceptedTasksSurviveLeaderCrash(t *testing.T) {
+	network := raft.NewNetwork()
+	replicas := startReplicas(t, network, 3)
+	old := waitLeader(t, replicas)
+
+	// Keep the tasks from running so they are only accepted when the
+	// leader dies.
+	old.local.Pause()
+	for i := 1; i <= 5; i++ {
+		if _, err := old.queue.Put(sumTask(i)); err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+	}
+
+	network.Disconnect(old.id)
+	old.queue.Node().Stop()
+	delete(replicas, old.id)
+
+	leader := waitLeader(t, replicas)
+	for i := 1; i <= 5; i++ {
+		ch, err := leader.queue.Wait(fmt.Sprint(i))
+		if err != nil {
+			t.Fatalf("wait %d on new leader: %v", i, err)
+		}
+		checkSum(t, i, ch)
+	}
+
+	// Resubmitting after failover returns the recorded result instead of
+	// running the task again.
+	ch, err := leader.queue.Put(sumTask(3))
+	if err != nil {
+		t.Fatalf("resubmit: %v", err)
+	}
+	checkSum(t, 3, ch)
+	if stats := leader.local.Stats(); stats.Size != 0 {
+		t.Fatalf("resubmitted task was queued again: %+v", stats)
+	}
+}
+
+// refusingQueue refuses the first Put as if it were full.
+type refusingQueue struct {
+	internal.IQueue
+	refused atomic.Bool
+}
+
+func (q *refusingQueue) Put(task *tasks.Task) (<-chan internal.Output, error) {
+	if q.refused.CompareAndSwap(false, true) {
+		return nil, internal.ErrQueueFull
+	}
+	return q.IQueue.Put(task)
+}
+
+func TestRefusedTaskIsDispatchedOnIdleCluster(t *testing.T) {
+	replicas := startReplicasConfig(t, raft.NewNetwork(), 3, func() internal.IQueue {
+		return &refusingQueue{IQueue: internal.NewQueue(10, 1, true)}
+	}, 20*time.Millisecond)
+	leader := waitLeader(t, replicas)
+
+	// No other entry is applied after this one.
+	ch, err := leader.queue.Put(sumTask(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSum(t, 1, ch)
+}
+
+func TestConcurrentPutsStayWithinCapacity(t *testing.T) {
+	replicas := startReplicasConfig(t, raft.NewNetwork(), 3, func() internal.IQueue { return internal.NewQueue(2, 0, true) }, 0)
+	leader := waitLeader(t, replicas)
+	queue, local := leader.queue, leader.local
+
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := queue.Put(sumTask(i)); err == nil {
+				accepted.Add(1)
+			} else if !errors.Is(err, internal.ErrQueueFull) {
+				t.Errorf("put %d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("%d tasks accepted with a capacity of 2", n)
+	}
+	if size := local.Stats().Size; size != 2 {
+		t.Errorf("%d tasks in the local queue, want 2", size)
+	}
+}
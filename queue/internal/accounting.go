@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// TypeStats aggregates the time spent on the tasks of one type. Durations
+// are totals; divide by Tasks for means.
+type TypeStats struct {
+	Tasks  int64 `json:"tasks"`
+	Failed int64 `json:"failed"`
+	// QueueWait is the time between Put and a worker picking the task up.
+	QueueWait    time.Duration `json:"queueWait"`
+	MaxQueueWait time.Duration `json:"maxQueueWait"`
+	// Wall is the time the handler ran.
+	Wall    time.Duration `json:"wall"`
+	MaxWall time.Duration `json:"maxWall"`
+	// CPU is the CPU time of the worker's thread while the handler ran. It
+	// is only measured with Config.CPUAccounting on Linux, and misses
+	// goroutines the handler starts.
+	CPU time.Duration `json:"cpu,omitempty"`
+}
+
+// WorkerStats is the work done by one worker goroutine.
+type WorkerStats struct {
+	ID    int           `json:"id"`
+	Tasks int64         `json:"tasks"`
+	Busy  time.Duration `json:"busy"`
+	CPU   time.Duration `json:"cpu,omitempty"`
+}
+
+// run executes task on the calling worker and measures the thread CPU time
+// it used, if enabled.
+func (q *_queue) run(task *_taskWrapper) (output Output, cpu time.Duration) {
+	execute := func(ctx context.Context) {
+		output = q.execute(ctx, task)
+	}
+
+	if q.cpuAccounting {
+		// The thread clock only means something if the goroutine stays on
+		// the thread.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if start, ok := threadCPUTime(); ok {
+			defer func() {
+				if end, ok := threadCPUTime(); ok {
+					cpu = end - start
+				}
+			}()
+		}
+	}
+
+	if q.profileLabels {
+		pprof.Do(task.ctx, pprof.Labels("task_type", task.task.Type), execute)
+	} else {
+		execute(task.ctx)
+	}
+	return output, cpu
+}
+
+// account adds a finished task to the per-type and per-worker totals. The
+// caller must hold q.mutex.
+func (q *_queue) account(workerID int, task *_taskWrapper, output Output, cpu time.Duration) {
+	wait := task.startedAt.Sub(task.enqueuedAt)
+	wall := time.Since(task.startedAt)
+
+	t := q.types[task.task.Type]
+	t.Tasks++
+	if output.Err != nil {
+		t.Failed++
+	}
+	t.QueueWait += wait
+	t.MaxQueueWait = max(t.MaxQueueWait, wait)
+	t.Wall += wall
+	t.MaxWall = max(t.MaxWall, wall)
+	t.CPU += cpu
+	q.types[task.task.Type] = t
+
+	w := &q.workers[workerID-1]
+	w.Tasks++
+	w.Busy += wall
+	w.CPU += cpu
+}
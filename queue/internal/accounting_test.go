@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+	"time"
+	"vu/benchmark/queue/mockserver"
+	"vu/benchmark/queue/tasks"
+)
+
+func TestAccountingSeparatesCPUFromWaiting(t *testing.T) {
+	server, err := mockserver.Start(mockserver.Config{
+		Latency:     mockserver.Latency{Base: 100 * time.Millisecond},
+		LogDisabled: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	burn, _ := json.Marshal(tasks.BurnCPUTaskInput{Iteration: 200_000_000})
+	slow, _ := json.Marshal(tasks.SlowAPITaskInput{Addr: server.Addr()})
+
+	// One worker, so the IO task waits for the CPU task.
+	queue := New(Config{Capacity: 10, Workers: 1, LogDisabled: true, CPUAccounting: true, ProfileLabels: true})
+	var channels []<-chan Output
+	for i, task := range []tasks.Task{
+		{Id: "burn", Type: tasks.BurnCPUTaskType, Input: burn},
+		{Id: "slow", Type: tasks.SlowAPITaskType, Input: slow},
+	} {
+		ch, err := queue.Put(&task)
+		if err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+		channels = append(channels, ch)
+	}
+	for _, ch := range channels {
+		if out := <-ch; out.Err != nil {
+			t.Fatal(out.Err)
+		}
+	}
+	queue.Shutdown()
+
+	stats := queue.Stats()
+	cpuTask, ioTask := stats.Types[tasks.BurnCPUTaskType], stats.Types[tasks.SlowAPITaskType]
+	if cpuTask.Tasks != 1 || ioTask.Tasks != 1 {
+		t.Fatalf("types %+v", stats.Types)
+	}
+	if ioTask.Wall < 100*time.Millisecond {
+		t.Errorf("IO task wall time %v, want at least the server latency", ioTask.Wall)
+	}
+	if ioTask.QueueWait < cpuTask.Wall/2 {
+		t.Errorf("IO task waited %v behind a CPU task that ran %v", ioTask.QueueWait, cpuTask.Wall)
+	}
+	if w := stats.PerWorker; len(w) != 1 || w[0].Tasks != 2 || w[0].Busy < cpuTask.Wall+ioTask.Wall {
+		t.Errorf("workers %+v", w)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if cpuTask.CPU < cpuTask.Wall/2 {
+		t.Errorf("CPU task used %v CPU in %v wall time", cpuTask.CPU, cpuTask.Wall)
+	}
+	if ioTask.CPU > ioTask.Wall/2 {
+		t.Errorf("IO task used %v CPU in %v wall time", ioTask.CPU, ioTask.Wall)
+	}
+}
@@ -1,68 +1,399 @@
 package internal
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
+	"vu/benchmark/queue/blob"
 	"vu/benchmark/queue/tasks"
 )
 
+var (
+	ErrQueueFull    = errors.New("queue is full")
+	ErrQueueClosed  = errors.New("queue is closed")
+	ErrDuplicateID  = errors.New("task id already in queue")
+	ErrTaskNotFound = errors.New("task not found")
+	ErrCancelled    = errors.New("task cancelled")
+	// ErrRateLimited is returned by servers limiting the rate of submissions.
+	ErrRateLimited = errors.New("submit rate exceeded")
+)
+
+// NotLeaderError is returned by replicated queues when a node that is not
+// the leader is asked to accept work. Leader is the leader's address if
+// known, so clients can reconnect there.
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "not leader"
+	}
+	return "not leader, leader is " + e.Leader
+}
+
 type IQueue interface {
 	Put(task *tasks.Task) (<-chan Output, error)
+	// Cancel removes a still-queued task, freeing its slot, or cancels the
+	// context of a running one. Either way the task's channel receives an
+	// Output with ErrCancelled.
+	Cancel(id string) error
+	// Pause stops workers from picking up queued tasks. Put keeps accepting
+	// tasks up to capacity and tasks already running are allowed to finish.
+	Pause()
+	// Resume lets workers pick up queued tasks again.
+	Resume()
+	// TryClaim takes the oldest queued task out of the queue so it can be
+	// executed elsewhere. It reports false when nothing is queued or the
+	// queue is paused.
+	TryClaim() (*Claim, bool)
+	Stats() Stats
 	Shutdown() error
 }
 
+// Streamer is implemented by queues whose handlers can stream updates
+// before their final output; see tasks.Emit.
+type Streamer interface {
+	// PutStream is Put, with the task's updates passed to emitter from the
+	// worker running it. They all arrive before the final Output.
+	PutStream(task *tasks.Task, emitter tasks.Emitter) (<-chan Output, error)
+}
+
+// Stats is a point-in-time snapshot of the queue state.
+type Stats struct {
+	Capacity int  `json:"capacity"`
+	Size     int  `json:"size"`
+	Running  int  `json:"running"`
+	Workers  int  `json:"workers"`
+	Paused   bool `json:"paused"`
+	// Types and PerWorker account for the tasks the workers finished.
+	Types     map[string]TypeStats `json:"types,omitempty"`
+	PerWorker []WorkerStats        `json:"perWorker,omitempty"`
+	// Waiting counts the queued tasks held back behind an earlier task with
+	// the same key.
+	Waiting int `json:"waiting,omitempty"`
+	// ExpiredLeases counts the leases that ran out before their task was
+	// acked, each putting the task back into the queue.
+	ExpiredLeases int64 `json:"expiredLeases,omitempty"`
+}
+
+// Config collects the queue options. NewQueue covers the common ones.
+type Config struct {
+	Capacity    int
+	Workers     int
+	LogDisabled bool
+	// CPUAccounting measures the CPU time of each task on Linux. Every
+	// running task then holds its worker's OS thread, even while blocked.
+	CPUAccounting bool
+	// ProfileLabels runs handlers under pprof.Do with a task_type label, so
+	// CPU profiles break down by task type.
+	ProfileLabels bool
+	// Blobs, if set, holds the inputs of tasks with an InputBlob and the
+	// results larger than ResultBlobThreshold, 1 MiB by default.
+	Blobs               *blob.Store
+	ResultBlobThreshold int
+}
+
 type _queue struct {
-	capacity    int
-	channel     chan _taskWrapper
-	poolSize    int
-	closed      bool
-	mutex       sync.Mutex
+	capacity int
+	poolSize int
+	closed   bool
+	paused   bool
+	mutex    sync.Mutex
+	// ready is signalled whenever a worker may be able to pick up a task:
+	// a task was queued, the queue was resumed or it was closed. pulls is
+	// broadcast at the same time for remote workers in Pull, which only
+	// take some task types.
+	ready       *sync.Cond
+	pulls       *sync.Cond
+	pending     *list.List
+	tasks       map[string]*_taskWrapper
+	running     int
 	wg          sync.WaitGroup
 	size        int
-	logDisabled bool
+	logDisabled atomic.Bool
+	// live marks the ids of the worker goroutines running, which may
+	// outnumber poolSize for a while after it shrinks.
+	live []bool
+
+	cpuAccounting bool
+	profileLabels bool
+	blobs         *blob.Store
+	blobThreshold int
+	types         map[string]TypeStats
+	workers       []WorkerStats
+	expiredLeases int64
+	// keys holds a backlog for every key with a task pending or running;
+	// see holdBack.
+	keys map[string]*list.List
 }
 
 type _taskWrapper struct {
 	task    *tasks.Task
 	channel chan Output
+	// elem is the task's position in pending while it is still queued, or
+	// in the backlog of its key if backlogged.
+	elem       *list.Element
+	backlogged bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	cancelled  bool
+	// emitter receives the task's updates, if it was put with PutStream.
+	emitter tasks.Emitter
+	// fn runs the task instead of its type's handler, if it was put with
+	// PutFunc.
+	fn Func
+	// deliveries counts how often the task was dispatched, more than once
+	// if it was released or its lease expired.
+	deliveries int
+	// waiters receive the output too, see Wait.
+	waiters []chan Output
+
+	enqueuedAt time.Time
+	startedAt  time.Time
 }
 
 type Output struct {
 	Err error
 	Res []byte
+	// Blob is the hash of the result instead of Res when it was too large
+	// to pass inline.
+	Blob string
 }
 
 func (q *_queue) Put(task *tasks.Task) (<-chan Output, error) {
+	return q.put(task, nil, nil)
+}
+
+func (q *_queue) PutStream(task *tasks.Task, emitter tasks.Emitter) (<-chan Output, error) {
+	return q.put(task, emitter, nil)
+}
+
+func (q *_queue) put(task *tasks.Task, emitter tasks.Emitter, fn Func) (<-chan Output, error) {
 	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
 	if q.size+1 > q.capacity {
-		q.mutex.Unlock()
-		return nil, errors.New("queue is full")
+		return nil, ErrQueueFull
 	}
 
 	if q.closed {
-		q.mutex.Unlock()
-		return nil, errors.New("queue is closed")
+		return nil, ErrQueueClosed
 	}
 
-	defer q.mutex.Unlock()
+	if _, ok := q.tasks[task.Id]; ok {
+		return nil, ErrDuplicateID
+	}
 
 	q.wg.Add(1)
 	q.size += 1
 
-	channel := make(chan Output, 1)
+	wrapper := &_taskWrapper{
+		task:       task,
+		channel:    make(chan Output, 1),
+		emitter:    emitter,
+		fn:         fn,
+		enqueuedAt: time.Now(),
+	}
+	q.tasks[task.Id] = wrapper
+	if q.holdBack(wrapper) {
+		return wrapper.channel, nil
+	}
+	wrapper.elem = q.pending.PushBack(wrapper)
+	q.signal()
+
+	return wrapper.channel, nil
+}
+
+func (q *_queue) Cancel(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	wrapper, ok := q.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	if wrapper.elem != nil {
+		if wrapper.backlogged {
+			q.keys[wrapper.task.Key].Remove(wrapper.elem)
+		} else {
+			q.pending.Remove(wrapper.elem)
+		}
+		wrapper.elem = nil
+		q.finish(wrapper, Output{Err: ErrCancelled})
+		return nil
+	}
+
+	// Already running: the worker delivers the cancelled output once the
+	// handler returns. Whoever holds a claim on it learns of it from
+	// Claim.Done.
+	wrapper.cancelled = true
+	wrapper.cancel()
+	return nil
+}
+
+// Wait returns another channel receiving the output of a queued or running
+// task, for a client that lost the one Put returned. Finished tasks are
+// forgotten, so waiting for them fails with ErrTaskNotFound.
+func (q *_queue) Wait(id string) (<-chan Output, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	wrapper, ok := q.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	waiter := make(chan Output, 1)
+	wrapper.waiters = append(wrapper.waiters, waiter)
+	return waiter, nil
+}
+
+// Claim is a queued task handed out by TryClaim, Pull or Lease. It keeps its
+// queue slot and counts as running until it is completed or released, or
+// its lease expires.
+type Claim struct {
+	queue   *_queue
+	wrapper *_taskWrapper
+	// done is the Done channel of the task's context for this claim.
+	done    <-chan struct{}
+	settled bool
+	// timer releases the task at expires if the claim is a lease.
+	timer   *time.Timer
+	expires time.Time
+}
+
+// claim hands out a task take or dispatch just marked running. The caller
+// must hold q.mutex.
+func (q *_queue) claim(wrapper *_taskWrapper) *Claim {
+	return &Claim{queue: q, wrapper: wrapper, done: wrapper.ctx.Done()}
+}
+
+func (c *Claim) Task() *tasks.Task {
+	return c.wrapper.task
+}
+
+// Done is closed once the claim ends or its task is cancelled, whichever
+// comes first; see Cancelled.
+func (c *Claim) Done() <-chan struct{} {
+	return c.done
+}
+
+// Cancelled reports whether the claimed task was cancelled. Its output is
+// ErrCancelled whatever it is completed with, so whoever runs it elsewhere
+// should be told to stop.
+func (c *Claim) Cancelled() bool {
+	c.queue.mutex.Lock()
+	defer c.queue.mutex.Unlock()
+
+	return c.wrapper.cancelled
+}
+
+// Complete delivers the output of the claimed task to its waiter, unless
+// the claim was settled already; see Ack.
+func (c *Claim) Complete(output Output) {
+	c.Ack(output)
+}
+
+// Release puts an unfinished claimed task back at the head of the queue.
+func (c *Claim) Release() {
+	c.queue.mutex.Lock()
+	defer c.queue.mutex.Unlock()
+
+	if c.settled {
+		return
+	}
+	c.settle()
+	c.requeue()
+}
+
+// settle ends the claim. The caller must hold the queue's mutex.
+func (c *Claim) settle() {
+	c.settled = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// requeue puts the task of a settled claim back at the head of the queue.
+// The caller must hold the queue's mutex.
+func (c *Claim) requeue() {
+	q := c.queue
+	q.running--
+
+	if c.wrapper.cancelled {
+		q.finish(c.wrapper, Output{Err: ErrCancelled})
+		return
+	}
+	c.wrapper.cancel()
+	c.wrapper.elem = q.pending.PushFront(c.wrapper)
+	q.signal()
+}
+
+func (q *_queue) TryClaim() (*Claim, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.paused || q.pending.Len() == 0 {
+		return nil, false
+	}
+
+	return q.claim(q.dispatch()), true
+}
+
+// Pause does nothing once the queue is shut down, which must drain it.
+func (q *_queue) Pause() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.paused = true
+}
+
+func (q *_queue) Resume() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.paused = false
+	q.broadcast()
+}
 
-	q.channel <- _taskWrapper{
-		task:    task,
-		channel: channel,
+func (q *_queue) Stats() Stats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := Stats{
+		Capacity:  q.capacity,
+		Size:      q.size,
+		Running:   q.running,
+		Workers:   q.poolSize,
+		Paused:    q.paused,
+		Types:     make(map[string]TypeStats, len(q.types)),
+		PerWorker: append([]WorkerStats(nil), q.workers...),
+
+		Waiting:       q.size - q.running - q.pending.Len(),
+		ExpiredLeases: q.expiredLeases,
 	}
-	return channel, nil
+	for taskType, t := range q.types {
+		stats.Types[taskType] = t
+	}
+	return stats
 }
 
+// Shutdown stops accepting tasks and waits for the queued ones to drain.
+// A paused queue is resumed first, otherwise it would never drain.
 func (q *_queue) Shutdown() error {
 	q.mutex.Lock()
 	q.closed = true
+	q.paused = false
+	q.broadcast()
 	q.mutex.Unlock()
 
 	q.wg.Wait()
@@ -70,62 +401,189 @@ func (q *_queue) Shutdown() error {
 }
 
 func (q *_queue) init() {
-	// Avoid spamming stdout when running benchmarks so measurements stay clean.
-	logWorkers := q.shouldLogWorker()
-
 	for i := 0; i < q.poolSize; i++ {
-		workerID := i + 1
-		go func(id int) {
-			for task := range q.channel {
-				if logWorkers {
-					fmt.Printf("Worker %d, pick up tasks %s\n", id, task.task.Id)
-				}
-				res, err := Execute(task)
-				task.channel <- Output{Res: res, Err: err}
-				close(task.channel)
-
-				q.mutex.Lock()
-				q.size--
-				q.mutex.Unlock()
-				q.wg.Done()
+		q.startWorker(i + 1)
+	}
+}
+
+// startWorker runs worker id until the queue is closed and drained or the
+// pool shrinks below id. The caller must hold q.mutex or be init.
+func (q *_queue) startWorker(id int) {
+	q.live[id-1] = true
+	go func() {
+		for {
+			task, ok := q.next(id)
+			if !ok {
+				return
+			}
+
+			// Avoid spamming stdout when running benchmarks so measurements stay clean.
+			if q.shouldLogWorker() {
+				fmt.Printf("Worker %d, pick up tasks %s\n", id, task.task.Id)
 			}
-		}(workerID)
+
+			output, cpu := q.run(task)
+
+			q.mutex.Lock()
+			q.account(id, task, output, cpu)
+			q.complete(task, output)
+			q.mutex.Unlock()
+		}
+	}()
+}
+
+// next blocks until a task can be dispatched to worker id and removes it
+// from pending. It reports false once the queue is closed and drained, or
+// the pool shrank below id.
+func (q *_queue) next(id int) (*_taskWrapper, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.paused || q.pending.Len() == 0 || id > q.poolSize {
+		if id > q.poolSize {
+			q.live[id-1] = false
+			return nil, false
+		}
+		// Tasks held back by their key become pending as running ones
+		// finish.
+		if q.closed && q.size == q.running {
+			return nil, false
+		}
+		q.ready.Wait()
+	}
+
+	return q.dispatch(), true
+}
+
+// dispatch removes the oldest pending task and marks it running. The caller
+// must hold q.mutex and make sure pending is not empty.
+func (q *_queue) dispatch() *_taskWrapper {
+	return q.take(q.pending.Front())
+}
+
+// take removes a pending task and marks it running. The caller must hold
+// q.mutex.
+func (q *_queue) take(elem *list.Element) *_taskWrapper {
+	task := q.pending.Remove(elem).(*_taskWrapper)
+	task.elem = nil
+	task.deliveries++
+	task.ctx, task.cancel = context.WithCancel(context.Background())
+	if task.emitter != nil {
+		task.ctx = tasks.WithEmitter(task.ctx, task.emitter)
+	}
+	task.startedAt = time.Now()
+	q.running++
+	return task
+}
+
+// signal wakes a worker and the remote pullers after a task was queued. The
+// caller must hold q.mutex.
+func (q *_queue) signal() {
+	q.ready.Signal()
+	q.pulls.Broadcast()
+}
+
+// broadcast wakes everybody waiting for tasks. The caller must hold q.mutex.
+func (q *_queue) broadcast() {
+	q.ready.Broadcast()
+	q.pulls.Broadcast()
+}
+
+// complete finishes a running task, replacing its output if it was
+// cancelled meanwhile. The caller must hold q.mutex.
+func (q *_queue) complete(task *_taskWrapper, output Output) {
+	task.cancel()
+	q.running--
+	if task.cancelled {
+		output = Output{Err: ErrCancelled}
+	}
+	q.finish(task, output)
+}
+
+// finish delivers the output and releases the task's slot. The caller must
+// hold q.mutex.
+func (q *_queue) finish(task *_taskWrapper, output Output) {
+	task.channel <- output
+	close(task.channel)
+	for _, waiter := range task.waiters {
+		waiter <- output
+		close(waiter)
+	}
+
+	delete(q.tasks, task.task.Id)
+	q.size--
+	q.wg.Done()
+
+	if task.task.Key != "" && !task.backlogged {
+		q.advance(task.task.Key)
+	}
+	if q.closed && q.size == q.running {
+		// Let idle workers see the queue is drained.
+		q.broadcast()
 	}
 }
 
 func NewQueue(capacity int, poolSize int, logDisabled bool) IQueue {
-	channel := make(chan _taskWrapper, capacity)
+	return New(Config{Capacity: capacity, Workers: poolSize, LogDisabled: logDisabled})
+}
 
+func New(cfg Config) IQueue {
+	if cfg.ResultBlobThreshold <= 0 {
+		cfg.ResultBlobThreshold = 1 << 20
+	}
 	queue := &_queue{
-		capacity:    capacity,
-		channel:     channel,
-		poolSize:    poolSize,
-		logDisabled: logDisabled,
+		capacity:      cfg.Capacity,
+		poolSize:      cfg.Workers,
+		pending:       list.New(),
+		tasks:         make(map[string]*_taskWrapper),
+		cpuAccounting: cfg.CPUAccounting,
+		profileLabels: cfg.ProfileLabels,
+		blobs:         cfg.Blobs,
+		blobThreshold: cfg.ResultBlobThreshold,
+		types:         make(map[string]TypeStats),
+		keys:          make(map[string]*list.List),
+		workers:       make([]WorkerStats, cfg.Workers),
+		live:          make([]bool, cfg.Workers),
 	}
+	queue.logDisabled.Store(cfg.LogDisabled)
+	for i := range queue.workers {
+		queue.workers[i].ID = i + 1
+	}
+	queue.ready = sync.NewCond(&queue.mutex)
+	queue.pulls = sync.NewCond(&queue.mutex)
 
 	queue.init()
 
 	return queue
 }
 
-func Execute(task _taskWrapper) ([]byte, error) {
-	switch task.task.Type {
+func Execute(ctx context.Context, task *tasks.Task) ([]byte, error) {
+	if task.Type == tasks.SHA256TaskType {
+		return tasks.SHA256Task(ctx, tasks.InputReader(ctx, task.Input))
+	}
+
+	raw, err := tasks.ReadInput(ctx, task.Input)
+	if err != nil {
+		return nil, err
+	}
+	switch task.Type {
 	case tasks.SumTaskType:
-		return tasks.SumTask(task.task.Input)
+		return tasks.SumTask(raw)
 	case tasks.HashTaskType:
 		input := tasks.HashTaskInput{}
-		if err := json.Unmarshal(task.task.Input, &input); err != nil {
+		if err := json.Unmarshal(raw, &input); err != nil {
 			return nil, err
 		}
-		return tasks.HashTask(input.Iteration), nil
+		return tasks.HashTask(ctx, input.Iteration)
 	case tasks.BurnCPUTaskType:
-		return tasks.BurnCPUTask(task.task.Input)
+		return tasks.BurnCPUTask(ctx, raw)
 	case tasks.SlowAPITaskType:
-		return tasks.SlowAPITask(task.task.Input)
+		return tasks.SlowAPITask(ctx, raw)
 	default:
-		{
-			return nil, errors.New("invalid tasks type")
+		if handler, ok := handlerFor(task.Type); ok {
+			return handler(ctx, raw)
 		}
+		return nil, errors.New("invalid tasks type")
 	}
 }
 
@@ -138,7 +596,7 @@ func (q *_queue) shouldLogWorker() bool {
 	//	return false
 	//}
 
-	if q.logDisabled {
+	if q.logDisabled.Load() {
 		return false
 	}
 
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+	"vu/benchmark/queue/tasks"
+)
+
+func hashTask(id string, iterations int) *tasks.Task {
+	input, _ := json.Marshal(tasks.HashTaskInput{Iteration: iterations})
+	return &tasks.Task{Id: id, Type: tasks.HashTaskType, Input: input}
+}
+
+// receive returns the output of ch, failing the test if it takes too long.
+func receive(t *testing.T, ch <-chan Output) Output {
+	t.Helper()
+	select {
+	case output := <-ch:
+		return output
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output")
+		return Output{}
+	}
+}
+
+func TestCancelQueuedTask(t *testing.T) {
+	queue := New(Config{Capacity: 2, Workers: 1, LogDisabled: true})
+	defer queue.Shutdown()
+	queue.Pause()
+
+	ch, err := queue.Put(hashTask("a", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Put(hashTask("b", 1))
+	if err := queue.Cancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	if output := receive(t, ch); !errors.Is(output.Err, ErrCancelled) {
+		t.Fatalf("cancelled task: %+v", output)
+	}
+
+	// Its slot is free again, and it never runs.
+	if _, err := queue.Put(hashTask("c", 1)); err != nil {
+		t.Fatalf("put after cancelling: %v", err)
+	}
+	queue.Resume()
+	if err := queue.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if ran := queue.Stats().Types[tasks.HashTaskType].Tasks; ran != 2 {
+		t.Errorf("%d tasks ran, want b and c", ran)
+	}
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	queue := New(Config{Capacity: 1, Workers: 1, LogDisabled: true})
+	defer queue.Shutdown()
+
+	// Long enough to still be running when cancelled.
+	ch, err := queue.Put(hashTask("a", 1<<40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for queue.Stats().Running != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("task did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := queue.Cancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	if output := receive(t, ch); !errors.Is(output.Err, ErrCancelled) {
+		t.Fatalf("cancelled task: %+v", output)
+	}
+}
+
+func TestCancelUnknownTask(t *testing.T) {
+	queue := New(Config{Capacity: 1, Workers: 1, LogDisabled: true})
+	defer queue.Shutdown()
+
+	if err := queue.Cancel("nope"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("cancel unknown id: %v", err)
+	}
+	ch, _ := queue.Put(hashTask("done", 1))
+	receive(t, ch)
+	if err := queue.Cancel("done"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("cancel finished task: %v", err)
+	}
+}
+
+func TestPauseAcceptsUpToCapacity(t *testing.T) {
+	queue := New(Config{Capacity: 3, Workers: 2, LogDisabled: true})
+	defer queue.Shutdown()
+	queue.Pause()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := queue.Put(hashTask(id, 1)); err != nil {
+			t.Fatalf("put %s while paused: %v", id, err)
+		}
+	}
+	if _, err := queue.Put(hashTask("d", 1)); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("put beyond capacity while paused: %v", err)
+	}
+	// Nothing runs while paused.
+	time.Sleep(50 * time.Millisecond)
+	if stats := queue.Stats(); !stats.Paused || stats.Size != 3 || stats.Running != 0 {
+		t.Errorf("paused queue: %+v", stats)
+	}
+	queue.Resume()
+}
+
+func TestPauseLetsRunningTasksFinish(t *testing.T) {
+	queue := New(Config{Capacity: 2, Workers: 1, LogDisabled: true})
+	defer queue.Shutdown()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	running, err := queue.(FuncQueue).PutFunc(&tasks.Task{Id: "running", Type: "func"}, func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	queue.Pause()
+	queued, err := queue.Put(hashTask("queued", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	if output := receive(t, running); output.Err != nil {
+		t.Fatalf("task running when paused: %+v", output)
+	}
+	select {
+	case output := <-queued:
+		t.Fatalf("task queued while paused ran: %+v", output)
+	case <-time.After(50 * time.Millisecond):
+	}
+	queue.Resume()
+	receive(t, queued)
+}
+
+func TestResumeRunsBacklog(t *testing.T) {
+	queue := New(Config{Capacity: 10, Workers: 3, LogDisabled: true})
+	defer queue.Shutdown()
+	queue.Pause()
+
+	var outputs []<-chan Output
+	for i := 0; i < 10; i++ {
+		ch, err := queue.Put(hashTask(strconv.Itoa(i), 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, ch)
+	}
+	queue.Resume()
+	for i, ch := range outputs {
+		if output := receive(t, ch); output.Err != nil {
+			t.Errorf("task %d: %v", i, output.Err)
+		}
+	}
+	if stats := queue.Stats(); stats.Paused || stats.Size != 0 || stats.Types[tasks.HashTaskType].Tasks != 10 {
+		t.Errorf("after resuming: %+v", stats)
+	}
+}
+
+func TestPauseAfterShutdownStillDrains(t *testing.T) {
+	queue := New(Config{Capacity: 100, Workers: 1, LogDisabled: true})
+	release := make(chan struct{})
+	queue.(FuncQueue).PutFunc(&tasks.Task{Id: "running", Type: "func"}, func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	queued, err := queue.Put(hashTask("queued", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- queue.Shutdown() }()
+	// Shutdown has begun once puts are refused.
+	for i := 0; ; i++ {
+		_, err := queue.Put(hashTask("probe"+strconv.Itoa(i), 1))
+		if errors.Is(err, ErrQueueClosed) {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("queue not closing: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	queue.Pause()
+	if queue.Stats().Paused {
+		t.Error("paused while shutting down")
+	}
+	close(release)
+	receive(t, queued)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after a pause")
+	}
+}
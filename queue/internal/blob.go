@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"vu/benchmark/queue/blob"
+	"vu/benchmark/queue/tasks"
+)
+
+// ErrNoBlobStore is the output of a task with an InputBlob on a queue
+// without a blob store.
+var ErrNoBlobStore = errors.New("no blob store configured")
+
+func (q *_queue) execute(ctx context.Context, task *_taskWrapper) Output {
+	if task.fn != nil {
+		return Output{Err: task.fn(ctx)}
+	}
+	return Run(ctx, task.task, q.blobs, q.blobThreshold)
+}
+
+// Run executes task the way the queue's workers do: with its input blob,
+// if any, opened for the handler, and a result larger than blobThreshold
+// moved into blobs. Without blobs results are always inline.
+func Run(ctx context.Context, task *tasks.Task, blobs *blob.Store, blobThreshold int) Output {
+	if hash := task.InputBlob; hash != "" {
+		if blobs == nil {
+			return Output{Err: ErrNoBlobStore}
+		}
+		file, err := blobs.Open(hash)
+		if err != nil {
+			return Output{Err: err}
+		}
+		defer file.Close()
+		ctx = tasks.WithInput(ctx, file)
+	}
+
+	res, err := Execute(ctx, task)
+	if err != nil {
+		return Output{Err: err}
+	}
+	if blobs == nil || len(res) <= blobThreshold {
+		return Output{Res: res}
+	}
+
+	hash, _, err := blobs.Put(bytes.NewReader(res))
+	if err != nil {
+		return Output{Err: err}
+	}
+	return Output{Blob: hash}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "time"
+
+// threadCPUTime is only implemented on Linux.
+func threadCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"context"
+	"vu/benchmark/queue/tasks"
+)
+
+// Func runs a task put with PutFunc. It hands its result to the caller
+// itself, e.g. through a variable the caller reads once the task's Output
+// arrives, so nothing is serialized.
+type Func func(ctx context.Context) error
+
+// FuncQueue is implemented by queues that run Go functions in-process, for
+// embedding the queue in a program; see package typed.
+type FuncQueue interface {
+	// PutFunc queues task to be run by fn instead of the handler of its
+	// type, which only labels it in Stats. Its Output carries the error fn
+	// returns. Such tasks only run on the queue's own workers, so the queue
+	// must not hand tasks to others with TryClaim, Pull, Lease or Evict.
+	PutFunc(task *tasks.Task, fn Func) (<-chan Output, error)
+}
+
+func (q *_queue) PutFunc(task *tasks.Task, fn Func) (<-chan Output, error) {
+	return q.put(task, nil, fn)
+}
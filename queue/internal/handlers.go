@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"vu/benchmark/queue/tasks"
+)
+
+// Handler runs the tasks of a type registered with Register. input is the
+// task's whole input, read from its blob if it has one.
+type Handler func(ctx context.Context, input []byte) ([]byte, error)
+
+var (
+	handlersMutex sync.RWMutex
+	handlers      = make(map[string]Handler)
+)
+
+// Register adds a task type beyond the built-in ones, e.g. one run by
+// subprocesses (see package subproc), to every queue and worker of the
+// process. Its inputs are validated against schema.
+func Register(taskType string, schema tasks.TypeSchema, handler Handler) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+
+	handlers[taskType] = handler
+	tasks.RegisterSchema(taskType, schema)
+}
+
+func handlerFor(taskType string) (Handler, bool) {
+	handlersMutex.RLock()
+	defer handlersMutex.RUnlock()
+
+	handler, ok := handlers[taskType]
+	return handler, ok
+}
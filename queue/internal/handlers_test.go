@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"vu/benchmark/queue/tasks"
+)
+
+func TestRegisteredHandlerRunsTasks(t *testing.T) {
+	Register("reverse", tasks.TypeSchema{}, func(ctx context.Context, input []byte) ([]byte, error) {
+		result := bytes.Clone(input)
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+		return result, nil
+	})
+	if _, ok := tasks.SchemaFor("reverse"); !ok {
+		t.Fatal("registered type has no schema")
+	}
+
+	queue := New(Config{Capacity: 1, Workers: 1, LogDisabled: true})
+	defer queue.Shutdown()
+	ch, err := queue.Put(&tasks.Task{Id: "r", Type: "reverse", Input: []byte("abc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := <-ch; output.Err != nil || string(output.Res) != "cba" {
+		t.Errorf("output %+v", output)
+	}
+}
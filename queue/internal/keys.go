@@ -0,0 +1,46 @@
+package internal
+
+import "container/list"
+
+// Tasks with a key run one at a time and in the order they were put, while
+// tasks of other keys keep the workers busy. Only the oldest task of a key
+// is ever pending or running; the others wait in the key's backlog and
+// become pending, at the back, as it finishes.
+
+// holdBack puts task into the backlog of its key if an earlier task with
+// that key is pending or running, and otherwise marks the key busy. The
+// caller must hold q.mutex.
+func (q *_queue) holdBack(task *_taskWrapper) bool {
+	key := task.task.Key
+	if key == "" {
+		return false
+	}
+
+	backlog, busy := q.keys[key]
+	if !busy {
+		q.keys[key] = nil
+		return false
+	}
+	if backlog == nil {
+		backlog = list.New()
+		q.keys[key] = backlog
+	}
+	task.elem = backlog.PushBack(task)
+	task.backlogged = true
+	return true
+}
+
+// advance makes the next task of key pending after the previous one
+// finished, or frees the key. The caller must hold q.mutex.
+func (q *_queue) advance(key string) {
+	backlog := q.keys[key]
+	if backlog == nil || backlog.Len() == 0 {
+		delete(q.keys, key)
+		return
+	}
+
+	task := backlog.Remove(backlog.Front()).(*_taskWrapper)
+	task.backlogged = false
+	task.elem = q.pending.PushBack(task)
+	q.signal()
+}
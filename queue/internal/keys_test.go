@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+	"vu/benchmark/queue/mockserver"
+	"vu/benchmark/queue/tasks"
+)
+
+func TestKeyHoldsBackLaterTasks(t *testing.T) {
+	queue := New(Config{Capacity: 10, Workers: 0, LogDisabled: true})
+	puller := queue.(Puller)
+	for _, task := range []tasks.Task{
+		{Id: "a1", Type: tasks.SumTaskType, Key: "a"},
+		{Id: "a2", Type: tasks.SumTaskType, Key: "a"},
+		{Id: "a3", Type: tasks.SumTaskType, Key: "a"},
+		{Id: "b1", Type: tasks.SumTaskType, Key: "b"},
+		{Id: "x", Type: tasks.SumTaskType},
+	} {
+		if _, err := queue.Put(&task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := queue.Stats(); stats.Waiting != 2 {
+		t.Errorf("%d tasks waiting, want 2", stats.Waiting)
+	}
+
+	pull := func() *Claim {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		claim, err := puller.Pull(ctx, nil)
+		if err != nil {
+			return nil
+		}
+		return claim
+	}
+
+	a1 := pull()
+	if b1, x := pull(), pull(); a1.Task().Id != "a1" || b1.Task().Id != "b1" || x.Task().Id != "x" {
+		t.Fatalf("pulled %s, %s, %s", a1.Task().Id, b1.Task().Id, x.Task().Id)
+	}
+	if claim := pull(); claim != nil {
+		t.Fatalf("pulled %s while a1 runs", claim.Task().Id)
+	}
+
+	// A cancelled task leaves its place in line.
+	if err := queue.Cancel("a2"); err != nil {
+		t.Fatal(err)
+	}
+	// Released, a1 still comes before the rest of its key.
+	a1.Release()
+	if claim := pull(); claim == nil || claim.Task().Id != "a1" {
+		t.Fatalf("pulled %v after releasing a1", claim)
+	} else {
+		claim.Complete(Output{})
+	}
+	if claim := pull(); claim == nil || claim.Task().Id != "a3" {
+		t.Fatalf("pulled %v after completing a1", claim)
+	}
+}
+
+// TestKeyOrderUnderConcurrency puts many keys' tasks from concurrent
+// producers and runs them on many workers with random delays. Within a key
+// the tasks must run one at a time and in order.
+func TestKeyOrderUnderConcurrency(t *testing.T) {
+	const keys, perKey, workers = 50, 40, 16
+	queue := New(Config{Capacity: keys * perKey, Workers: 0, LogDisabled: true})
+	puller := queue.(Puller)
+
+	var mutex sync.Mutex
+	running := make(map[string]bool)
+	next := make(map[string]int)
+	maxRunning := 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var workerGroup sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			for {
+				claim, err := puller.Pull(ctx, nil)
+				if err != nil {
+					return
+				}
+				task := claim.Task()
+				var seq int
+				fmt.Sscanf(task.Id, task.Key+"-%d", &seq)
+
+				mutex.Lock()
+				if running[task.Key] {
+					t.Errorf("%s runs while an earlier task of its key does", task.Id)
+				}
+				if seq != next[task.Key] {
+					t.Errorf("%s runs before %s-%d", task.Id, task.Key, next[task.Key])
+				}
+				running[task.Key] = true
+				next[task.Key] = seq + 1
+				maxRunning = max(maxRunning, len(running))
+				mutex.Unlock()
+
+				time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+
+				mutex.Lock()
+				delete(running, task.Key)
+				mutex.Unlock()
+				claim.Complete(Output{})
+			}
+		}()
+	}
+
+	var producers sync.WaitGroup
+	for k := 0; k < keys; k++ {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			key := fmt.Sprint("k", k)
+			var channels []<-chan Output
+			for i := 0; i < perKey; i++ {
+				ch, err := queue.Put(&tasks.Task{Id: fmt.Sprintf("%s-%d", key, i), Type: tasks.SumTaskType, Key: key})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				channels = append(channels, ch)
+			}
+			for _, ch := range channels {
+				<-ch
+			}
+		}()
+	}
+	producers.Wait()
+	cancel()
+	workerGroup.Wait()
+
+	for k := 0; k < keys; k++ {
+		if key := fmt.Sprint("k", k); next[key] != perKey {
+			t.Errorf("%s ran %d of %d tasks", key, next[key], perKey)
+		}
+	}
+	if maxRunning < workers/2 {
+		t.Errorf("at most %d keys ran at once with %d workers", maxRunning, workers)
+	}
+}
+
+// TestKeyedTasksDoNotIdleWorkers checks that a long line of one key runs
+// alongside other keys on the local workers.
+func TestKeyedTasksDoNotIdleWorkers(t *testing.T) {
+	api, err := mockserver.Start(mockserver.Config{
+		Latency:     mockserver.Latency{Base: 50 * time.Millisecond},
+		LogDisabled: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	input, _ := json.Marshal(tasks.SlowAPITaskInput{Addr: api.Addr()})
+
+	queue := New(Config{Capacity: 20, Workers: 4, LogDisabled: true})
+	defer queue.Shutdown()
+
+	start := time.Now()
+	var line []<-chan Output
+	for i := 0; i < 4; i++ {
+		ch, _ := queue.Put(&tasks.Task{Id: fmt.Sprint("a", i), Type: tasks.SlowAPITaskType, Input: input, Key: "a"})
+		line = append(line, ch)
+	}
+	other, _ := queue.Put(&tasks.Task{Id: "b", Type: tasks.SlowAPITaskType, Input: input, Key: "b"})
+
+	if output := <-other; output.Err != nil {
+		t.Fatal(output.Err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("key b waited %v behind key a", elapsed)
+	}
+	for _, ch := range line {
+		if output := <-ch; output.Err != nil {
+			t.Fatal(output.Err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("four tasks of one key took %v, so some ran at once", elapsed)
+	}
+}
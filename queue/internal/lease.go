@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrLeaseExpired is returned for a lease that ran out, or was otherwise
+// settled, before it was acked or extended. Its task was put back into the
+// queue and is delivered again, so processing is at least once.
+var ErrLeaseExpired = errors.New("lease expired")
+
+// Lease is Pull with a visibility timeout: the task is invisible to others
+// for visibility, after which it is put back at the head of the queue unless
+// the claim was acked, released or extended meanwhile.
+func (q *_queue) Lease(ctx context.Context, types []string, visibility time.Duration) (*Claim, error) {
+	claim, err := q.Pull(ctx, types)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	claim.lease(visibility)
+	return claim, nil
+}
+
+// Lease turns a claim taken with TryClaim or Pull into a lease that runs
+// out after visibility, as if it was taken with Lease.
+func (c *Claim) Lease(visibility time.Duration) error {
+	c.queue.mutex.Lock()
+	defer c.queue.mutex.Unlock()
+
+	if c.settled {
+		return ErrLeaseExpired
+	}
+	if c.timer != nil {
+		return errors.New("claim is a lease already")
+	}
+	c.lease(visibility)
+	return nil
+}
+
+// lease starts the lease timer. The caller must hold the queue's mutex.
+func (c *Claim) lease(visibility time.Duration) {
+	c.expires = time.Now().Add(visibility)
+	c.timer = time.AfterFunc(visibility, c.expire)
+}
+
+// Ack completes the claimed task with output and hands it to its waiter. It
+// fails with ErrLeaseExpired if the claim was settled before, e.g. because
+// its lease ran out.
+func (c *Claim) Ack(output Output) error {
+	c.queue.mutex.Lock()
+	defer c.queue.mutex.Unlock()
+
+	if c.settled {
+		return ErrLeaseExpired
+	}
+	c.settle()
+	c.queue.complete(c.wrapper, output)
+	return nil
+}
+
+// Extend keeps a leased task invisible until visibility from now, for
+// tasks running longer than their lease.
+func (c *Claim) Extend(visibility time.Duration) error {
+	c.queue.mutex.Lock()
+	defer c.queue.mutex.Unlock()
+
+	if c.settled {
+		return ErrLeaseExpired
+	}
+	if c.timer == nil {
+		return errors.New("claim is not a lease")
+	}
+	c.expires = time.Now().Add(visibility)
+	c.timer.Reset(visibility)
+	return nil
+}
+
+// Deliveries is how many times the claimed task was handed out, including
+// this time.
+func (c *Claim) Deliveries() int {
+	c.queue.mutex.Lock()
+	defer c.queue.mutex.Unlock()
+
+	return c.wrapper.deliveries
+}
+
+// expire runs when the lease timer fires and requeues the task unless the
+// lease was extended or settled meanwhile.
+func (c *Claim) expire() {
+	q := c.queue
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// An Extend racing with the timer rescheduled it.
+	if c.settled || time.Now().Before(c.expires) {
+		return
+	}
+	c.settled = true
+	q.expiredLeases++
+	c.requeue()
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+	"vu/benchmark/queue/tasks"
+)
+
+func TestExpiredLeaseIsRedelivered(t *testing.T) {
+	queue := New(Config{Capacity: 10, Workers: 0, LogDisabled: true})
+	puller := queue.(Puller)
+	ch, _ := queue.Put(&tasks.Task{Id: "a", Type: tasks.SumTaskType})
+
+	first, err := puller.Lease(context.Background(), nil, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first worker dies; the task stays invisible until its lease ends.
+	start := time.Now()
+	second, err := puller.Lease(context.Background(), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("task visible again after %v", waited)
+	}
+	if n := second.Deliveries(); n != 2 {
+		t.Errorf("%d deliveries, want 2", n)
+	}
+
+	if err := first.Ack(Output{Res: []byte("late")}); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("ack of expired lease: %v", err)
+	}
+	if err := first.Extend(time.Second); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("extend of expired lease: %v", err)
+	}
+	if err := second.Ack(Output{Res: []byte("done")}); err != nil {
+		t.Fatal(err)
+	}
+	if output := <-ch; string(output.Res) != "done" {
+		t.Errorf("output %+v", output)
+	}
+	if stats := queue.Stats(); stats.ExpiredLeases != 1 || stats.Size != 0 || stats.Running != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestExtendKeepsTaskInvisible(t *testing.T) {
+	queue := New(Config{Capacity: 10, Workers: 0, LogDisabled: true})
+	puller := queue.(Puller)
+	queue.Put(&tasks.Task{Id: "long", Type: tasks.SumTaskType})
+
+	claim, err := puller.Lease(context.Background(), nil, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-time.After(20 * time.Millisecond):
+				claim.Extend(50 * time.Millisecond)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if other, err := puller.Lease(ctx, nil, time.Second); err == nil {
+		t.Fatalf("extended task delivered again, %d deliveries", other.Deliveries())
+	}
+	close(stop)
+
+	if err := claim.Ack(Output{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := queue.Stats(); stats.ExpiredLeases != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// TestEveryTaskCompletesWhileWorkersDie runs tasks on workers that often
+// die mid-task, abandoning their lease. Every task must still complete,
+// exactly once from its waiter's view.
+func TestEveryTaskCompletesWhileWorkersDie(t *testing.T) {
+	const n = 200
+	queue := New(Config{Capacity: n, Workers: 0, LogDisabled: true})
+	puller := queue.(Puller)
+
+	channels := make([]<-chan Output, n)
+	for i := range channels {
+		ch, err := queue.Put(&tasks.Task{Id: fmt.Sprint(i), Type: tasks.SumTaskType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels[i] = ch
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				claim, err := puller.Lease(ctx, nil, 20*time.Millisecond)
+				if err != nil {
+					return
+				}
+				if rand.Intn(10) < 3 {
+					// Killed: the lease is never acked.
+					continue
+				}
+				claim.Ack(Output{Res: []byte(claim.Task().Id)})
+			}
+		}()
+	}
+
+	for i, ch := range channels {
+		select {
+		case output := <-ch:
+			if string(output.Res) != fmt.Sprint(i) {
+				t.Errorf("task %d: output %q", i, output.Res)
+			}
+			if _, more := <-ch; more {
+				t.Errorf("task %d: second output", i)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("task %d never completed", i)
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	if stats := queue.Stats(); stats.Size != 0 || stats.ExpiredLeases == 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestTryClaimTurnedIntoLeaseExpires(t *testing.T) {
+	queue := New(Config{Capacity: 10, Workers: 0, LogDisabled: true})
+	queue.Put(&tasks.Task{Id: "a", Type: tasks.SumTaskType})
+
+	claim, ok := queue.TryClaim()
+	if !ok {
+		t.Fatal("nothing to claim")
+	}
+	if err := claim.Lease(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := claim.Lease(time.Second); err == nil {
+		t.Error("leased twice")
+	}
+	time.Sleep(50 * time.Millisecond)
+	again, ok := queue.TryClaim()
+	if !ok || again.Task().Id != "a" {
+		t.Fatalf("task not back after its lease ran out")
+	}
+	if err := claim.Ack(Output{}); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("ack of expired lease: %v", err)
+	}
+}
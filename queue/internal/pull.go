@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+var ErrPullUnsupported = errors.New("queue does not support remote workers")
+
+// Puller is implemented by queues that hand tasks to remote workers.
+type Puller interface {
+	// Pull blocks until the oldest queued task of one of types, or of any
+	// type if types is empty, can be claimed. It fails once ctx is done or
+	// the queue is closed without such a task left.
+	Pull(ctx context.Context, types []string) (*Claim, error)
+	// Lease is Pull with the claim expiring after visibility unless it is
+	// acked or extended first.
+	Lease(ctx context.Context, types []string, visibility time.Duration) (*Claim, error)
+}
+
+// Evicter is implemented by queues whose queued tasks can be moved to
+// another queue, e.g. the one of a restarted server.
+type Evicter interface {
+	// Evict is TryClaim ignoring Pause, so the queue can be paused to keep
+	// its workers from starting the tasks while they are moved.
+	Evict() (*Claim, bool)
+}
+
+func (q *_queue) Evict() (*Claim, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.pending.Len() == 0 {
+		return nil, false
+	}
+	return q.claim(q.dispatch()), true
+}
+
+func (q *_queue) Pull(ctx context.Context, types []string) (*Claim, error) {
+	// sync.Cond knows nothing of contexts; wake the waiters to notice.
+	stop := context.AfterFunc(ctx, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		q.pulls.Broadcast()
+	})
+	defer stop()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !q.paused {
+			if elem := q.find(types); elem != nil {
+				return q.claim(q.take(elem)), nil
+			}
+		}
+		if q.closed {
+			return nil, ErrQueueClosed
+		}
+		q.pulls.Wait()
+	}
+}
+
+// find returns the oldest pending task of one of types. The caller must
+// hold q.mutex.
+func (q *_queue) find(types []string) *list.Element {
+	for elem := q.pending.Front(); elem != nil; elem = elem.Next() {
+		if len(types) == 0 || slices.Contains(types, elem.Value.(*_taskWrapper).task.Type) {
+			return elem
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"vu/benchmark/queue/tasks"
+)
+
+func TestPullTakesOldestTaskOfItsTypes(t *testing.T) {
+	queue := New(Config{Capacity: 10, Workers: 0, LogDisabled: true})
+	puller := queue.(Puller)
+
+	for _, task := range []tasks.Task{
+		{Id: "hash", Type: tasks.HashTaskType},
+		{Id: "sum1", Type: tasks.SumTaskType},
+		{Id: "sum2", Type: tasks.SumTaskType},
+	} {
+		if _, err := queue.Put(&task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claim, err := puller.Pull(context.Background(), []string{tasks.SumTaskType})
+	if err != nil || claim.Task().Id != "sum1" {
+		t.Fatalf("Pull: %v %v", claim, err)
+	}
+	claim.Complete(Output{Res: []byte("done")})
+
+	claim, err = puller.Pull(context.Background(), nil)
+	if err != nil || claim.Task().Id != "hash" {
+		t.Fatalf("Pull of any type: %v %v", claim, err)
+	}
+	claim.Release()
+
+	// Nothing to run until ctx ends.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := puller.Pull(ctx, []string{tasks.BurnCPUTaskType}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Pull without tasks: %v", err)
+	}
+
+	// A waiting pull gets the next matching task.
+	pulled := make(chan *Claim)
+	go func() {
+		claim, _ := puller.Pull(context.Background(), []string{tasks.BurnCPUTaskType})
+		pulled <- claim
+	}()
+	time.Sleep(10 * time.Millisecond)
+	queue.Put(&tasks.Task{Id: "burn", Type: tasks.BurnCPUTaskType})
+	select {
+	case claim := <-pulled:
+		if claim == nil || claim.Task().Id != "burn" {
+			t.Fatalf("waiting pull got %v", claim)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting pull was not woken")
+	}
+}
+
+func TestEvictIgnoresPause(t *testing.T) {
+	queue := New(Config{Capacity: 10, Workers: 0, LogDisabled: true})
+	ch, _ := queue.Put(&tasks.Task{Id: "a", Type: tasks.SumTaskType})
+	queue.Pause()
+
+	if _, ok := queue.TryClaim(); ok {
+		t.Fatal("claimed from a paused queue")
+	}
+	claim, ok := queue.(Evicter).Evict()
+	if !ok || claim.Task().Id != "a" {
+		t.Fatalf("Evict: %v %v", claim, ok)
+	}
+	if _, ok := queue.(Evicter).Evict(); ok {
+		t.Fatal("evicted a task twice")
+	}
+	claim.Complete(Output{Res: []byte("moved")})
+	if output := <-ch; string(output.Res) != "moved" {
+		t.Errorf("output %+v", output)
+	}
+}
@@ -0,0 +1,46 @@
+package internal
+
+// Tuner is implemented by queues whose settings can change while they run,
+// e.g. on a configuration reload.
+type Tuner interface {
+	// SetWorkers grows or shrinks the worker pool. Workers beyond n finish
+	// the task they run before they stop.
+	SetWorkers(n int)
+	// SetCapacity changes how many tasks the queue holds. Lowering it below
+	// the tasks queued keeps them and refuses new ones until they drain.
+	SetCapacity(n int)
+	// SetLogDisabled turns the per-task worker logs off or on.
+	SetLogDisabled(disabled bool)
+}
+
+func (q *_queue) SetWorkers(n int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.poolSize = max(n, 0)
+	for len(q.workers) < q.poolSize {
+		q.workers = append(q.workers, WorkerStats{ID: len(q.workers) + 1})
+		q.live = append(q.live, false)
+	}
+	if q.closed {
+		return
+	}
+	for id := 1; id <= q.poolSize; id++ {
+		if !q.live[id-1] {
+			q.startWorker(id)
+		}
+	}
+	// Idle workers beyond the pool see it shrank and stop.
+	q.ready.Broadcast()
+}
+
+func (q *_queue) SetCapacity(n int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.capacity = n
+}
+
+func (q *_queue) SetLogDisabled(disabled bool) {
+	q.logDisabled.Store(disabled)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vu/benchmark/queue/tasks"
+)
+
+func TestSetWorkersResizesPool(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	release := make(chan struct{})
+	Register("block", tasks.TypeSchema{}, func(ctx context.Context, input []byte) ([]byte, error) {
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		if string(input) == "block" {
+			<-release
+		} else {
+			time.Sleep(5 * time.Millisecond)
+		}
+		running.Add(-1)
+		return nil, nil
+	})
+
+	queue := New(Config{Capacity: 10, Workers: 1, LogDisabled: true})
+	defer queue.Shutdown()
+	tuner := queue.(Tuner)
+
+	put := func(n int, prefix, input string) []<-chan Output {
+		var channels []<-chan Output
+		for i := 0; i < n; i++ {
+			ch, err := queue.Put(&tasks.Task{Id: fmt.Sprint(prefix, i), Type: "block", Input: []byte(input)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			channels = append(channels, ch)
+		}
+		return channels
+	}
+	waitRunning := func(n int32) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for running.Load() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d tasks running, want %d", running.Load(), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	first := put(4, "a", "block")
+	waitRunning(1)
+	tuner.SetWorkers(4)
+	waitRunning(4)
+	if stats := queue.Stats(); stats.Workers != 4 || len(stats.PerWorker) != 4 {
+		t.Errorf("stats after growing: %d workers, %d accounted", stats.Workers, len(stats.PerWorker))
+	}
+
+	// Shrinking lets the running tasks finish, then one worker is left.
+	tuner.SetWorkers(1)
+	time.Sleep(20 * time.Millisecond)
+	if n := running.Load(); n != 4 {
+		t.Fatalf("%d tasks running after shrinking, want the 4 started", n)
+	}
+	close(release)
+	for _, ch := range first {
+		<-ch
+	}
+	maxRunning.Store(0)
+	for _, ch := range put(4, "b", "sleep") {
+		<-ch
+	}
+	if n := maxRunning.Load(); n > 1 {
+		t.Errorf("%d tasks ran at once on one worker", n)
+	}
+}
+
+func TestSetCapacity(t *testing.T) {
+	queue := New(Config{Capacity: 1, Workers: 0, LogDisabled: true})
+	queue.Put(&tasks.Task{Id: "a", Type: tasks.SumTaskType})
+	if _, err := queue.Put(&tasks.Task{Id: "b", Type: tasks.SumTaskType}); err != ErrQueueFull {
+		t.Fatalf("put over capacity: %v", err)
+	}
+	queue.(Tuner).SetCapacity(2)
+	if _, err := queue.Put(&tasks.Task{Id: "b", Type: tasks.SumTaskType}); err != nil {
+		t.Fatalf("put after raising capacity: %v", err)
+	}
+}
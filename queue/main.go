@@ -4,49 +4,173 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
+	"vu/benchmark/queue/breaker"
 	"vu/benchmark/queue/runner"
 )
 
 //go run main.go -mode=server -workers=4 -capacity=10 -addr=:8082
 
 func main() {
-	mode := flag.String("mode", "server", "choose server or client mode")
-	addr := flag.String("addr", ":8080", "tcp listen address")
+	mode := flag.String("mode", "server", "choose server, client or worker mode")
+	addr := flag.String("addr", ":8080", "tcp listen address, none if empty; or the server address of a worker or client, comma-separated for several servers of a client; unix:path for a Unix socket")
 
 	// Server options.
 	capacity := flag.Int("capacity", 100, "queue capacity")
-	workers := flag.Int("workers", 8, "number of worker goroutines")
+	workers := flag.Int("workers", 8, "number of worker goroutines; 0 leaves all tasks to remote workers")
+	peers := flag.String("peers", "", "comma-separated addresses of peer queue servers")
+	raftAddr := flag.String("raft-addr", "", "raft listen address, enables replication")
+	raftPeers := flag.String("raft-peers", "", "comma-separated addr=raft-addr pairs of the other replicas")
+	cpuAccounting := flag.Bool("cpu-accounting", false, "measure per-task CPU time (Linux; pins each running task to an OS thread)")
+	pprofLabels := flag.Bool("pprof-labels", false, "label handler goroutines with their task type in profiles")
+	debugAddr := flag.String("debug-addr", "", "http listen address for pprof, runtime stats and trace capture")
+	traceDir := flag.String("trace-dir", ".", "directory for traces captured through -debug-addr")
+	blobDir := flag.String("blob-dir", "", "directory of the blob store for large task inputs and results, disabled if empty")
+	resultBlobThreshold := flag.Int("result-blob-threshold", 1<<20, "results larger than this many bytes are stored as blobs")
+	uploadTimeout := flag.Duration("upload-timeout", 10*time.Minute, "discard blob uploads nothing was appended to for this long, never if 0")
+	blobTTL := flag.Duration("blob-ttl", 24*time.Hour, "remove blobs neither stored nor read for this long, never if 0")
+	unixSocket := flag.String("unix-socket", "", "path of a Unix socket to accept clients on besides -addr")
+	unixSocketMode := flag.Uint("unix-socket-mode", 0o660, "permissions of the -unix-socket file")
+	maxConns := flag.Int("max-conns", 0, "maximum open client connections, unlimited if 0")
+	idleTimeout := flag.Duration("idle-timeout", 5*time.Minute, "close connections silent this long with nothing in flight, never if 0")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "time limit to read a request once it started arriving, none if 0")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "time limit to write a response, none if 0")
+	keepAlive := flag.Duration("keepalive", 15*time.Second, "TCP keepalive period of client connections, disabled if negative")
+	handlers := flag.String("handlers", "", "comma-separated type=command pairs adding task types run by external processes")
+	handlerProcs := flag.Int("handler-procs", 1, "processes per external handler")
+	handlerTimeout := flag.Duration("handler-timeout", 30*time.Second, "time limit of a task run by an external handler")
+	handlerMemory := flag.Uint64("handler-memory", 0, "address space limit of each handler process in bytes (Linux), none if 0")
+	handlerCPU := flag.Duration("handler-cpu", 0, "CPU time limit of each handler process (Linux), none if 0")
+	breakerFailures := flag.Int("breaker-failures", 5, "failed calls in a row that open the circuit to an IO task's backend; 0 disables breakers and bulkheads")
+	breakerCooldown := flag.Duration("breaker-cooldown", 5*time.Second, "how long an open circuit fails calls before probing the backend again")
+	breakerTimeout := flag.Duration("breaker-timeout", 10*time.Second, "time limit of a call to an IO task's backend, counted as failed beyond it; none if 0")
+	bulkhead := flag.Int("bulkhead", 0, "maximum concurrent calls to one backend, unlimited if 0")
+	submitRate := flag.Float64("submit-rate", 0, "maximum client submissions per second, unlimited if 0")
+	submitBurst := flag.Int("submit-burst", 1, "submissions accepted at once under -submit-rate")
+	logLevel := flag.String("log-level", runner.LogDebug, "server log level: debug logs every task, info only server events")
+	configPath := flag.String("config", "", "JSON server configuration file replacing the server flags; SIGHUP reloads it")
+
+	// Worker options; -workers is the concurrency and -blob-dir must be
+	// the server's, shared.
+	workerName := flag.String("worker-name", "", "name of this worker in the server logs, host-pid by default")
+	workerTypes := flag.String("types", "", "comma-separated task types this worker runs, all if empty")
+	visibility := flag.Duration("visibility", 30*time.Second, "lease period of the tasks a worker pulls; leases of running tasks are extended")
 
 	// Client options.
 	total := flag.Int("total", 1000, "total tasks to run")
 	concurrency := flag.Int("concurrency", 8, "concurrent client workers")
 	iterations := flag.Int("iterations", 100000, "hash iterations per tasks")
+	profilePath := flag.String("profile", "", "JSON load profile to replay open-loop instead of a fixed number of tasks")
+	name := flag.String("name", "", "label for this run in its report, e.g. the commit")
+	jsonOut := flag.String("json", "", "write the run report as JSON to this file")
+	csvOut := flag.String("csv", "", "write the per-second time series as CSV to this file")
 
 	flag.Parse()
 
+	handlerList, err := runner.ParseHandlers(*handlers, *handlerProcs, *handlerTimeout, *handlerMemory, *handlerCPU)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var breakerConfig *breaker.Config
+	if *breakerFailures > 0 {
+		breakerConfig = &breaker.Config{Failures: *breakerFailures, Cooldown: *breakerCooldown, MaxConcurrent: *bulkhead, Timeout: *breakerTimeout}
+	}
+
 	switch *mode {
 	case "server":
+		if *configPath != "" {
+			cfg, err := runner.LoadServerConfig(*configPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if err := runner.RunServer(cfg); err != nil {
+				os.Exit(1)
+			}
+			return
+		}
+		var peerList []string
+		if *peers != "" {
+			peerList = strings.Split(*peers, ",")
+		}
+		raftPeerMap := make(map[string]string)
+		if *raftPeers != "" {
+			for _, pair := range strings.Split(*raftPeers, ",") {
+				addr, raftAddr, ok := strings.Cut(pair, "=")
+				if !ok {
+					fmt.Fprintf(os.Stderr, "invalid raft peer %q (expected addr=raft-addr)\n", pair)
+					os.Exit(1)
+				}
+				raftPeerMap[addr] = raftAddr
+			}
+		}
 		err := runner.RunServer(runner.ServerConfig{
-			Addr:     *addr,
-			Capacity: *capacity,
-			Workers:  *workers,
+			Addr:                *addr,
+			Capacity:            *capacity,
+			Workers:             *workers,
+			Peers:               peerList,
+			RaftAddr:            *raftAddr,
+			RaftPeers:           raftPeerMap,
+			CPUAccounting:       *cpuAccounting,
+			ProfileLabels:       *pprofLabels,
+			DebugAddr:           *debugAddr,
+			TraceDir:            *traceDir,
+			BlobDir:             *blobDir,
+			ResultBlobThreshold: *resultBlobThreshold,
+			UploadTimeout:       *uploadTimeout,
+			BlobTTL:             *blobTTL,
+			Handlers:            handlerList,
+			Breaker:             breakerConfig,
+			UnixSocket:          *unixSocket,
+			UnixSocketMode:      os.FileMode(*unixSocketMode),
+			MaxConns:            *maxConns,
+			IdleTimeout:         *idleTimeout,
+			ReadTimeout:         *readTimeout,
+			WriteTimeout:        *writeTimeout,
+			KeepAlive:           *keepAlive,
+			SubmitRate:          *submitRate,
+			SubmitBurst:         *submitBurst,
+			LogLevel:            *logLevel,
 		})
 		if err != nil {
 			os.Exit(1)
 		}
+	case "worker":
+		var types []string
+		if *workerTypes != "" {
+			types = strings.Split(*workerTypes, ",")
+		}
+		err := runner.RunWorker(runner.WorkerConfig{
+			Addr:                *addr,
+			Name:                *workerName,
+			Types:               types,
+			Concurrency:         *workers,
+			Visibility:          *visibility,
+			BlobDir:             *blobDir,
+			ResultBlobThreshold: *resultBlobThreshold,
+			Handlers:            handlerList,
+			Breaker:             breakerConfig,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	case "client":
-		err := runner.RunClient(runner.ClientConfig{
-			Addr:        *addr,
+		err := runner.RunBench(runner.ClientConfig{
+			Addrs:       strings.Split(*addr, ","),
 			Total:       *total,
 			Concurrency: *concurrency,
 			Iterations:  *iterations,
-		})
+			Output:      runner.OutputConfig{Name: *name, JSONPath: *jsonOut, CSVPath: *csvOut},
+		}, *profilePath)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	default:
-		fmt.Fprintf(os.Stderr, "unknown mode %q (expected server or client)\n", *mode)
+		fmt.Fprintf(os.Stderr, "unknown mode %q (expected server, client or worker)\n", *mode)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,121 @@
+// Package metrics records benchmark results: latency histograms, error
+// breakdowns and per-second time series, and writes them as JSON or CSV
+// reports that can be compared across runs.
+package metrics
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// subBucketBits sets the histogram precision: values are bucketed with
+// 2^subBucketBits linear sub-buckets per power of two, i.e. a relative
+// error below 1/2^(subBucketBits-1).
+const (
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+)
+
+// Histogram is a log-linear histogram in the style of HdrHistogram. It keeps
+// a bounded relative error over the whole int64 range while only storing
+// the buckets actually used. It is not safe for concurrent use.
+type Histogram struct {
+	counts map[int]int64
+	total  int64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make(map[int]int64), min: math.MaxInt64}
+}
+
+func bucketIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	top := int(v >> shift)
+	return subBucketCount + (shift-1)*subBucketHalf + (top - subBucketHalf)
+}
+
+// bucketUpper is the highest value that falls into bucket index.
+func bucketUpper(index int) int64 {
+	if index < subBucketCount {
+		return int64(index)
+	}
+	shift := (index-subBucketCount)/subBucketHalf + 1
+	top := int64((index-subBucketCount)%subBucketHalf + subBucketHalf)
+	return (top+1)<<shift - 1
+}
+
+// Record adds a value; negative values are recorded as zero.
+func (h *Histogram) Record(v int64) {
+	v = max(v, 0)
+	h.counts[bucketIndex(v)]++
+	h.total++
+	h.sum += float64(v)
+	h.min = min(h.min, v)
+	h.max = max(h.max, v)
+}
+
+func (h *Histogram) Merge(other *Histogram) {
+	for index, count := range other.counts {
+		h.counts[index] += count
+	}
+	h.total += other.total
+	h.sum += other.sum
+	h.min = min(h.min, other.min)
+	h.max = max(h.max, other.max)
+}
+
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+func (h *Histogram) Min() int64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.min
+}
+
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+func (h *Histogram) Mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / float64(h.total)
+}
+
+// ValueAt returns the value below which percentile percent of the recorded
+// values fall, within the histogram's precision.
+func (h *Histogram) ValueAt(percentile float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	target := int64(math.Ceil(percentile / 100 * float64(h.total)))
+	target = min(max(target, 1), h.total)
+
+	indexes := make([]int, 0, len(h.counts))
+	for index := range h.counts {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var seen int64
+	for _, index := range indexes {
+		seen += h.counts[index]
+		if seen >= target {
+			return min(bucketUpper(index), h.max)
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestHistogramPercentilesWithinPrecision(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	h := NewHistogram()
+	values := make([]int64, 100_000)
+	for i := range values {
+		// Long-tailed, from microseconds to seconds in nanoseconds.
+		values[i] = int64(math.Exp(rng.Float64()*15) * 1000)
+		h.Record(values[i])
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		exact := values[int(math.Ceil(p/100*float64(len(values))))-1]
+		got := h.ValueAt(p)
+		if err := math.Abs(float64(got-exact)) / float64(exact); err > 1.0/subBucketHalf {
+			t.Errorf("p%v = %d, exact %d (relative error %.4f)", p, got, exact, err)
+		}
+	}
+	if h.ValueAt(100) != values[len(values)-1] || h.Max() != values[len(values)-1] {
+		t.Errorf("max = %d, want %d", h.Max(), values[len(values)-1])
+	}
+}
+
+func TestBucketBoundsRoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 129, 255, 256, 1 << 20, 1<<40 + 12345, math.MaxInt64} {
+		index := bucketIndex(v)
+		if upper := bucketUpper(index); upper < v {
+			t.Errorf("value %d in bucket %d whose upper bound is %d", v, index, upper)
+		}
+		if index > 0 && bucketUpper(index-1) >= v {
+			t.Errorf("value %d also fits the previous bucket %d", v, index-1)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Recorder collects the outcome of every task of a benchmark run. It is safe
+// for concurrent use.
+type Recorder struct {
+	mutex   sync.Mutex
+	start   time.Time
+	latency *Histogram
+	failed  int64
+	dropped int64
+	errors  map[string]int64
+	seconds []*second
+}
+
+type second struct {
+	latency *Histogram
+	failed  int64
+	dropped int64
+}
+
+func NewRecorder(start time.Time) *Recorder {
+	return &Recorder{
+		start:   start,
+		latency: NewHistogram(),
+		errors:  make(map[string]int64),
+	}
+}
+
+// second returns the time-series bucket at is in. The caller must hold
+// r.mutex.
+func (r *Recorder) second(at time.Time) *second {
+	index := max(int(at.Sub(r.start)/time.Second), 0)
+	for len(r.seconds) <= index {
+		r.seconds = append(r.seconds, &second{latency: NewHistogram()})
+	}
+	return r.seconds[index]
+}
+
+// Success records a task that completed at with the given latency.
+func (r *Recorder) Success(at time.Time, latency time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.latency.Record(int64(latency))
+	r.second(at).latency.Record(int64(latency))
+}
+
+// Failure records a task that finally failed at. Failures are broken down
+// by message, so it should not name the task.
+func (r *Recorder) Failure(at time.Time, message string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.failed++
+	r.second(at).failed++
+	r.errors[message]++
+}
+
+// Drop records a task that was due at but never sent, because too many
+// were in flight.
+func (r *Recorder) Drop(at time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.dropped++
+	r.second(at).dropped++
+}
+
+// Error counts an error that was retried, without failing the task.
+func (r *Recorder) Error(message string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.errors[message]++
+}
+
+// Report summarizes everything recorded up to end.
+func (r *Recorder) Report(name string, end time.Time) *Report {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	duration := end.Sub(r.start)
+	report := &Report{
+		Name:            name,
+		StartedAt:       r.start,
+		DurationSeconds: duration.Seconds(),
+		Completed:       r.latency.Count(),
+		Failed:          r.failed,
+		Dropped:         r.dropped,
+		Throughput:      float64(r.latency.Count()) / duration.Seconds(),
+		Latency:         summarize(r.latency),
+		Errors:          make(map[string]int64),
+	}
+	for message, count := range r.errors {
+		report.Errors[message] = count
+	}
+	for i, s := range r.seconds {
+		report.Series = append(report.Series, SecondStats{
+			Second:    i,
+			Completed: s.latency.Count(),
+			Failed:    s.failed,
+			Dropped:   s.dropped,
+			P50:       time.Duration(s.latency.ValueAt(50)),
+			P99:       time.Duration(s.latency.ValueAt(99)),
+			Max:       time.Duration(s.latency.Max()),
+		})
+	}
+	return report
+}
+
+// Report is the result of one benchmark run. Durations are in nanoseconds
+// in JSON.
+type Report struct {
+	Name            string    `json:"name"`
+	StartedAt       time.Time `json:"startedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Completed       int64     `json:"completed"`
+	Failed          int64     `json:"failed"`
+	// Dropped counts the tasks of an open-loop run that were never sent.
+	Dropped    int64            `json:"dropped,omitempty"`
+	Throughput float64          `json:"throughput"`
+	Latency    LatencySummary   `json:"latency"`
+	Errors     map[string]int64 `json:"errors,omitempty"`
+	Series     []SecondStats    `json:"series,omitempty"`
+}
+
+type LatencySummary struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P99  time.Duration `json:"p99"`
+	P999 time.Duration `json:"p999"`
+	Max  time.Duration `json:"max"`
+}
+
+// SecondStats covers tasks that finished during one second of the run.
+type SecondStats struct {
+	Second    int           `json:"second"`
+	Completed int64         `json:"completed"`
+	Failed    int64         `json:"failed"`
+	Dropped   int64         `json:"dropped,omitempty"`
+	P50       time.Duration `json:"p50"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+}
+
+func summarize(h *Histogram) LatencySummary {
+	return LatencySummary{
+		Min:  time.Duration(h.Min()),
+		Mean: time.Duration(h.Mean()),
+		P50:  time.Duration(h.ValueAt(50)),
+		P90:  time.Duration(h.ValueAt(90)),
+		P99:  time.Duration(h.ValueAt(99)),
+		P999: time.Duration(h.ValueAt(99.9)),
+		Max:  time.Duration(h.Max()),
+	}
+}
+
+// Print writes a human readable summary.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "completed %d tasks, failed %d in %.2fs (throughput: %.2f tasks/sec)\n",
+		r.Completed, r.Failed, r.DurationSeconds, r.Throughput)
+	if r.Dropped > 0 {
+		fmt.Fprintf(w, "dropped %d tasks over the in-flight limit\n", r.Dropped)
+	}
+	l := r.Latency
+	fmt.Fprintf(w, "latency p50 %v, p90 %v, p99 %v, p99.9 %v, max %v (mean %v)\n",
+		l.P50, l.P90, l.P99, l.P999, l.Max, l.Mean)
+
+	messages := make([]string, 0, len(r.Errors))
+	for message := range r.Errors {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool { return r.Errors[messages[i]] > r.Errors[messages[j]] })
+	for _, message := range messages {
+		fmt.Fprintf(w, "  %6d × %s\n", r.Errors[message], message)
+	}
+}
+
+func (r *Report) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// WriteCSV writes the per-second time series, latencies in microseconds.
+func (r *Report) WriteCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"second", "completed", "failed", "p50_us", "p99_us", "max_us", "dropped"})
+	for _, s := range r.Series {
+		w.Write([]string{
+			strconv.Itoa(s.Second),
+			strconv.FormatInt(s.Completed, 10),
+			strconv.FormatInt(s.Failed, 10),
+			strconv.FormatInt(s.P50.Microseconds(), 10),
+			strconv.FormatInt(s.P99.Microseconds(), 10),
+			strconv.FormatInt(s.Max.Microseconds(), 10),
+			strconv.FormatInt(s.Dropped, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// ReadReport loads a report written by WriteJSON.
+func ReadReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &report, nil
+}
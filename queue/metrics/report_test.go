@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportCountsFailuresAndDrops(t *testing.T) {
+	start := time.Now()
+	r := NewRecorder(start)
+	r.Success(start.Add(100*time.Millisecond), time.Millisecond)
+	r.Failure(start.Add(200*time.Millisecond), "queue is full")
+	r.Failure(start.Add(1200*time.Millisecond), "queue is full")
+	r.Drop(start.Add(1300 * time.Millisecond))
+	r.Error("decode: EOF")
+
+	report := r.Report("run", start.Add(2*time.Second))
+	if report.Completed != 1 || report.Failed != 2 || report.Dropped != 1 {
+		t.Errorf("completed %d, failed %d, dropped %d", report.Completed, report.Failed, report.Dropped)
+	}
+	if report.Errors["queue is full"] != 2 || report.Errors["decode: EOF"] != 1 || len(report.Errors) != 2 {
+		t.Errorf("errors %v", report.Errors)
+	}
+	if len(report.Series) != 2 || report.Series[0].Failed != 1 || report.Series[1].Dropped != 1 {
+		t.Errorf("series %+v", report.Series)
+	}
+}
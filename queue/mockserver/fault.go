@@ -0,0 +1,202 @@
+package mockserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faults that can be injected into requests.
+const (
+	// FaultClose closes the connection instead of replying.
+	FaultClose = "close"
+	// FaultRefuse stops listening, so connections are refused. It applies
+	// to every connection whatever the error rate.
+	FaultRefuse = "refuse"
+	// FaultReset sends part of the reply, then resets the connection.
+	FaultReset = "reset"
+	// FaultPartial sends part of the reply, then closes the connection
+	// cleanly.
+	FaultPartial = "partial"
+	// FaultHang reads the request and never replies.
+	FaultHang = "hang"
+	// FaultTrickle sends the reply one byte per TrickleInterval, like a
+	// slowloris attacker in reverse.
+	FaultTrickle = "trickle"
+)
+
+var errServerClosed = errors.New("mock server closed")
+
+func validateFault(fault string, rate float64) error {
+	switch fault {
+	case FaultClose, FaultRefuse, FaultReset, FaultPartial, FaultHang, FaultTrickle:
+	default:
+		return fmt.Errorf("unknown fault %q", fault)
+	}
+	if rate < 0 || rate > 1 {
+		return errors.New("error rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// SetFault changes the fault injected into a fraction rate of the requests
+// received from now on. A rate of 0 turns faults off. Switching to or from
+// FaultRefuse closes or reopens the listener on the same address.
+func (s *Server) SetFault(fault string, rate float64) error {
+	if err := validateFault(fault, rate); err != nil {
+		return err
+	}
+
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.closed {
+		return errServerClosed
+	}
+
+	s.mutex.Lock()
+	s.fault = fault
+	s.errorRate = rate
+	s.mutex.Unlock()
+
+	switch {
+	case fault == FaultRefuse && s.listener != nil:
+		s.listener.Close()
+		s.listener = nil
+	case fault != FaultRefuse && s.listener == nil:
+		listener, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.listener = listener
+		s.wg.Add(1)
+		go s.acceptLoop(listener)
+	}
+	return nil
+}
+
+// hang waits, without replying, until the client or the server gives up on
+// the connection.
+func hang(reader *bufio.Reader) {
+	for {
+		if _, err := reader.ReadByte(); err != nil {
+			return
+		}
+	}
+}
+
+// truncate sends the first byte of the reply. Under FaultReset the
+// connection is then closed with an RST instead of a FIN.
+func truncate(conn net.Conn, fault string) {
+	conn.Write([]byte("O"))
+	if tcp, ok := conn.(*net.TCPConn); ok && fault == FaultReset {
+		tcp.SetLinger(0)
+	}
+}
+
+// StartControl serves the control protocol on addr until Close, and returns
+// the address it listens on. Each line is a command and gets one line back,
+// "OK", "ERR <reason>" or the stats as JSON:
+//
+//	fault <fault> [percent]                  percent defaults to 100
+//	fault none
+//	latency <distribution> <base> [jitter] [max]
+//	stats
+func (s *Server) StartControl(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	s.connMutex.Lock()
+	if s.closed || s.control != nil {
+		s.connMutex.Unlock()
+		listener.Close()
+		return "", errors.New("mock server closed or already controlled")
+	}
+	s.control = listener
+	s.wg.Add(1)
+	s.connMutex.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !s.track(conn) {
+				return
+			}
+			s.wg.Add(1)
+			go s.handleControl(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+func (s *Server) handleControl(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrack(conn)
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		reply := "OK"
+		if fields[0] == "stats" {
+			data, _ := json.Marshal(s.Stats())
+			reply = string(data)
+		} else if err := s.command(fields); err != nil {
+			reply = "ERR " + err.Error()
+		}
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) command(fields []string) error {
+	switch fields[0] {
+	case "fault":
+		if len(fields) < 2 {
+			return errors.New("usage: fault <fault> [percent]")
+		}
+		if fields[1] == "none" {
+			return s.SetFault(FaultClose, 0)
+		}
+		percent := 100.0
+		if len(fields) > 2 {
+			var err error
+			if percent, err = strconv.ParseFloat(fields[2], 64); err != nil {
+				return err
+			}
+		}
+		return s.SetFault(fields[1], percent/100)
+	case "latency":
+		if len(fields) < 3 {
+			return errors.New("usage: latency <distribution> <base> [jitter] [max]")
+		}
+		latency := Latency{Distribution: fields[1]}
+		durations := []*time.Duration{&latency.Base, &latency.Jitter, &latency.Max}
+		for i, field := range fields[2:] {
+			if i == len(durations) {
+				return errors.New("too many arguments")
+			}
+			d, err := time.ParseDuration(field)
+			if err != nil {
+				return err
+			}
+			*durations[i] = d
+		}
+		return s.SetLatency(latency)
+	}
+	return fmt.Errorf("unknown command %q", fields[0])
+}
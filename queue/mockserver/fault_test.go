@@ -0,0 +1,120 @@
+package mockserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"vu/benchmark/queue/tasks"
+)
+
+func slowAPIWithin(t *testing.T, addr string, timeout time.Duration) error {
+	t.Helper()
+	input, err := json.Marshal(tasks.SlowAPITaskInput{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err = tasks.SlowAPITask(ctx, input)
+	return err
+}
+
+func TestSlowAPITaskFailsOnEveryFault(t *testing.T) {
+	cases := []struct {
+		fault string
+		check func(error) bool
+	}{
+		{FaultClose, func(err error) bool { return err != nil }},
+		{FaultRefuse, func(err error) bool { return errors.Is(err, syscall.ECONNREFUSED) }},
+		{FaultReset, func(err error) bool { return errors.Is(err, syscall.ECONNRESET) }},
+		{FaultPartial, func(err error) bool { return err != nil }},
+		{FaultHang, func(err error) bool { return errors.Is(err, context.DeadlineExceeded) }},
+		{FaultTrickle, func(err error) bool { return errors.Is(err, context.DeadlineExceeded) }},
+	}
+	for _, c := range cases {
+		t.Run(c.fault, func(t *testing.T) {
+			s, err := Start(Config{Fault: c.fault, ErrorRate: 1, TrickleInterval: time.Second, LogDisabled: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if err := slowAPIWithin(t, s.Addr(), 200*time.Millisecond); !c.check(err) {
+				t.Errorf("SlowAPITask returned %v", err)
+			}
+		})
+	}
+}
+
+func TestTrickleEventuallyCompletes(t *testing.T) {
+	s, err := Start(Config{Fault: FaultTrickle, ErrorRate: 1, TrickleInterval: 20 * time.Millisecond, LogDisabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := slowAPIWithin(t, s.Addr(), time.Second); err != nil {
+		t.Errorf("patient client failed: %v", err)
+	}
+}
+
+func TestControlPort(t *testing.T) {
+	s, err := Start(Config{LogDisabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	controlAddr, err := s.StartControl("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	replies := bufio.NewScanner(conn)
+	send := func(command string) string {
+		fmt.Fprintln(conn, command)
+		if !replies.Scan() {
+			t.Fatalf("%s: no reply", command)
+		}
+		return replies.Text()
+	}
+
+	if reply := send("fault refuse"); reply != "OK" {
+		t.Fatalf("fault refuse: %s", reply)
+	}
+	if err := slowAPIWithin(t, s.Addr(), time.Second); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("while refusing: %v", err)
+	}
+
+	if reply := send("fault none"); reply != "OK" {
+		t.Fatalf("fault none: %s", reply)
+	}
+	if reply := send("latency fixed 1ms"); reply != "OK" {
+		t.Fatalf("latency: %s", reply)
+	}
+	if err := slowAPIWithin(t, s.Addr(), time.Second); err != nil {
+		t.Errorf("after recovering: %v", err)
+	}
+
+	if reply := send("fault bogus"); reply == "OK" {
+		t.Error("unknown fault accepted")
+	}
+
+	var stats Stats
+	if err := json.Unmarshal([]byte(send("stats")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Served != 1 {
+		t.Errorf("stats %+v, want 1 served", stats)
+	}
+}
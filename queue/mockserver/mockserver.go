@@ -0,0 +1,385 @@
+// Package mockserver is a TCP server that stands in for a slow remote API in
+// IO-bound benchmarks and tests. It reads one line per connection, waits for
+// a delay drawn from a latency distribution and replies "OK", unless a fault
+// is injected (see fault.go).
+package mockserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Latency distributions.
+const (
+	// Fixed always waits Base.
+	Fixed = "fixed"
+	// Uniform waits Base plus up to Jitter.
+	Uniform = "uniform"
+	// Normal waits Base with standard deviation Jitter.
+	Normal = "normal"
+	// LongTail waits Base plus a Pareto distributed delay of scale Jitter:
+	// mostly short, occasionally many times longer.
+	LongTail = "longtail"
+)
+
+// paretoShape makes LongTail heavy-tailed but with a finite mean
+// (Jitter / (paretoShape - 1) on top of Base).
+const paretoShape = 1.5
+
+// Latency describes how long the server takes to answer.
+type Latency struct {
+	Distribution string
+	Base         time.Duration
+	Jitter       time.Duration
+	// Max caps every delay when positive.
+	Max time.Duration
+}
+
+type Config struct {
+	// Addr defaults to an ephemeral loopback port; see Server.Addr.
+	Addr    string
+	Latency Latency
+	// Fault is how failing requests fail, FaultClose by default.
+	Fault string
+	// ErrorRate is the fraction of requests, between 0 and 1, that get
+	// Fault. It does not apply to FaultRefuse, which refuses everything.
+	ErrorRate float64
+	// TrickleInterval is the pause between bytes under FaultTrickle,
+	// 500ms by default.
+	TrickleInterval time.Duration
+	// MaxConns bounds the connections served at once. Further clients wait
+	// in the listen backlog, as they would for a saturated real server.
+	MaxConns    int
+	Seed        int64
+	LogDisabled bool
+}
+
+// Stats counts what the server did so far.
+type Stats struct {
+	Accepted int64 `json:"accepted"`
+	Served   int64 `json:"served"`
+	Failed   int64 `json:"failed"`
+	// Faults counts the requests a fault was injected into.
+	Faults int64 `json:"faults"`
+	// Active is the number of connections being served right now.
+	Active int64 `json:"active"`
+}
+
+type Server struct {
+	addr       string
+	logEnabled bool
+	slots      chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	// mutex guards the settings that can change while serving.
+	mutex     sync.Mutex
+	rand      *rand.Rand
+	latency   Latency
+	fault     string
+	errorRate float64
+	trickle   time.Duration
+
+	connMutex sync.Mutex
+	listener  net.Listener
+	control   net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+
+	accepted int64
+	served   int64
+	failed   int64
+	faults   int64
+	active   int64
+}
+
+// Start listens on cfg.Addr and serves until Close.
+func Start(cfg Config) (*Server, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:0"
+	}
+	if cfg.Latency.Distribution == "" {
+		cfg.Latency.Distribution = Fixed
+	}
+	if err := cfg.Latency.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Fault == "" {
+		cfg.Fault = FaultClose
+	}
+	if err := validateFault(cfg.Fault, cfg.ErrorRate); err != nil {
+		return nil, err
+	}
+	if cfg.TrickleInterval <= 0 {
+		cfg.TrickleInterval = 500 * time.Millisecond
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		addr:       listener.Addr().String(),
+		logEnabled: !cfg.LogDisabled,
+		done:       make(chan struct{}),
+		rand:       rand.New(rand.NewSource(cfg.Seed)),
+		latency:    cfg.Latency,
+		fault:      cfg.Fault,
+		errorRate:  cfg.ErrorRate,
+		trickle:    cfg.TrickleInterval,
+		conns:      make(map[net.Conn]struct{}),
+	}
+	if cfg.MaxConns > 0 {
+		s.slots = make(chan struct{}, cfg.MaxConns)
+	}
+	if s.logEnabled {
+		fmt.Printf("Mock TCP server listening on %s, latency=%s base=%v jitter=%v\n",
+			s.addr, cfg.Latency.Distribution, cfg.Latency.Base, cfg.Latency.Jitter)
+	}
+
+	if cfg.Fault == FaultRefuse {
+		// Keep the address but refuse connections from the start.
+		listener.Close()
+		return s, nil
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	go s.acceptLoop(listener)
+	return s, nil
+}
+
+// Addr is the address the server actually listens on.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// Close stops accepting, drops the open connections and waits for their
+// handlers to return.
+func (s *Server) Close() error {
+	s.connMutex.Lock()
+	if s.closed {
+		s.connMutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if s.control != nil {
+		s.control.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMutex.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) Stats() Stats {
+	return Stats{
+		Accepted: atomic.LoadInt64(&s.accepted),
+		Served:   atomic.LoadInt64(&s.served),
+		Failed:   atomic.LoadInt64(&s.failed),
+		Faults:   atomic.LoadInt64(&s.faults),
+		Active:   atomic.LoadInt64(&s.active),
+	}
+}
+
+// SetLatency changes the latency of the requests received from now on.
+func (s *Server) SetLatency(latency Latency) error {
+	if latency.Distribution == "" {
+		latency.Distribution = Fixed
+	}
+	if err := latency.validate(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.latency = latency
+	return nil
+}
+
+// track registers conn so Close can drop it. It returns false, having
+// closed conn, if the server is already closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.connMutex.Lock()
+	delete(s.conns, conn)
+	s.connMutex.Unlock()
+	conn.Close()
+}
+
+// acceptLoop serves listener until it is closed, by Close or by switching
+// to FaultRefuse.
+func (s *Server) acceptLoop(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		if s.slots != nil {
+			s.slots <- struct{}{}
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.slots != nil {
+				<-s.slots
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if s.logEnabled {
+				fmt.Println("accept error:", err)
+			}
+			continue
+		}
+
+		if !s.track(conn) {
+			if s.slots != nil {
+				<-s.slots
+			}
+			return
+		}
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.untrack(conn)
+		atomic.AddInt64(&s.active, -1)
+		if s.slots != nil {
+			<-s.slots
+		}
+	}()
+
+	count := atomic.AddInt64(&s.accepted, 1)
+	atomic.AddInt64(&s.active, 1)
+	if s.logEnabled {
+		fmt.Printf("Receive connection %d\n", count)
+	}
+
+	// Read the request to force real I/O.
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil {
+		atomic.AddInt64(&s.failed, 1)
+		return
+	}
+
+	delay, fault, trickle := s.draw()
+	if fault != "" {
+		atomic.AddInt64(&s.faults, 1)
+		atomic.AddInt64(&s.failed, 1)
+		if fault == FaultHang {
+			hang(reader)
+			return
+		}
+	}
+	if !s.sleep(delay) {
+		return
+	}
+
+	switch fault {
+	case FaultClose:
+		return
+	case FaultReset, FaultPartial:
+		truncate(conn, fault)
+		return
+	case FaultTrickle:
+		for _, b := range []byte("OK\n") {
+			if _, err := conn.Write([]byte{b}); err != nil || !s.sleep(trickle) {
+				return
+			}
+		}
+		return
+	}
+
+	if _, err := fmt.Fprintln(conn, "OK"); err != nil {
+		atomic.AddInt64(&s.failed, 1)
+		return
+	}
+	atomic.AddInt64(&s.served, 1)
+}
+
+// sleep waits for d, returning false if the server closes meanwhile.
+func (s *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// draw picks the delay of one request and the fault to inject into it, if
+// any.
+func (s *Server) draw() (delay time.Duration, fault string, trickle time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.fault != FaultRefuse && s.errorRate > 0 && s.rand.Float64() < s.errorRate {
+		fault = s.fault
+	}
+	return s.latency.sample(s.rand), fault, s.trickle
+}
+
+func (l Latency) validate() error {
+	switch l.Distribution {
+	case Fixed, Uniform, Normal, LongTail:
+		return nil
+	}
+	return fmt.Errorf("unknown latency distribution %q", l.Distribution)
+}
+
+func (l Latency) sample(r *rand.Rand) time.Duration {
+	var d time.Duration
+	switch l.Distribution {
+	case Uniform:
+		d = l.Base
+		if l.Jitter > 0 {
+			d += time.Duration(r.Int63n(int64(l.Jitter)))
+		}
+	case Normal:
+		d = l.Base + time.Duration(r.NormFloat64()*float64(l.Jitter))
+	case LongTail:
+		// Inverse transform of a Pareto distribution shifted to start at 0.
+		u := 1 - r.Float64()
+		d = l.Base + time.Duration(float64(l.Jitter)*(math.Pow(u, -1/paretoShape)-1))
+	default:
+		d = l.Base
+	}
+
+	d = max(d, 0)
+	if l.Max > 0 {
+		d = min(d, l.Max)
+	}
+	return d
+}
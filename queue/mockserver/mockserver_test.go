@@ -0,0 +1,99 @@
+package mockserver
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+	"vu/benchmark/queue/tasks"
+)
+
+func TestLatencyDistributions(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	const n = 10_000
+
+	cases := []struct {
+		latency  Latency
+		min, max time.Duration
+		meanLow  time.Duration
+		meanHigh time.Duration
+	}{
+		{Latency{Fixed, 5 * time.Millisecond, time.Second, 0}, 5 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond},
+		{Latency{Uniform, 10 * time.Millisecond, 10 * time.Millisecond, 0}, 10 * time.Millisecond, 20 * time.Millisecond, 14 * time.Millisecond, 16 * time.Millisecond},
+		{Latency{Normal, 10 * time.Millisecond, time.Millisecond, 0}, 0, time.Hour, 9900 * time.Microsecond, 10100 * time.Microsecond},
+		{Latency{LongTail, 0, time.Millisecond, 50 * time.Millisecond}, 0, 50 * time.Millisecond, time.Millisecond, 3 * time.Millisecond},
+	}
+	for _, c := range cases {
+		var sum time.Duration
+		for i := 0; i < n; i++ {
+			d := c.latency.sample(r)
+			if d < c.min || d > c.max {
+				t.Fatalf("%s: sample %v outside [%v, %v]", c.latency.Distribution, d, c.min, c.max)
+			}
+			sum += d
+		}
+		if mean := sum / n; mean < c.meanLow || mean > c.meanHigh {
+			t.Errorf("%s: mean %v outside [%v, %v]", c.latency.Distribution, mean, c.meanLow, c.meanHigh)
+		}
+	}
+}
+
+func slowAPI(t *testing.T, addr string) error {
+	t.Helper()
+	input, err := json.Marshal(tasks.SlowAPITaskInput{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tasks.SlowAPITask(context.Background(), input)
+	return err
+}
+
+func TestErrorInjection(t *testing.T) {
+	s, err := Start(Config{ErrorRate: 0.5, Seed: 1, LogDisabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if slowAPI(t, s.Addr()) != nil {
+			failed++
+		}
+	}
+	if failed < 60 || failed > 140 {
+		t.Errorf("%d of 200 calls failed, want about half", failed)
+	}
+	if stats := s.Stats(); stats.Failed != int64(failed) || stats.Served != int64(200-failed) {
+		t.Errorf("stats %+v, client saw %d failures", stats, failed)
+	}
+}
+
+func TestMaxConnsQueuesExtraClients(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	s, err := Start(Config{Latency: Latency{Base: delay}, MaxConns: 2, LogDisabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := slowAPI(t, s.Addr()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Six calls two at a time take three rounds.
+	if elapsed := time.Since(start); elapsed < 3*delay {
+		t.Errorf("6 calls with 2 connections took %v, want at least %v", elapsed, 3*delay)
+	}
+}
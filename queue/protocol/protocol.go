@@ -0,0 +1,122 @@
+// Package protocol is the wire protocol of server.Serve: JSON lines of
+// Request, each answered with one or more Response lines carrying the same
+// task id. Clients, cluster peers and remote workers all speak it.
+package protocol
+
+import (
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/tasks"
+)
+
+// Control operations a client can send instead of a task. A message without
+// an op is a task submission.
+const (
+	OpPause  = "pause"
+	OpResume = "resume"
+	OpStats  = "stats"
+	OpCancel = "cancel"
+	// OpWait re-attaches to a task submitted earlier, e.g. over a connection
+	// that was lost; it needs a queue implementing Waiter.
+	OpWait = "wait"
+	// OpUpdate tags the progress and partial results of a task submitted
+	// with Stream set. Its final result still comes without an op.
+	OpUpdate = "update"
+
+	// Operations used between cluster nodes. A node sends peer first on
+	// each connection, so it may steal. A forwarded task is acked as soon
+	// as it is queued; steal leases out a queued task for Visibility, which
+	// the peer extends while running it and reports back with complete, or
+	// hands back with release. Should the task be cancelled meanwhile, the
+	// server sends cancel for it, with the error of a cancelled task, and
+	// the peer stops it and reports it as usual.
+	OpPeer     = "peer"
+	OpForward  = "forward"
+	OpSteal    = "steal"
+	OpComplete = "complete"
+	OpRelease  = "release"
+
+	// Operations of remote workers. A worker registers once per connection,
+	// then pulls tasks, each pull answered with a task leased to it, and
+	// reports them with complete or release like a stealing peer, which
+	// includes being told to stop the tasks that get cancelled. Leases
+	// end with the connection, or once their Visibility runs out unless the
+	// worker extends them.
+	OpRegister = "register"
+	OpPull     = "pull"
+	OpExtend   = "extend"
+
+	// OpHeartbeat is answered right away. Clients send it to keep an idle
+	// connection open and to check that the server still answers.
+	OpHeartbeat = "heartbeat"
+
+	// Blob operations, see package blob. upload starts an upload when sent
+	// without one and appends Chunk at Offset; commit turns it into a blob;
+	// download reads up to Length bytes of a blob from Offset.
+	OpUpload   = "upload"
+	OpCommit   = "commit"
+	OpDownload = "download"
+)
+
+// Request is a line sent to the server.
+type Request struct {
+	Op string `json:"op,omitempty"`
+	// Client optionally names the client. Task ids are scoped to it instead
+	// of the connection, so a client can reconnect and still wait for its
+	// tasks.
+	Client string `json:"client,omitempty"`
+	// Stream asks for the task's updates as they happen, if the queue
+	// supports it.
+	Stream bool `json:"stream,omitempty"`
+	tasks.Task
+	// Result, Blob and Error carry the outcome of a stolen task on complete.
+	Result []byte `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Blob is also the blob to commit or download; Upload, Offset, Length
+	// and Chunk describe the other blob operations.
+	Blob   string `json:"blob,omitempty"`
+	Upload string `json:"upload,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Length int64  `json:"length,omitempty"`
+	Chunk  []byte `json:"chunk,omitempty"`
+	// Worker describes a remote worker on register.
+	Worker *WorkerInfo `json:"worker,omitempty"`
+	// Visibility is the lease period of a pull, steal or extend.
+	Visibility time.Duration `json:"visibility,omitempty"`
+}
+
+// Response is a line sent back by the server.
+type Response struct {
+	ID     string          `json:"id"`
+	Op     string          `json:"op,omitempty"`
+	Result []byte          `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Stats  *internal.Stats `json:"stats,omitempty"`
+	Task   *tasks.Task     `json:"task,omitempty"`
+	// Blob replaces Result when the result was stored as a blob. It is also
+	// the blob a commit created.
+	Blob string `json:"blob,omitempty"`
+	// Upload and Size answer blob operations: the upload's id and bytes so
+	// far, or the size of the blob.
+	Upload string `json:"upload,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	// Progress and Chunk carry a streamed update; Chunk also carries
+	// downloaded blob content.
+	Progress *tasks.Progress `json:"progress,omitempty"`
+	Chunk    []byte          `json:"chunk,omitempty"`
+	// Validation details an Error caused by a malformed task input.
+	Validation *tasks.ValidationError `json:"validation,omitempty"`
+	// Leader is where to reconnect when this node is not the leader of a
+	// replicated queue.
+	Leader string `json:"leader,omitempty"`
+}
+
+// WorkerInfo is what a remote worker advertises when it registers.
+type WorkerInfo struct {
+	Name string `json:"name"`
+	// Types are the task types the worker runs, all of them if empty.
+	Types []string `json:"types,omitempty"`
+	// Concurrency is how many tasks the worker runs at once. The server
+	// leases it no more than that.
+	Concurrency int `json:"concurrency"`
+}
@@ -0,0 +1,530 @@
+// Package raft implements the leader election and log replication parts of
+// the Raft consensus algorithm. The log is kept in memory: a node that is
+// stopped loses its state, but committed entries survive on the majority.
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader = errors.New("raft: not leader")
+	ErrStopped   = errors.New("raft: node stopped")
+	ErrTimeout   = errors.New("raft: proposal timed out")
+)
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return "unknown"
+	}
+}
+
+// Entry is a log entry. A leader appends an entry with nil Data when it is
+// elected, so it can commit entries from earlier terms.
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Data  []byte
+}
+
+// Config collects the tunables of a raft node.
+type Config struct {
+	ID string
+	// Peers are the IDs of the other members of the cluster.
+	Peers     []string
+	Transport Transport
+	// ElectionTimeout is the minimum time a follower waits for a leader
+	// before starting an election; the actual timeout is randomized up to
+	// twice as long.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// ProposeTimeout bounds how long Propose waits for an entry to commit.
+	ProposeTimeout time.Duration
+	// Apply is called for every committed entry, in log order, from a
+	// single goroutine. This includes the blank entry each new leader
+	// commits, which tells the state machine a leader took over.
+	Apply func(Entry)
+}
+
+type Node struct {
+	cfg Config
+
+	mutex       sync.Mutex
+	state       State
+	term        uint64
+	votedFor    string
+	leaderID    string
+	log         []Entry
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	deadline    time.Time
+	lastBeat    time.Time
+	// committed wakes the apply loop when commitIndex moves.
+	committed *sync.Cond
+	// proposals are resolved once the entry at their index is applied or
+	// overwritten.
+	proposals map[uint64]*proposal
+	stopped   bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type proposal struct {
+	term uint64
+	err  chan error
+}
+
+// NewNode creates a follower. Register it with the transport and call
+// Start to let it take part in elections.
+func NewNode(cfg Config) *Node {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 5
+	}
+	if cfg.ProposeTimeout <= 0 {
+		cfg.ProposeTimeout = 5 * cfg.ElectionTimeout
+	}
+
+	n := &Node{
+		cfg:       cfg,
+		log:       []Entry{{}}, // sentinel so that log[i].Index == i
+		proposals: make(map[uint64]*proposal),
+		done:      make(chan struct{}),
+	}
+	n.committed = sync.NewCond(&n.mutex)
+	return n
+}
+
+func (n *Node) Start() {
+	n.mutex.Lock()
+	n.resetDeadline()
+	n.mutex.Unlock()
+
+	n.wg.Add(2)
+	go n.tickLoop()
+	go n.applyLoop()
+}
+
+// Stop halts the node as if its process was killed.
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.done)
+	for index, p := range n.proposals {
+		p.err <- ErrStopped
+		delete(n.proposals, index)
+	}
+	n.committed.Broadcast()
+	n.mutex.Unlock()
+
+	n.wg.Wait()
+}
+
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Status reports the node's current state, term and the leader it knows of.
+func (n *Node) Status() (State, uint64, string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.state, n.term, n.leaderID
+}
+
+func (n *Node) IsLeader() bool {
+	state, _, _ := n.Status()
+	return state == Leader
+}
+
+// Propose appends data to the log and blocks until it is committed and
+// applied on this node.
+func (n *Node) Propose(data []byte) error {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return ErrStopped
+	}
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return ErrNotLeader
+	}
+
+	index := n.lastIndex() + 1
+	n.log = append(n.log, Entry{Term: n.term, Index: index, Data: data})
+	p := &proposal{term: n.term, err: make(chan error, 1)}
+	n.proposals[index] = p
+	n.mutex.Unlock()
+
+	n.broadcastAppend()
+
+	select {
+	case err := <-p.err:
+		return err
+	case <-time.After(n.cfg.ProposeTimeout):
+		n.mutex.Lock()
+		delete(n.proposals, index)
+		n.mutex.Unlock()
+		return ErrTimeout
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// resetDeadline picks a new randomized election deadline. The caller must
+// hold n.mutex.
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// stepDown moves to a newer term as follower. The caller must hold n.mutex.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leaderID = ""
+	}
+	n.state = Follower
+	n.resetDeadline()
+}
+
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.Lock()
+		now := time.Now()
+		switch {
+		case n.state == Leader && now.Sub(n.lastBeat) >= n.cfg.HeartbeatInterval:
+			n.mutex.Unlock()
+			n.broadcastAppend()
+		case n.state != Leader && now.After(n.deadline):
+			n.startElection()
+			n.mutex.Unlock()
+		default:
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// startElection becomes a candidate for the next term and asks every peer
+// for its vote. The caller must hold n.mutex.
+func (n *Node) startElection() {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leaderID = ""
+	n.resetDeadline()
+
+	term := n.term
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+
+	votes := 1
+	if votes > n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	for _, peer := range n.cfg.Peers {
+		go func(peer string) {
+			reply, err := n.cfg.Transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if reply.Term > n.term {
+				n.stepDown(reply.Term)
+				return
+			}
+			if n.state != Candidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+
+			votes++
+			if votes > n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// quorum is the number of votes beyond which a majority is reached.
+func (n *Node) quorum() int {
+	return (len(n.cfg.Peers) + 1) / 2
+}
+
+// becomeLeader takes over the cluster. The caller must hold n.mutex.
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leaderID = n.cfg.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+	}
+
+	// Commit a blank entry so entries from earlier terms get committed too.
+	n.log = append(n.log, Entry{Term: n.term, Index: n.lastIndex() + 1})
+	n.advanceCommit()
+	go n.broadcastAppend()
+}
+
+func (n *Node) broadcastAppend() {
+	n.mutex.Lock()
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return
+	}
+	n.lastBeat = time.Now()
+	n.mutex.Unlock()
+
+	for _, peer := range n.cfg.Peers {
+		go n.replicate(peer)
+	}
+}
+
+// replicate sends the entries peer is missing, or a heartbeat if none.
+func (n *Node) replicate(peer string) {
+	n.mutex.Lock()
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return
+	}
+
+	term := n.term
+	prevIndex := n.nextIndex[peer] - 1
+	if prevIndex > n.lastIndex() {
+		prevIndex = n.lastIndex()
+	}
+	entries := append([]Entry(nil), n.log[prevIndex+1:]...)
+	args := AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  n.log[prevIndex].Term,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mutex.Unlock()
+
+	reply, err := n.cfg.Transport.AppendEntries(peer, args)
+	if err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return
+	}
+	if n.state != Leader || n.term != term {
+		return
+	}
+
+	if reply.Success {
+		match := prevIndex + uint64(len(entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+		return
+	}
+
+	// Back up to where the follower's log diverges and retry.
+	n.nextIndex[peer] = max(reply.ConflictIndex, 1)
+	go n.replicate(peer)
+}
+
+// advanceCommit commits the highest entry of the current term stored on a
+// majority. The caller must hold n.mutex.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.log[index].Term != n.term {
+			break
+		}
+
+		count := 1
+		for _, peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count > n.quorum() {
+			n.commitIndex = index
+			n.committed.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	for {
+		n.mutex.Lock()
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.committed.Wait()
+		}
+		if n.stopped {
+			n.mutex.Unlock()
+			return
+		}
+
+		entries := append([]Entry(nil), n.log[n.lastApplied+1:n.commitIndex+1]...)
+		n.lastApplied = n.commitIndex
+		n.mutex.Unlock()
+
+		for _, entry := range entries {
+			if n.cfg.Apply != nil {
+				n.cfg.Apply(entry)
+			}
+
+			n.mutex.Lock()
+			if p, ok := n.proposals[entry.Index]; ok {
+				delete(n.proposals, entry.Index)
+				if p.term == entry.Term {
+					p.err <- nil
+				} else {
+					p.err <- ErrNotLeader
+				}
+			}
+			n.mutex.Unlock()
+		}
+	}
+}
+
+func (n *Node) HandleRequestVote(args RequestVoteArgs) (RequestVoteReply, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return RequestVoteReply{}, ErrStopped
+	}
+
+	if args.Term > n.term {
+		n.stepDown(args.Term)
+	}
+
+	upToDate := args.LastLogTerm > n.lastTerm() ||
+		(args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	granted := args.Term == n.term && upToDate &&
+		(n.votedFor == "" || n.votedFor == args.CandidateID)
+	if granted {
+		n.votedFor = args.CandidateID
+		n.resetDeadline()
+	}
+
+	return RequestVoteReply{Term: n.term, VoteGranted: granted}, nil
+}
+
+func (n *Node) HandleAppendEntries(args AppendEntriesArgs) (AppendEntriesReply, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return AppendEntriesReply{}, ErrStopped
+	}
+
+	if args.Term < n.term {
+		return AppendEntriesReply{Term: n.term}, nil
+	}
+	if args.Term > n.term || n.state != Follower {
+		n.stepDown(args.Term)
+	}
+	n.leaderID = args.LeaderID
+	n.resetDeadline()
+
+	if args.PrevLogIndex > n.lastIndex() {
+		return AppendEntriesReply{Term: n.term, ConflictIndex: n.lastIndex() + 1}, nil
+	}
+	if conflictTerm := n.log[args.PrevLogIndex].Term; conflictTerm != args.PrevLogTerm {
+		// Skip the whole conflicting term in one round trip.
+		index := args.PrevLogIndex
+		for index > 1 && n.log[index-1].Term == conflictTerm {
+			index--
+		}
+		return AppendEntriesReply{Term: n.term, ConflictIndex: index}, nil
+	}
+
+	for _, entry := range args.Entries {
+		if entry.Index <= n.lastIndex() {
+			if n.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			n.truncate(entry.Index)
+		}
+		n.log = append(n.log, entry)
+	}
+
+	if commit := min(args.LeaderCommit, args.PrevLogIndex+uint64(len(args.Entries))); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.committed.Broadcast()
+	}
+
+	return AppendEntriesReply{Term: n.term, Success: true}, nil
+}
+
+// truncate drops the log from index on, failing proposals that were lost
+// with it. The caller must hold n.mutex.
+func (n *Node) truncate(index uint64) {
+	n.log = n.log[:index]
+	for i, p := range n.proposals {
+		if i >= index {
+			p.err <- ErrNotLeader
+			delete(n.proposals, i)
+		}
+	}
+}
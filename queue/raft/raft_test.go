@@ -0,0 +1,271 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testElectionTimeout = 50 * time.Millisecond
+
+type testCluster struct {
+	t       *testing.T
+	network *Network
+	nodes   map[string]*Node
+	mutex   sync.Mutex
+	applied map[string][]string
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	t.Helper()
+
+	c := &testCluster{
+		t:       t,
+		network: NewNetwork(),
+		nodes:   make(map[string]*Node),
+		applied: make(map[string][]string),
+	}
+
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("n%d", i+1)
+	}
+	for _, id := range ids {
+		c.nodes[id] = NewNode(Config{
+			ID:              id,
+			Peers:           without(ids, id),
+			Transport:       c.network.Transport(id),
+			ElectionTimeout: testElectionTimeout,
+			Apply:           c.applier(id),
+		})
+		c.network.Register(id, c.nodes[id])
+	}
+	for _, node := range c.nodes {
+		node.Start()
+	}
+
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	return c
+}
+
+func without(ids []string, id string) []string {
+	var res []string
+	for _, other := range ids {
+		if other != id {
+			res = append(res, other)
+		}
+	}
+	return res
+}
+
+func (c *testCluster) applier(id string) func(Entry) {
+	return func(entry Entry) {
+		if entry.Data == nil {
+			return
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.applied[id] = append(c.applied[id], string(entry.Data))
+	}
+}
+
+func (c *testCluster) appliedOn(id string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.applied[id]...)
+}
+
+// leader waits for exactly one leader among ids and returns it.
+func (c *testCluster) leader(ids ...string) *Node {
+	c.t.Helper()
+
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+
+	deadline := time.Now().Add(40 * testElectionTimeout)
+	for time.Now().Before(deadline) {
+		leaders := make(map[uint64][]*Node)
+		for _, id := range ids {
+			state, term, _ := c.nodes[id].Status()
+			if state == Leader {
+				leaders[term] = append(leaders[term], c.nodes[id])
+			}
+		}
+
+		var newest uint64
+		for term, nodes := range leaders {
+			if len(nodes) > 1 {
+				c.t.Fatalf("term %d has %d leaders", term, len(nodes))
+			}
+			newest = max(newest, term)
+		}
+		if newest > 0 {
+			return leaders[newest][0]
+		}
+		time.Sleep(testElectionTimeout / 5)
+	}
+
+	c.t.Fatalf("no leader elected among %v", ids)
+	return nil
+}
+
+func (c *testCluster) waitApplied(id string, want []string) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(40 * testElectionTimeout)
+	for time.Now().Before(deadline) {
+		if fmt.Sprint(c.appliedOn(id)) == fmt.Sprint(want) {
+			return
+		}
+		time.Sleep(testElectionTimeout / 5)
+	}
+	c.t.Fatalf("%s applied %v, want %v", id, c.appliedOn(id), want)
+}
+
+func TestElectsOneLeader(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+
+	_, term, _ := leader.Status()
+	// Give the followers a few heartbeats to learn about the leader.
+	time.Sleep(2 * testElectionTimeout)
+	for id, node := range c.nodes {
+		_, nodeTerm, known := node.Status()
+		if nodeTerm != term || known != leader.ID() {
+			t.Fatalf("%s is at term %d following %q, want term %d following %s", id, nodeTerm, known, term, leader.ID())
+		}
+	}
+}
+
+func TestReplicatesToAllNodes(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+
+	for i := 0; i < 5; i++ {
+		if err := leader.Propose([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("propose %d: %v", i, err)
+		}
+	}
+	for id := range c.nodes {
+		c.waitApplied(id, []string{"0", "1", "2", "3", "4"})
+	}
+}
+
+func TestReelectsAfterLeaderIsLost(t *testing.T) {
+	c := newTestCluster(t, 3)
+	old := c.leader()
+	if err := old.Propose([]byte("before")); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+
+	c.network.Disconnect(old.ID())
+	old.Stop()
+
+	rest := without([]string{"n1", "n2", "n3"}, old.ID())
+	leader := c.leader(rest...)
+	if err := leader.Propose([]byte("after")); err != nil {
+		t.Fatalf("propose on new leader: %v", err)
+	}
+	for _, id := range rest {
+		c.waitApplied(id, []string{"before", "after"})
+	}
+}
+
+func TestMinorityCannotCommitAndConvergesAfterHeal(t *testing.T) {
+	c := newTestCluster(t, 5)
+	old := c.leader()
+
+	minority := []string{old.ID()}
+	majority := without([]string{"n1", "n2", "n3", "n4", "n5"}, old.ID())
+	minority = append(minority, majority[0])
+	majority = majority[1:]
+	c.network.Partition(minority, majority)
+
+	if err := old.Propose([]byte("lost")); err == nil {
+		t.Fatalf("minority leader committed an entry")
+	}
+
+	leader := c.leader(majority...)
+	if err := leader.Propose([]byte("kept")); err != nil {
+		t.Fatalf("propose on majority leader: %v", err)
+	}
+
+	c.network.Heal()
+	for id := range c.nodes {
+		c.waitApplied(id, []string{"kept"})
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	addrs := make(map[string]string)
+	for _, id := range ids {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		addrs[id] = ln.Addr().String()
+		ln.Close()
+	}
+
+	var mutex sync.Mutex
+	applied := make(map[string]int)
+	done := make(chan struct{})
+	var nodes []*Node
+	for _, id := range ids {
+		node := NewNode(Config{
+			ID:              id,
+			Peers:           without(ids, id),
+			Transport:       NewTCPTransport(addrs, testElectionTimeout),
+			ElectionTimeout: testElectionTimeout,
+			Apply: func(entry Entry) {
+				if entry.Data != nil {
+					mutex.Lock()
+					applied[id]++
+					mutex.Unlock()
+				}
+			},
+		})
+		nodes = append(nodes, node)
+		go ServeTCP(addrs[id], node, done)
+	}
+	for _, node := range nodes {
+		node.Start()
+	}
+	t.Cleanup(func() {
+		close(done)
+		for _, node := range nodes {
+			node.Stop()
+		}
+	})
+
+	deadline := time.Now().Add(40 * testElectionTimeout)
+	for {
+		var err error
+		for _, node := range nodes {
+			if node.IsLeader() {
+				err = node.Propose([]byte("x"))
+				break
+			}
+		}
+		mutex.Lock()
+		replicated := applied["n1"] > 0 && applied["n2"] > 0 && applied["n3"] > 0
+		mutex.Unlock()
+		if replicated {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry not replicated over TCP, last error: %v", err)
+		}
+		time.Sleep(testElectionTimeout / 5)
+	}
+}
@@ -0,0 +1,307 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+)
+
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is where the leader should resume replication after a
+	// rejected append.
+	ConflictIndex uint64
+}
+
+// Transport carries RPCs from a node to its peers.
+type Transport interface {
+	RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error)
+}
+
+// Handler receives the RPCs a transport delivers; *Node implements it.
+type Handler interface {
+	HandleRequestVote(args RequestVoteArgs) (RequestVoteReply, error)
+	HandleAppendEntries(args AppendEntriesArgs) (AppendEntriesReply, error)
+}
+
+var ErrUnreachable = errors.New("raft: peer unreachable")
+
+// Network is an in-process network for tests. Nodes are addressed by ID and
+// the network can be partitioned to simulate failures.
+type Network struct {
+	mutex    sync.Mutex
+	handlers map[string]Handler
+	// group assigns each node to a partition; nodes only reach nodes in the
+	// same group. Nodes without a group are in the default group 0.
+	group map[string]int
+	down  map[string]bool
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		handlers: make(map[string]Handler),
+		group:    make(map[string]int),
+		down:     make(map[string]bool),
+	}
+}
+
+func (n *Network) Register(id string, handler Handler) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.handlers[id] = handler
+}
+
+// Transport returns the transport node id sends its RPCs through.
+func (n *Network) Transport(id string) Transport {
+	return &memTransport{network: n, from: id}
+}
+
+// Partition splits the network into the given groups. Nodes that are not
+// listed end up in a group of their own.
+func (n *Network) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.group = make(map[string]int)
+	for id := range n.handlers {
+		n.group[id] = -1
+	}
+	for i, group := range groups {
+		for _, id := range group {
+			n.group[id] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.group = make(map[string]int)
+}
+
+// Disconnect cuts id off from every other node.
+func (n *Network) Disconnect(id string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.down[id] = true
+}
+
+func (n *Network) Reconnect(id string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.down, id)
+}
+
+func (n *Network) route(from string, to string) (Handler, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	handler, ok := n.handlers[to]
+	if !ok || n.down[from] || n.down[to] {
+		return nil, ErrUnreachable
+	}
+	if from != to && (n.group[from] == -1 || n.group[from] != n.group[to]) {
+		return nil, ErrUnreachable
+	}
+	return handler, nil
+}
+
+type memTransport struct {
+	network *Network
+	from    string
+}
+
+func (t *memTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	handler, err := t.network.route(t.from, peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return handler.HandleRequestVote(args)
+}
+
+func (t *memTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	handler, err := t.network.route(t.from, peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	// Replies are dropped too if the network was partitioned meanwhile.
+	reply, err := handler.HandleAppendEntries(args)
+	if _, routeErr := t.network.route(peer, t.from); routeErr != nil {
+		return AppendEntriesReply{}, routeErr
+	}
+	return reply, err
+}
+
+// TCPTransport sends RPCs as JSON-RPC over TCP. Peers are resolved through
+// a static map from node ID to address.
+type TCPTransport struct {
+	addrs   map[string]string
+	timeout time.Duration
+	mutex   sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func NewTCPTransport(addrs map[string]string, timeout time.Duration) *TCPTransport {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &TCPTransport{
+		addrs:   addrs,
+		timeout: timeout,
+		clients: make(map[string]*rpc.Client),
+	}
+}
+
+func (t *TCPTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := t.call(peer, "Raft.RequestVote", args, &reply)
+	return reply, err
+}
+
+func (t *TCPTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := t.call(peer, "Raft.AppendEntries", args, &reply)
+	return reply, err
+}
+
+func (t *TCPTransport) call(peer string, method string, args any, reply any) error {
+	client, err := t.client(peer)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if errors.Is(call.Error, rpc.ErrShutdown) {
+			t.drop(peer, client)
+		}
+		return call.Error
+	case <-time.After(t.timeout):
+		// The connection may be stuck on a dead peer; redial next time.
+		t.drop(peer, client)
+		return ErrUnreachable
+	}
+}
+
+func (t *TCPTransport) client(peer string) (*rpc.Client, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if client, ok := t.clients[peer]; ok {
+		return client, nil
+	}
+
+	addr, ok := t.addrs[peer]
+	if !ok {
+		return nil, fmt.Errorf("raft: unknown peer %q", peer)
+	}
+	conn, err := net.DialTimeout("tcp", addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client := jsonrpc.NewClient(conn)
+	t.clients[peer] = client
+	return client, nil
+}
+
+func (t *TCPTransport) drop(peer string, client *rpc.Client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.clients[peer] == client {
+		delete(t.clients, peer)
+	}
+	client.Close()
+}
+
+// rpcService adapts a Handler to net/rpc.
+type rpcService struct {
+	handler Handler
+}
+
+func (s *rpcService) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	r, err := s.handler.HandleRequestVote(args)
+	*reply = r
+	return err
+}
+
+func (s *rpcService) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	r, err := s.handler.HandleAppendEntries(args)
+	*reply = r
+	return err
+}
+
+// ServeTCP answers RPCs from peers on addr until done is closed.
+func ServeTCP(addr string, handler Handler, done <-chan struct{}) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcService{handler: handler}); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	var conns sync.Map
+	go func() {
+		<-done
+		listener.Close()
+		conns.Range(func(key, _ any) bool {
+			key.(net.Conn).Close()
+			return true
+		})
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		conns.Store(conn, struct{}{})
+		go func() {
+			server.ServeCodec(jsonrpc.NewServerCodec(conn))
+			conns.Delete(conn)
+		}()
+	}
+}
@@ -1,38 +1,82 @@
 package runner
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
+	"vu/benchmark/queue/client"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/metrics"
+	"vu/benchmark/queue/protocol"
 	"vu/benchmark/queue/tasks"
 )
 
 // ClientConfig collects options for pushing tasks into the queue server.
 type ClientConfig struct {
-	Addr        string
+	// Addrs are the servers to use; a connection moves on to the next
+	// when one does not answer.
+	Addrs       []string
 	Total       int
 	Concurrency int
 	Iterations  int
+	Output      OutputConfig
 }
 
+// OutputConfig says where to write the report of a benchmark run.
+type OutputConfig struct {
+	// Name labels the run in its report, e.g. a commit hash.
+	Name     string
+	JSONPath string
+	CSVPath  string
+}
+
+func (o OutputConfig) write(report *metrics.Report) error {
+	report.Print(os.Stdout)
+	if o.JSONPath != "" {
+		if err := report.WriteJSON(o.JSONPath); err != nil {
+			return err
+		}
+	}
+	if o.CSVPath != "" {
+		if err := report.WriteCSV(o.CSVPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunClient pushes cfg.Total hash tasks into the servers at cfg.Addrs from
+// cfg.Concurrency connections. A connection that breaks is dialed again,
+// moving on to the next server when one does not answer, and replicated
+// servers may point it at their leader.
 func RunClient(cfg ClientConfig) error {
+	if len(cfg.Addrs) == 0 {
+		return errors.New("no server address")
+	}
 	payload, err := json.Marshal(tasks.HashTaskInput{Iteration: cfg.Iterations})
 	if err != nil {
 		return err
 	}
 
+	// Task ids are scoped to the client name rather than the connection, so
+	// a task resubmitted after reconnecting is waited for, not run again.
+	name := clientName()
 	var sent int64
-	var completed int64
 
 	var wg sync.WaitGroup
 	errCh := make(chan error, 1)
 	var once sync.Once
 
 	start := time.Now()
+	recorder := metrics.NewRecorder(start)
 
 	for i := 0; i < cfg.Concurrency; i++ {
 		wg.Add(1)
@@ -40,19 +84,39 @@ func RunClient(cfg ClientConfig) error {
 			fmt.Printf("Starting goroutine %d\n", index+1)
 			defer wg.Done()
 
-			conn, err := net.Dial("tcp", cfg.Addr)
+			servers := &rotation{addrs: cfg.Addrs, next: index}
+			conn, addr, err := servers.dial("")
 			if err != nil {
 				recordError(errCh, &once, err)
 				return
 			}
-			defer conn.Close()
+			defer func() { conn.Close() }()
 
 			encoder := json.NewEncoder(conn)
 			decoder := json.NewDecoder(conn)
+			reconnect := func(to string) {
+				conn.Close()
+				next, nextAddr, err := servers.dial(to)
+				if err != nil {
+					fmt.Printf("Goroutine %d: reconnect failed %v\n", index+1, err)
+					time.Sleep(time.Second)
+					return
+				}
+				conn, addr = next, nextAddr
+				encoder = json.NewEncoder(conn)
+				decoder = json.NewDecoder(conn)
+			}
+
 			var lastTask int64
+			// taskStart is when the current task was first sent, so its
+			// latency includes retries.
+			var taskStart time.Time
+			op := ""
 			for {
 				if lastTask == 0 {
 					lastTask = atomic.AddInt64(&sent, 1)
+					taskStart = time.Now()
+					op = ""
 				}
 
 				if lastTask > int64(cfg.Total) {
@@ -61,75 +125,97 @@ func RunClient(cfg ClientConfig) error {
 
 				fmt.Printf("Goroutine %d runs tasks %d\n", index+1, int(lastTask))
 
-				task := tasks.Task{
-					Id:    strconv.FormatInt(lastTask, 10),
-					Type:  tasks.HashTaskType,
-					Input: payload,
+				req := protocol.Request{
+					Op:     op,
+					Client: name,
+					Task: tasks.Task{
+						Id:    strconv.FormatInt(lastTask, 10),
+						Type:  tasks.HashTaskType,
+						Input: payload,
+					},
+				}
+
+				if err := encoder.Encode(req); err != nil {
+					fmt.Printf("Goroutine %d: encode error %v — reconnecting\n", index+1, err)
+					recorder.Error("encode: " + err.Error())
+					reconnect(addr)
+					continue
 				}
 
-				// ---- NEW: retry loop per tasks ----
-				for retry := 0; retry < 5; retry++ {
-
-					if err := encoder.Encode(task); err != nil {
-						fmt.Printf("Goroutine %d: encode error %v — reconnecting\n", index+1, err)
-						conn.Close()
-
-						// reconnect
-						var err2 error
-						conn, err2 = net.Dial("tcp", cfg.Addr)
-						if err2 != nil {
-							fmt.Printf("Goroutine %d: reconnect failed %v\n", index+1, err2)
-							time.Sleep(time.Second)
-							continue
-						}
-						encoder = json.NewEncoder(conn)
-						decoder = json.NewDecoder(conn)
-						continue
-					}
-
-					var resp clientResponse
-					if err := decoder.Decode(&resp); err != nil {
-						fmt.Printf("Goroutine %d: decode error %v — reconnecting\n", index+1, err)
-						conn.Close()
-
-						// reconnect
-						var err2 error
-						conn, err2 = net.Dial("tcp", cfg.Addr)
-						if err2 != nil {
-							fmt.Printf("Goroutine %d: reconnect failed %v\n", index+1, err2)
-							time.Sleep(time.Second)
-							continue
-						}
-						encoder = json.NewEncoder(conn)
-						decoder = json.NewDecoder(conn)
-						continue
-					}
-
-					if resp.Error != "" {
-						fmt.Printf("Goroutine %d: server error %s — retry\n", index+1, resp.Error)
-						time.Sleep(200 * time.Millisecond)
-						continue
-					}
-
-					// success
-					atomic.AddInt64(&completed, 1)
+				var resp protocol.Response
+				if err := decoder.Decode(&resp); err != nil {
+					fmt.Printf("Goroutine %d: decode error %v — reconnecting\n", index+1, err)
+					recorder.Error("decode: " + err.Error())
+					reconnect(addr)
+					continue
+				}
+
+				switch {
+				case resp.Leader != "" && resp.Leader != addr:
+					fmt.Printf("Goroutine %d: %s — switching to leader %s\n", index+1, resp.Error, resp.Leader)
+					reconnect(resp.Leader)
+				case resp.Error == internal.ErrDuplicateID.Error() && op == "":
+					// Still queued from before we reconnected.
+					op = protocol.OpWait
+				case resp.Error == internal.ErrTaskNotFound.Error() && op == protocol.OpWait:
+					// It finished while we reconnected; its result is lost.
+					op = ""
+				case resp.Error != "":
+					fmt.Printf("Goroutine %d: server error %s — retry\n", index+1, resp.Error)
+					recorder.Error(resp.Error)
+					time.Sleep(200 * time.Millisecond)
+				default:
+					now := time.Now()
+					recorder.Success(now, now.Sub(taskStart))
 					lastTask = 0
-					break
 				}
 			}
 		}(i)
 	}
 	wg.Wait()
-	duration := time.Since(start)
+	end := time.Now()
+	duration := end.Sub(start)
 
 	select {
 	case err := <-errCh:
 		return fmt.Errorf("benchmark aborted after %v: %w", duration, err)
 	default:
-		tput := float64(completed) / duration.Seconds()
-		fmt.Printf("completed %d tasks in %v (throughput: %.2f tasks/sec)\n", completed, duration, tput)
-		return nil
+		return cfg.Output.write(recorder.Report(cfg.Output.Name, end))
+	}
+}
+
+// clientName names a run of RunClient on the servers.
+func clientName() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return "bench-" + hex.EncodeToString(buf)
+}
+
+// rotation dials the servers of a run in turn.
+type rotation struct {
+	addrs []string
+	next  int
+}
+
+// dial connects to addr, or if that does not answer, or is empty, to the
+// next of the servers that does. It returns the address it connected to.
+func (r *rotation) dial(addr string) (net.Conn, string, error) {
+	err := errors.New("no server answered")
+	if addr != "" {
+		var conn net.Conn
+		if conn, err = client.DialNet(addr, time.Second); err == nil {
+			return conn, addr, nil
+		}
 	}
+	for range r.addrs {
+		addr = r.addrs[r.next%len(r.addrs)]
+		r.next++
+		var conn net.Conn
+		if conn, err = client.DialNet(addr, time.Second); err == nil {
+			return conn, addr, nil
+		}
+	}
+	return nil, "", err
 }
 
 // RunClient dials the server and pushes hash tasks, returning an error if the run aborts early.
@@ -220,12 +306,6 @@ func RunClient(cfg ClientConfig) error {
 //	}
 //}
 
-type clientResponse struct {
-	ID     string `json:"id"`
-	Result []byte `json:"result"`
-	Error  string `json:"error"`
-}
-
 func recordError(ch chan<- error, once *sync.Once, err error) {
 	once.Do(func() {
 		ch <- err
@@ -0,0 +1,86 @@
+package runner
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/server"
+	"vu/benchmark/queue/tasks"
+)
+
+// serveListener serves a queue on ln until the test ends.
+func serveListener(t *testing.T, ln net.Listener) internal.IQueue {
+	t.Helper()
+	queue := internal.New(internal.Config{Capacity: 10, Workers: 2, LogDisabled: true})
+	done := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.ServeConfig(server.Config{Listeners: []server.Listener{{Listener: ln}}}, queue, done)
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-served
+		queue.Shutdown()
+	})
+	return queue
+}
+
+// waitForTasks waits for queue to have run n hash tasks.
+func waitForTasks(t *testing.T, queue internal.IQueue, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for queue.Stats().Types[tasks.HashTaskType].Tasks != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("server ran %d tasks, want %d", queue.Stats().Types[tasks.HashTaskType].Tasks, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunClientMovesOnToServerThatAnswers(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing answers there once closed.
+	down.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := serveListener(t, ln)
+
+	err = RunClient(ClientConfig{
+		Addrs:       []string{down.Addr().String(), ln.Addr().String()},
+		Total:       10,
+		Concurrency: 2,
+		Iterations:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForTasks(t, queue, 10)
+}
+
+func TestRunClientOverUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "queue.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := serveListener(t, ln)
+
+	err = RunClient(ClientConfig{
+		Addrs:       []string{"unix:" + socket},
+		Total:       10,
+		Concurrency: 2,
+		Iterations:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForTasks(t, queue, 10)
+}
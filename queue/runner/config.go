@@ -0,0 +1,374 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"vu/benchmark/queue/breaker"
+)
+
+// Log levels of a server: debug logs every task a worker picks up, info
+// only the server's own events.
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+)
+
+// ConfigFile is the layout of a JSON server configuration file, see
+// configs/server.json. Settings left out keep the defaults of the flags;
+// durations are written like "30s".
+type ConfigFile struct {
+	Server      ServerSection      `json:"server"`
+	Workers     WorkersSection     `json:"workers"`
+	Limits      LimitsSection      `json:"limits"`
+	Connections ConnectionsSection `json:"connections"`
+	Breaker     BreakerSection     `json:"breaker"`
+	Log         LogSection         `json:"log"`
+}
+
+// ServerSection holds where the server listens and what it runs with. It
+// only takes effect on restart.
+type ServerSection struct {
+	Addr                string            `json:"addr"`
+	UnixSocket          string            `json:"unixSocket"`
+	UnixSocketMode      string            `json:"unixSocketMode"`
+	Peers               []string          `json:"peers"`
+	RaftAddr            string            `json:"raftAddr"`
+	RaftPeers           map[string]string `json:"raftPeers"`
+	DebugAddr           string            `json:"debugAddr"`
+	TraceDir            string            `json:"traceDir"`
+	BlobDir             string            `json:"blobDir"`
+	ResultBlobThreshold int               `json:"resultBlobThreshold"`
+	UploadTimeout       string            `json:"uploadTimeout"`
+	BlobTTL             string            `json:"blobTTL"`
+	CPUAccounting       bool              `json:"cpuAccounting"`
+	PprofLabels         bool              `json:"pprofLabels"`
+}
+
+// WorkersSection sizes the worker pool, which changes on reload, and adds
+// the task types run by external processes, which need a restart.
+type WorkersSection struct {
+	Count    int              `json:"count"`
+	Handlers []HandlerSection `json:"handlers"`
+}
+
+type HandlerSection struct {
+	Type      string   `json:"type"`
+	Command   []string `json:"command"`
+	Procs     int      `json:"procs"`
+	Timeout   string   `json:"timeout"`
+	MaxMemory uint64   `json:"maxMemory"`
+	MaxCPU    string   `json:"maxCPU"`
+}
+
+// LimitsSection bounds the work the server takes. All but MaxConns change
+// on reload.
+type LimitsSection struct {
+	Capacity int `json:"capacity"`
+	// SubmitRate caps client submissions per second, in bursts of
+	// SubmitBurst; unlimited if zero.
+	SubmitRate  float64 `json:"submitRate"`
+	SubmitBurst int     `json:"submitBurst"`
+	MaxConns    int     `json:"maxConns"`
+}
+
+// ConnectionsSection manages client connections; it needs a restart.
+// Timeouts left empty or zero are off. KeepAlive is the period of the TCP
+// keepalive probes, 15s if empty or zero; a negative one like "-1s"
+// disables them.
+type ConnectionsSection struct {
+	IdleTimeout  string `json:"idleTimeout"`
+	ReadTimeout  string `json:"readTimeout"`
+	WriteTimeout string `json:"writeTimeout"`
+	KeepAlive    string `json:"keepAlive"`
+}
+
+// BreakerSection is the retry policy of the outbound calls of IO tasks:
+// after Failures in a row a backend is not called again for Cooldown, then
+// retried with Probes calls at once. Calls taking longer than Timeout count
+// as failed. Bulkhead caps the calls in flight per backend. Failures of zero
+// disables breakers and bulkheads. It changes on reload, resetting the
+// circuits.
+type BreakerSection struct {
+	Failures int    `json:"failures"`
+	Cooldown string `json:"cooldown"`
+	Probes   int    `json:"probes"`
+	Timeout  string `json:"timeout"`
+	Bulkhead int    `json:"bulkhead"`
+}
+
+// LogSection changes on reload.
+type LogSection struct {
+	Level string `json:"level"`
+}
+
+// DefaultConfigFile returns the settings of a file that sets nothing, the
+// same as the flags' defaults.
+func DefaultConfigFile() ConfigFile {
+	return ConfigFile{
+		Server: ServerSection{
+			Addr:                ":8080",
+			UnixSocketMode:      "0660",
+			TraceDir:            ".",
+			ResultBlobThreshold: 1 << 20,
+			UploadTimeout:       "10m",
+			BlobTTL:             "24h",
+		},
+		Workers: WorkersSection{Count: 8},
+		Limits:  LimitsSection{Capacity: 100},
+		Connections: ConnectionsSection{
+			IdleTimeout:  "5m",
+			ReadTimeout:  "30s",
+			WriteTimeout: "30s",
+			KeepAlive:    "15s",
+		},
+		Breaker: BreakerSection{Failures: 5, Cooldown: "5s", Probes: 1, Timeout: "10s"},
+		Log:     LogSection{Level: LogDebug},
+	}
+}
+
+// LoadServerConfig reads and validates a JSON configuration file. Every problem
+// found is reported, each naming its setting.
+func LoadServerConfig(path string) (ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+
+	file := DefaultConfigFile()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return ServerConfig{}, fmt.Errorf("config %s: %w", path, describeJSONError(data, err))
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return ServerConfig{}, fmt.Errorf("config %s: data after the configuration object", path)
+	}
+
+	cfg, err := file.ServerConfig()
+	if err != nil {
+		return ServerConfig{}, fmt.Errorf("config %s:\n%w", path, err)
+	}
+	cfg.ConfigPath = path
+	return cfg, nil
+}
+
+// describeJSONError adds the line and column to syntax and type errors.
+func describeJSONError(data []byte, err error) error {
+	var offset int64
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		offset = syntax.Offset
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			err = fmt.Errorf("%s: expected %s, got %s", typeErr.Field, jsonKind(typeErr.Type), typeErr.Value)
+		}
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	before := data[:min(int(offset), len(data))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// jsonKind names t the way the file writes it.
+func jsonKind(t reflect.Type) string {
+	switch {
+	case t.Kind() == reflect.Struct || t.Kind() == reflect.Map:
+		return "an object"
+	case t.Kind() == reflect.Slice:
+		return "a list"
+	case t.Kind() == reflect.String:
+		return "a string"
+	case t.Kind() == reflect.Bool:
+		return "true or false"
+	}
+	return "a number"
+}
+
+// ServerConfig validates the file and converts it to the configuration of
+// RunServer.
+func (f ConfigFile) ServerConfig() (ServerConfig, error) {
+	var problems []error
+	check := func(ok bool, setting, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf("%s: %s", setting, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	// signedDuration parses a setting written like "30s"; empty is zero.
+	signedDuration := func(setting, value string) time.Duration {
+		if value == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(value)
+		check(err == nil, setting, "%q is not a duration like \"30s\"", value)
+		return d
+	}
+	// duration is signedDuration for settings that cannot be negative.
+	duration := func(setting, value string) time.Duration {
+		d := signedDuration(setting, value)
+		check(d >= 0, setting, "must not be negative")
+		return d
+	}
+
+	s := f.Server
+	check(s.Addr != "" || s.UnixSocket != "", "server.addr", "no address to listen on, set it or server.unixSocket")
+	mode, err := strconv.ParseUint(s.UnixSocketMode, 8, 32)
+	check(err == nil && mode <= 0o777, "server.unixSocketMode", "%q is not an octal permission like \"0660\"", s.UnixSocketMode)
+	check(len(s.Peers) == 0 || s.RaftAddr == "", "server.peers", "cannot be combined with server.raftAddr")
+	check(len(s.RaftPeers) == 0 || s.RaftAddr != "", "server.raftPeers", "needs server.raftAddr")
+	for i, peer := range s.Peers {
+		check(peer != "", fmt.Sprintf("server.peers[%d]", i), "empty address")
+	}
+	for addr, raftAddr := range s.RaftPeers {
+		check(addr != "" && raftAddr != "", "server.raftPeers", "%q: %q is not an addr: raft-addr pair", addr, raftAddr)
+	}
+	check(s.ResultBlobThreshold > 0, "server.resultBlobThreshold", "must be positive")
+	uploadTimeout := duration("server.uploadTimeout", s.UploadTimeout)
+	blobTTL := duration("server.blobTTL", s.BlobTTL)
+
+	w := f.Workers
+	check(w.Count >= 0, "workers.count", "must not be negative")
+	var handlers []HandlerConfig
+	seen := make(map[string]bool)
+	for i, h := range w.Handlers {
+		setting := fmt.Sprintf("workers.handlers[%d]", i)
+		check(h.Type != "", setting+".type", "missing")
+		check(!seen[h.Type], setting+".type", "%q is handled twice", h.Type)
+		seen[h.Type] = true
+		check(len(h.Command) > 0 && h.Command[0] != "", setting+".command", "missing")
+		check(h.Procs >= 0, setting+".procs", "must not be negative")
+		handlers = append(handlers, HandlerConfig{
+			Type:      h.Type,
+			Command:   h.Command,
+			Procs:     h.Procs,
+			Timeout:   duration(setting+".timeout", h.Timeout),
+			MaxMemory: h.MaxMemory,
+			MaxCPU:    duration(setting+".maxCPU", h.MaxCPU),
+		})
+	}
+
+	l := f.Limits
+	check(l.Capacity > 0, "limits.capacity", "must be positive")
+	check(l.SubmitRate >= 0, "limits.submitRate", "must not be negative")
+	check(l.SubmitBurst >= 0, "limits.submitBurst", "must not be negative")
+	check(l.MaxConns >= 0, "limits.maxConns", "must not be negative")
+
+	c := f.Connections
+	idleTimeout := duration("connections.idleTimeout", c.IdleTimeout)
+	readTimeout := duration("connections.readTimeout", c.ReadTimeout)
+	writeTimeout := duration("connections.writeTimeout", c.WriteTimeout)
+	// A negative keepalive disables it, as with the flag.
+	keepAlive := signedDuration("connections.keepAlive", c.KeepAlive)
+
+	b := f.Breaker
+	check(b.Failures >= 0, "breaker.failures", "must not be negative")
+	cooldown := duration("breaker.cooldown", b.Cooldown)
+	check(b.Probes >= 0, "breaker.probes", "must not be negative")
+	callTimeout := duration("breaker.timeout", b.Timeout)
+	check(b.Bulkhead >= 0, "breaker.bulkhead", "must not be negative")
+	var breakerConfig *breaker.Config
+	if b.Failures > 0 {
+		breakerConfig = &breaker.Config{
+			Failures:      b.Failures,
+			Cooldown:      cooldown,
+			Probes:        b.Probes,
+			MaxConcurrent: b.Bulkhead,
+			Timeout:       callTimeout,
+		}
+	}
+
+	check(f.Log.Level == LogDebug || f.Log.Level == LogInfo, "log.level", "%q is not %s or %s", f.Log.Level, LogDebug, LogInfo)
+
+	if len(problems) > 0 {
+		return ServerConfig{}, errors.Join(problems...)
+	}
+	return ServerConfig{
+		Addr:                s.Addr,
+		Capacity:            l.Capacity,
+		Workers:             w.Count,
+		UnixSocket:          s.UnixSocket,
+		UnixSocketMode:      os.FileMode(mode),
+		Peers:               s.Peers,
+		RaftAddr:            s.RaftAddr,
+		RaftPeers:           s.RaftPeers,
+		CPUAccounting:       s.CPUAccounting,
+		ProfileLabels:       s.PprofLabels,
+		DebugAddr:           s.DebugAddr,
+		TraceDir:            s.TraceDir,
+		BlobDir:             s.BlobDir,
+		ResultBlobThreshold: s.ResultBlobThreshold,
+		UploadTimeout:       uploadTimeout,
+		BlobTTL:             blobTTL,
+		Handlers:            handlers,
+		Breaker:             breakerConfig,
+		MaxConns:            l.MaxConns,
+		IdleTimeout:         idleTimeout,
+		ReadTimeout:         readTimeout,
+		WriteTimeout:        writeTimeout,
+		KeepAlive:           keepAlive,
+		SubmitRate:          l.SubmitRate,
+		SubmitBurst:         l.SubmitBurst,
+		LogLevel:            f.Log.Level,
+	}, nil
+}
+
+// restartOnlyChanges names the settings that differ between cfg and next
+// but only take effect on restart.
+func restartOnlyChanges(cfg, next ServerConfig) []string {
+	var changed []string
+	differ := func(setting string, a, b any) {
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			changed = append(changed, setting)
+		}
+	}
+	differ("server.addr", cfg.Addr, next.Addr)
+	differ("server.unixSocket", cfg.UnixSocket, next.UnixSocket)
+	differ("server.unixSocketMode", cfg.UnixSocketMode, next.UnixSocketMode)
+	differ("server.peers", cfg.Peers, next.Peers)
+	differ("server.raftAddr", cfg.RaftAddr, next.RaftAddr)
+	differ("server.raftPeers", cfg.RaftPeers, next.RaftPeers)
+	differ("server.debugAddr", cfg.DebugAddr, next.DebugAddr)
+	differ("server.traceDir", cfg.TraceDir, next.TraceDir)
+	differ("server.blobDir", cfg.BlobDir, next.BlobDir)
+	differ("server.resultBlobThreshold", cfg.ResultBlobThreshold, next.ResultBlobThreshold)
+	differ("server.uploadTimeout", cfg.UploadTimeout, next.UploadTimeout)
+	differ("server.blobTTL", cfg.BlobTTL, next.BlobTTL)
+	differ("server.cpuAccounting", cfg.CPUAccounting, next.CPUAccounting)
+	differ("server.pprofLabels", cfg.ProfileLabels, next.ProfileLabels)
+	differ("workers.handlers", cfg.Handlers, next.Handlers)
+	differ("limits.maxConns", cfg.MaxConns, next.MaxConns)
+	differ("connections.idleTimeout", cfg.IdleTimeout, next.IdleTimeout)
+	differ("connections.readTimeout", cfg.ReadTimeout, next.ReadTimeout)
+	differ("connections.writeTimeout", cfg.WriteTimeout, next.WriteTimeout)
+	differ("connections.keepAlive", cfg.KeepAlive, next.KeepAlive)
+	return changed
+}
+
+// describeLimits summarizes the settings a reload applies.
+func describeLimits(cfg ServerConfig) string {
+	parts := []string{
+		fmt.Sprintf("%d workers", cfg.Workers),
+		fmt.Sprintf("capacity %d", cfg.Capacity),
+		"log level " + cfg.LogLevel,
+	}
+	if cfg.SubmitRate > 0 {
+		parts = append(parts, fmt.Sprintf("%g submits/s", cfg.SubmitRate))
+	}
+	if cfg.Breaker == nil {
+		parts = append(parts, "no breakers")
+	}
+	return strings.Join(parts, ", ")
+}
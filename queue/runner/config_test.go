@@ -0,0 +1,222 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/server"
+)
+
+// writeConfig writes a config file into a test directory and returns its
+// path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadServerConfigDefaults(t *testing.T) {
+	path := writeConfig(t, `{}`)
+	cfg, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := DefaultConfigFile().ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.ConfigPath = path
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("empty file loads as %+v, want the defaults %+v", cfg, want)
+	}
+}
+
+func TestLoadServerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "unknown field",
+			content: `{"limits": {"capcity": 10}}`,
+			want:    []string{`unknown field "capcity"`},
+		},
+		{
+			name:    "syntax error",
+			content: "{\n  \"workers\": {\"count\": 4,}\n}",
+			want:    []string{"line 2, column 27:", "invalid character '}'"},
+		},
+		{
+			name:    "wrong type",
+			content: "{\n  \"log\": {\"level\": \"info\"},\n  \"workers\": {\"count\": \"eight\"}\n}",
+			want:    []string{"line 3, column 31:", "workers.count: expected a number, got string"},
+		},
+		{
+			name:    "data after the object",
+			content: `{} {}`,
+			want:    []string{"data after the configuration object"},
+		},
+		{
+			name:    "bad duration",
+			content: `{"connections": {"idleTimeout": "5 minutes"}}`,
+			want:    []string{`connections.idleTimeout: "5 minutes" is not a duration like "30s"`},
+		},
+		{
+			name:    "negative duration",
+			content: `{"breaker": {"cooldown": "-5s"}}`,
+			want:    []string{"breaker.cooldown: must not be negative"},
+		},
+		{
+			name:    "bad socket mode",
+			content: `{"server": {"unixSocketMode": "rw-rw----"}}`,
+			want:    []string{`server.unixSocketMode: "rw-rw----" is not an octal permission like "0660"`},
+		},
+		{
+			name:    "bad log level",
+			content: `{"log": {"level": "loud"}}`,
+			want:    []string{`log.level: "loud" is not debug or info`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeConfig(t, test.content)
+			_, err := LoadServerConfig(path)
+			if err == nil {
+				t.Fatal("loaded without an error")
+			}
+			if !strings.HasPrefix(err.Error(), "config "+path+":") {
+				t.Errorf("error does not name the file: %v", err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadServerConfigReportsEveryProblem(t *testing.T) {
+	path := writeConfig(t, `{
+  "workers": {"count": -1},
+  "limits": {"capacity": 0},
+  "connections": {"readTimeout": "soon"},
+  "log": {"level": "loud"}
+}`)
+	_, err := LoadServerConfig(path)
+	if err == nil {
+		t.Fatal("loaded without an error")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	want := []string{
+		"config " + path + ":",
+		"workers.count: must not be negative",
+		"limits.capacity: must be positive",
+		`connections.readTimeout: "soon" is not a duration like "30s"`,
+		`log.level: "loud" is not debug or info`,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRestartOnlyChanges(t *testing.T) {
+	cfg, err := DefaultConfigFile().ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := cfg
+	next.Addr = ":9090"
+	next.MaxConns = 10
+	next.IdleTimeout = time.Minute
+	// Applied live, so not reported.
+	next.Workers = 2
+	next.Capacity = 5
+	next.SubmitRate = 100
+	next.LogLevel = LogInfo
+
+	changed := restartOnlyChanges(cfg, next)
+	want := []string{"server.addr", "limits.maxConns", "connections.idleTimeout"}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed %v, want %v", changed, want)
+	}
+	if changed := restartOnlyChanges(cfg, cfg); len(changed) != 0 {
+		t.Errorf("unchanged config reports %v", changed)
+	}
+}
+
+func TestReloadAppliesWorkersAndLimits(t *testing.T) {
+	path := writeConfig(t, `{"workers": {"count": 2}, "limits": {"capacity": 10}}`)
+	started, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := internal.New(internal.Config{Capacity: started.Capacity, Workers: started.Workers, LogDisabled: true})
+	defer queue.Shutdown()
+	limiter := server.NewLimiter(started.SubmitRate, started.SubmitBurst)
+
+	if err := os.WriteFile(path, []byte(`{
+  "workers": {"count": 4},
+  "limits": {"capacity": 20, "submitRate": 1, "submitBurst": 2, "maxConns": 5}
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	current := reload(started, started, queue, limiter)
+
+	if current.Workers != 4 || current.Capacity != 20 || current.MaxConns != 5 {
+		t.Errorf("reload returned %d workers, capacity %d, max conns %d", current.Workers, current.Capacity, current.MaxConns)
+	}
+	stats := queue.Stats()
+	if stats.Workers != 4 || stats.Capacity != 20 {
+		t.Errorf("queue has %d workers and capacity %d after reload, want 4 and 20", stats.Workers, stats.Capacity)
+	}
+	// The unlimited bucket becomes a full one of the new burst.
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("submission %d refused within the burst", i)
+		}
+	}
+	if limiter.Allow() {
+		t.Error("submission beyond the new burst allowed")
+	}
+
+	// A file that fails to load changes nothing.
+	if err := os.WriteFile(path, []byte(`{"workers": {"count": -1}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := reload(started, current, queue, limiter); !reflect.DeepEqual(reloaded, current) {
+		t.Errorf("failed reload changed the config to %+v", reloaded)
+	}
+	if stats := queue.Stats(); stats.Workers != 4 {
+		t.Errorf("failed reload changed the workers to %d", stats.Workers)
+	}
+}
+
+func TestLoadServerConfigKeepAlive(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{`""`, 0},
+		{`"30s"`, 30 * time.Second},
+		{`"-1s"`, -time.Second},
+	}
+	for _, test := range tests {
+		cfg, err := LoadServerConfig(writeConfig(t, `{"connections": {"keepAlive": `+test.value+`}}`))
+		if err != nil || cfg.KeepAlive != test.want {
+			t.Errorf("keepAlive %s: %v, %v, want %v", test.value, cfg.KeepAlive, err, test.want)
+		}
+	}
+	_, err := LoadServerConfig(writeConfig(t, `{"connections": {"keepAlive": "often"}}`))
+	if err == nil || !strings.Contains(err.Error(), `connections.keepAlive: "often" is not a duration`) {
+		t.Errorf("bad keepAlive: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/subproc"
+	"vu/benchmark/queue/tasks"
+)
+
+// HandlerConfig adds a task type run by a pool of external processes, see
+// package subproc.
+type HandlerConfig struct {
+	Type    string
+	Command []string
+	// Procs is the number of processes, and so of the type's tasks run at
+	// once.
+	Procs   int
+	Timeout time.Duration
+	// MaxMemory, in bytes, and MaxCPU limit every process; Linux only.
+	MaxMemory uint64
+	MaxCPU    time.Duration
+}
+
+// ParseHandlers parses comma-separated type=command pairs, the command's
+// arguments separated by spaces, applying the same limits to each.
+func ParseHandlers(spec string, procs int, timeout time.Duration, maxMemory uint64, maxCPU time.Duration) ([]HandlerConfig, error) {
+	var handlers []HandlerConfig
+	if spec == "" {
+		return nil, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		taskType, command, ok := strings.Cut(pair, "=")
+		if !ok || taskType == "" || len(strings.Fields(command)) == 0 {
+			return nil, fmt.Errorf("invalid handler %q (expected type=command)", pair)
+		}
+		handlers = append(handlers, HandlerConfig{
+			Type:      taskType,
+			Command:   strings.Fields(command),
+			Procs:     procs,
+			Timeout:   timeout,
+			MaxMemory: maxMemory,
+			MaxCPU:    maxCPU,
+		})
+	}
+	return handlers, nil
+}
+
+// startHandlers starts the process pools and registers their task types,
+// which accept any input. The returned function stops the pools.
+func startHandlers(handlers []HandlerConfig) (func(), error) {
+	var pools []*subproc.Pool
+	stop := func() {
+		for _, pool := range pools {
+			pool.Close()
+		}
+	}
+	for _, handler := range handlers {
+		if _, ok := tasks.SchemaFor(handler.Type); ok {
+			stop()
+			return nil, fmt.Errorf("handler for task type %q, which exists already", handler.Type)
+		}
+		pool, err := subproc.Start(subproc.Config{
+			Command:   handler.Command,
+			Size:      handler.Procs,
+			Timeout:   handler.Timeout,
+			MaxMemory: handler.MaxMemory,
+			MaxCPU:    handler.MaxCPU,
+		})
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("handler %s: %w", handler.Type, err)
+		}
+		pools = append(pools, pool)
+		internal.Register(handler.Type, tasks.TypeSchema{}, pool.Handle)
+		fmt.Printf("Task type %s runs in %d processes of %s\n", handler.Type, max(handler.Procs, 1), strings.Join(handler.Command, " "))
+	}
+	return stop, nil
+}
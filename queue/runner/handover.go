@@ -0,0 +1,135 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+)
+
+// handover moves the tasks queued in local to the restarted server at the
+// other end of conn and completes them with the outputs it reports, so the
+// clients waiting here still get them. It stops local's
+// workers from starting queued tasks and moves them until stop is closed,
+// then waits for the outputs of those it moved. Should the restarted
+// server go away, the tasks are put back and run here after all.
+func handover(local internal.IQueue, conn net.Conn, stop <-chan struct{}) {
+	defer conn.Close()
+	evicter, ok := local.(internal.Evicter)
+	if !ok {
+		return
+	}
+
+	local.Pause()
+	defer local.Resume()
+
+	var mutex sync.Mutex
+	claims := make(map[string]*internal.Claim)
+	// gone is set once the connection broke and claims must not be added.
+	gone := false
+	moved := 0
+	var pending sync.WaitGroup
+	// settle removes the claim of id and completes it with output, or puts
+	// it back if output is nil.
+	settle := func(id string, output *internal.Output) {
+		mutex.Lock()
+		claim, ok := claims[id]
+		delete(claims, id)
+		if ok && output != nil {
+			moved++
+		}
+		mutex.Unlock()
+		if !ok {
+			return
+		}
+		if output == nil {
+			claim.Release()
+		} else {
+			claim.Complete(*output)
+		}
+		pending.Done()
+	}
+
+	// rejected is signalled when the restarted server refuses a task, e.g.
+	// because its queue is full, to back off.
+	rejected := make(chan struct{}, 1)
+	broken := make(chan struct{})
+	go func() {
+		defer close(broken)
+		decoder := json.NewDecoder(conn)
+		for {
+			var resp protocol.Response
+			if err := decoder.Decode(&resp); err != nil {
+				break
+			}
+			switch {
+			case resp.Op == protocol.OpForward && resp.Error != "":
+				settle(resp.ID, nil)
+				select {
+				case rejected <- struct{}{}:
+				default:
+				}
+			case resp.Op == "" && resp.Error != "":
+				settle(resp.ID, &internal.Output{Err: errors.New(resp.Error)})
+			case resp.Op == "":
+				settle(resp.ID, &internal.Output{Res: resp.Result, Blob: resp.Blob})
+			}
+		}
+
+		// Put back whatever is still out, to run here.
+		mutex.Lock()
+		gone = true
+		ids := make([]string, 0, len(claims))
+		for id := range claims {
+			ids = append(ids, id)
+		}
+		mutex.Unlock()
+		for _, id := range ids {
+			settle(id, nil)
+		}
+	}()
+
+	encoder := json.NewEncoder(conn)
+	for {
+		claim, ok := evicter.Evict()
+		if !ok {
+			select {
+			case <-time.After(10 * time.Millisecond):
+				continue
+			case <-stop:
+			case <-broken:
+			}
+			break
+		}
+
+		task := claim.Task()
+		mutex.Lock()
+		if gone {
+			mutex.Unlock()
+			claim.Release()
+			break
+		}
+		claims[task.Id] = claim
+		pending.Add(1)
+		mutex.Unlock()
+		if err := encoder.Encode(protocol.Request{Op: protocol.OpForward, Client: "handover", Task: *task}); err != nil {
+			settle(task.Id, nil)
+			break
+		}
+
+		select {
+		case <-rejected:
+			time.Sleep(100 * time.Millisecond)
+		default:
+		}
+	}
+
+	pending.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	fmt.Printf("handed %d queued tasks over to the new process\n", moved)
+}
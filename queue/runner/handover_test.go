@@ -0,0 +1,147 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/server"
+	"vu/benchmark/queue/tasks"
+)
+
+// serveHandover serves queue on one end of a pipe, as a restarted server
+// serves the handover connection, and returns the other end. Closing the
+// returned channel stops the server.
+func serveHandover(t *testing.T, queue internal.IQueue) (net.Conn, chan struct{}) {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	done := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.ServeConfig(server.Config{Listeners: []server.Listener{{Listener: newConnListener(theirs)}}}, queue, done)
+	}()
+	t.Cleanup(func() {
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+		<-served
+		// Drain tasks left queued without workers.
+		queue.(internal.Tuner).SetWorkers(1)
+		queue.Shutdown()
+	})
+	return ours, done
+}
+
+// putSums queues n sum tasks on queue and returns their channels.
+func putSums(t *testing.T, queue internal.IQueue, n int) []<-chan internal.Output {
+	t.Helper()
+	var channels []<-chan internal.Output
+	for i := 0; i < n; i++ {
+		input, _ := json.Marshal(tasks.SumTaskInput{A: i, B: 1})
+		ch, err := queue.Put(&tasks.Task{Id: fmt.Sprint(i), Type: tasks.SumTaskType, Input: input})
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// checkOutputs checks that every waiter gets its sum exactly once.
+func checkOutputs(t *testing.T, channels []<-chan internal.Output) {
+	t.Helper()
+	for i, ch := range channels {
+		select {
+		case output := <-ch:
+			var res tasks.SumTaskOutput
+			if err := json.Unmarshal(output.Res, &res); err != nil || res.Res != i+1 {
+				t.Errorf("task %d: %s, %v", i, output.Res, output.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("task %d: no output", i)
+		}
+		if _, ok := <-ch; ok {
+			t.Errorf("task %d: second output", i)
+		}
+	}
+}
+
+func TestHandoverCompletesMovedTasks(t *testing.T) {
+	old := internal.New(internal.Config{Capacity: 20, Workers: 1, LogDisabled: true})
+	old.Pause()
+	channels := putSums(t, old, 20)
+
+	conn, _ := serveHandover(t, internal.New(internal.Config{Capacity: 20, Workers: 4, LogDisabled: true}))
+	stop := make(chan struct{})
+	handedOver := make(chan struct{})
+	go func() {
+		defer close(handedOver)
+		handover(old, conn, stop)
+	}()
+
+	checkOutputs(t, channels)
+	close(stop)
+	<-handedOver
+	if stats := old.Stats(); stats.Types[tasks.SumTaskType].Tasks != 0 {
+		t.Errorf("%d tasks ran on the old queue", stats.Types[tasks.SumTaskType].Tasks)
+	}
+}
+
+func TestHandoverBacksOffWhenRejected(t *testing.T) {
+	old := internal.New(internal.Config{Capacity: 10, Workers: 1, LogDisabled: true})
+	old.Pause()
+	channels := putSums(t, old, 10)
+
+	// The new queue takes one task at a time and refuses the rest, which
+	// go back to the old queue until it has room.
+	conn, _ := serveHandover(t, internal.New(internal.Config{Capacity: 1, Workers: 1, LogDisabled: true}))
+	stop := make(chan struct{})
+	handedOver := make(chan struct{})
+	go func() {
+		defer close(handedOver)
+		handover(old, conn, stop)
+	}()
+
+	checkOutputs(t, channels)
+	close(stop)
+	<-handedOver
+	if stats := old.Stats(); stats.Types[tasks.SumTaskType].Tasks != 0 || stats.Size != 0 {
+		t.Errorf("old queue ran %d tasks and holds %d", stats.Types[tasks.SumTaskType].Tasks, stats.Size)
+	}
+}
+
+func TestHandoverPutsTasksBackWhenConnectionBreaks(t *testing.T) {
+	old := internal.New(internal.Config{Capacity: 10, Workers: 1, LogDisabled: true})
+	old.Pause()
+	channels := putSums(t, old, 10)
+
+	// The new queue never runs them; it goes away with the tasks.
+	conn, done := serveHandover(t, internal.New(internal.Config{Capacity: 10, Workers: 0, LogDisabled: true}))
+	stop := make(chan struct{})
+	handedOver := make(chan struct{})
+	go func() {
+		defer close(handedOver)
+		handover(old, conn, stop)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for old.Stats().Running != 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tasks out, want 10", old.Stats().Running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	<-handedOver
+
+	// Resumed, the old queue runs them after all.
+	checkOutputs(t, channels)
+	if stats := old.Stats(); stats.Types[tasks.SumTaskType].Tasks != 10 {
+		t.Errorf("old queue ran %d tasks, want 10", stats.Types[tasks.SumTaskType].Tasks)
+	}
+}
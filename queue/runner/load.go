@@ -0,0 +1,155 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vu/benchmark/queue/client"
+	"vu/benchmark/queue/metrics"
+)
+
+// LoadConfig collects options for replaying a load profile against the
+// queue servers.
+type LoadConfig struct {
+	Addrs   []string
+	Profile *Profile
+	// DrainTimeout bounds how long to wait for outstanding tasks once the
+	// last stage is over.
+	DrainTimeout time.Duration
+	Output       OutputConfig
+}
+
+type stageCounters struct {
+	sent int64
+	// latency of the tasks sent during the stage, measured from when they
+	// were scheduled to be sent.
+	recorder *metrics.Recorder
+}
+
+// RunLoadFile reads the profile at path and replays it against addrs.
+func RunLoadFile(addrs []string, path string, output OutputConfig) error {
+	profile, err := LoadProfile(path)
+	if err != nil {
+		return err
+	}
+	return RunLoad(LoadConfig{Addrs: addrs, Profile: profile, Output: output})
+}
+
+// RunBench replays the profile at profilePath if one is given, or else
+// runs the fixed number of tasks of cfg with RunClient. Only cfg.Addrs and
+// cfg.Output apply to a profile.
+func RunBench(cfg ClientConfig, profilePath string) error {
+	if profilePath != "" {
+		return RunLoadFile(cfg.Addrs, profilePath, cfg.Output)
+	}
+	return RunClient(cfg)
+}
+
+// RunLoad replays cfg.Profile open-loop: tasks are sent on the profile's
+// schedule whether or not earlier ones have completed, and latency is
+// measured from the scheduled send time, so a slow server cannot slow the
+// load down and hide its own latency.
+func RunLoad(cfg LoadConfig) error {
+	profile := cfg.Profile
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = 30 * time.Second
+	}
+	maxInFlight := profile.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = 10_000
+	}
+
+	c, err := client.New(client.Config{
+		Addrs:              cfg.Addrs,
+		InitialConcurrency: maxInFlight,
+		MaxConcurrency:     maxInFlight,
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), profile.Duration()+cfg.DrainTimeout)
+	defer cancel()
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var inFlight int64
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	recorder := metrics.NewRecorder(start)
+	counters := make([]stageCounters, len(profile.Stages))
+	for i := range counters {
+		counters[i].recorder = metrics.NewRecorder(start)
+	}
+	var offset time.Duration
+	for {
+		rate, stage, ok := profile.rateAt(offset)
+		if !ok {
+			break
+		}
+		if rate <= 0 {
+			// Nothing to send; look again a little later.
+			offset += 10 * time.Millisecond
+			continue
+		}
+
+		intended := start.Add(offset)
+		offset += time.Duration(float64(time.Second) / rate)
+		if wait := time.Until(intended); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		counter := &counters[stage]
+		atomic.AddInt64(&counter.sent, 1)
+		if atomic.AddInt64(&inFlight, 1) > int64(maxInFlight) {
+			atomic.AddInt64(&inFlight, -1)
+			recorder.Drop(intended)
+			counter.recorder.Drop(intended)
+			continue
+		}
+
+		task := profile.pickTask(rng)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&inFlight, -1)
+
+			_, err := c.Submit(ctx, task)
+			now := time.Now()
+			for _, r := range []*metrics.Recorder{recorder, counter.recorder} {
+				if err != nil {
+					r.Failure(now, failureMessage(err))
+				} else {
+					r.Success(now, now.Sub(intended))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	end := time.Now()
+
+	for i, stage := range profile.Stages {
+		counter := &counters[i]
+		report := counter.recorder.Report(stage.Name, end)
+		l := report.Latency
+		fmt.Printf("stage %d %s (%s, %v): sent %d, completed %d, failed %d, dropped %d, p50 %v, p99 %v, max %v\n",
+			i+1, stage.Name, stage.Type, time.Duration(stage.Duration),
+			counter.sent, report.Completed, report.Failed, report.Dropped, l.P50, l.P99, l.Max)
+	}
+	return cfg.Output.write(recorder.Report(cfg.Output.Name, end))
+}
+
+// failureMessage is what the failures of a run are broken down by: the
+// server's message for the task, without the task id.
+func failureMessage(err error) string {
+	var taskErr *client.TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.Message
+	}
+	return err.Error()
+}
@@ -0,0 +1,20 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"vu/benchmark/queue/client"
+)
+
+func TestFailureMessageLeavesOutTaskID(t *testing.T) {
+	for _, id := range []string{"1", "2"} {
+		err := fmt.Errorf("submit: %w", &client.TaskError{ID: id, Message: "task cancelled"})
+		if message := failureMessage(err); message != "task cancelled" {
+			t.Errorf("task %s: %q", id, message)
+		}
+	}
+	if message := failureMessage(errors.New("no healthy server")); message != "no healthy server" {
+		t.Errorf("other error: %q", message)
+	}
+}
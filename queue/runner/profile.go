@@ -0,0 +1,186 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+	"vu/benchmark/queue/tasks"
+)
+
+// Stage types of a load profile.
+const (
+	StageConstant = "constant"
+	StageRamp     = "ramp"
+	StageStep     = "step"
+	StageSpike    = "spike"
+)
+
+// Duration is a time.Duration written as a string like "30s" in profiles.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Profile describes the shape of the traffic sent by RunLoad: a sequence of
+// stages, each with its own arrival rate, and the mix of task types sent.
+type Profile struct {
+	Stages []Stage   `json:"stages"`
+	Mix    []TaskMix `json:"mix"`
+	// MaxInFlight caps outstanding tasks; arrivals beyond it are counted as
+	// dropped rather than delaying the schedule.
+	MaxInFlight int `json:"maxInFlight"`
+}
+
+// Stage is one phase of a profile. Rates are in tasks per second.
+//
+//   - constant: Rate for the whole stage.
+//   - ramp: linear from From to To.
+//   - step: From to To in Steps equal increments.
+//   - spike: Rate, except SpikeRate during SpikeDuration starting at SpikeAt.
+type Stage struct {
+	Name          string   `json:"name"`
+	Type          string   `json:"type"`
+	Duration      Duration `json:"duration"`
+	Rate          float64  `json:"rate"`
+	From          float64  `json:"from"`
+	To            float64  `json:"to"`
+	Steps         int      `json:"steps"`
+	SpikeRate     float64  `json:"spikeRate"`
+	SpikeAt       Duration `json:"spikeAt"`
+	SpikeDuration Duration `json:"spikeDuration"`
+}
+
+// TaskMix is a task type and its share of the traffic.
+type TaskMix struct {
+	Type   string          `json:"type"`
+	Weight float64         `json:"weight"`
+	Input  json.RawMessage `json:"input"`
+}
+
+// LoadProfile reads and validates a JSON profile.
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile Profile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", path, err)
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", path, err)
+	}
+	return &profile, nil
+}
+
+func (p *Profile) Validate() error {
+	if len(p.Stages) == 0 {
+		return errors.New("no stages")
+	}
+	for i, stage := range p.Stages {
+		if stage.Duration <= 0 {
+			return fmt.Errorf("stage %d: duration must be positive", i)
+		}
+		switch stage.Type {
+		case StageConstant:
+		case StageRamp:
+		case StageStep:
+			if stage.Steps <= 0 {
+				return fmt.Errorf("stage %d: step needs steps > 0", i)
+			}
+		case StageSpike:
+			if stage.SpikeAt+stage.SpikeDuration > stage.Duration {
+				return fmt.Errorf("stage %d: spike ends after the stage", i)
+			}
+		default:
+			return fmt.Errorf("stage %d: unknown type %q", i, stage.Type)
+		}
+	}
+
+	if len(p.Mix) == 0 {
+		return errors.New("no task mix")
+	}
+	for i, mix := range p.Mix {
+		if mix.Type == "" || mix.Weight <= 0 {
+			return fmt.Errorf("mix %d: needs a type and a positive weight", i)
+		}
+	}
+	return nil
+}
+
+// Duration is the total length of the profile.
+func (p *Profile) Duration() time.Duration {
+	var total time.Duration
+	for _, stage := range p.Stages {
+		total += time.Duration(stage.Duration)
+	}
+	return total
+}
+
+// rateAt returns the arrival rate at elapsed time into the profile and the
+// index of the stage it falls in. ok is false past the last stage.
+func (p *Profile) rateAt(elapsed time.Duration) (rate float64, stage int, ok bool) {
+	for i, s := range p.Stages {
+		length := time.Duration(s.Duration)
+		if elapsed >= length {
+			elapsed -= length
+			continue
+		}
+
+		progress := float64(elapsed) / float64(length)
+		switch s.Type {
+		case StageConstant:
+			return s.Rate, i, true
+		case StageRamp:
+			return s.From + (s.To-s.From)*progress, i, true
+		case StageStep:
+			step := int(progress * float64(s.Steps))
+			if s.Steps > 1 {
+				return s.From + (s.To-s.From)*float64(step)/float64(s.Steps-1), i, true
+			}
+			return s.To, i, true
+		case StageSpike:
+			if elapsed >= time.Duration(s.SpikeAt) && elapsed < time.Duration(s.SpikeAt+s.SpikeDuration) {
+				return s.SpikeRate, i, true
+			}
+			return s.Rate, i, true
+		}
+	}
+	return 0, 0, false
+}
+
+// pickTask draws a task from the mix according to the weights.
+func (p *Profile) pickTask(rng *rand.Rand) tasks.Task {
+	var total float64
+	for _, mix := range p.Mix {
+		total += mix.Weight
+	}
+
+	r := rng.Float64() * total
+	for _, mix := range p.Mix {
+		if r < mix.Weight {
+			return tasks.Task{Type: mix.Type, Input: mix.Input}
+		}
+		r -= mix.Weight
+	}
+	last := p.Mix[len(p.Mix)-1]
+	return tasks.Task{Type: last.Type, Input: last.Input}
+}
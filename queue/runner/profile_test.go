@@ -0,0 +1,127 @@
+package runner
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func seconds(n float64) Duration {
+	return Duration(time.Duration(n * float64(time.Second)))
+}
+
+func TestProfileValidate(t *testing.T) {
+	mix := []TaskMix{{Type: "sum", Weight: 1}}
+	tests := []struct {
+		name    string
+		profile Profile
+		want    string
+	}{
+		{"valid", Profile{Stages: []Stage{{Type: StageConstant, Duration: seconds(1), Rate: 10}}, Mix: mix}, ""},
+		{"no stages", Profile{Mix: mix}, "no stages"},
+		{"zero duration", Profile{Stages: []Stage{{Type: StageConstant}}, Mix: mix}, "stage 0: duration must be positive"},
+		{"unknown type", Profile{Stages: []Stage{{Type: "wave", Duration: seconds(1)}}, Mix: mix}, `stage 0: unknown type "wave"`},
+		{"step without steps", Profile{Stages: []Stage{
+			{Type: StageConstant, Duration: seconds(1)},
+			{Type: StageStep, Duration: seconds(1), From: 1, To: 5},
+		}, Mix: mix}, "stage 1: step needs steps > 0"},
+		{"spike past the stage", Profile{Stages: []Stage{
+			{Type: StageSpike, Duration: seconds(10), SpikeAt: seconds(8), SpikeDuration: seconds(3)},
+		}, Mix: mix}, "stage 0: spike ends after the stage"},
+		{"spike at the end", Profile{Stages: []Stage{
+			{Type: StageSpike, Duration: seconds(10), SpikeAt: seconds(8), SpikeDuration: seconds(2)},
+		}, Mix: mix}, ""},
+		{"no mix", Profile{Stages: []Stage{{Type: StageRamp, Duration: seconds(1)}}}, "no task mix"},
+		{"mix without type", Profile{Stages: []Stage{{Type: StageRamp, Duration: seconds(1)}}, Mix: []TaskMix{{Weight: 1}}}, "mix 0: needs a type and a positive weight"},
+		{"mix without weight", Profile{Stages: []Stage{{Type: StageRamp, Duration: seconds(1)}}, Mix: []TaskMix{{Type: "sum"}}}, "mix 0: needs a type and a positive weight"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.profile.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("valid profile: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestProfileRateAt(t *testing.T) {
+	profile := Profile{Stages: []Stage{
+		{Type: StageConstant, Duration: seconds(10), Rate: 5},
+		{Type: StageRamp, Duration: seconds(10), From: 10, To: 30},
+		{Type: StageStep, Duration: seconds(10), From: 10, To: 40, Steps: 4},
+		{Type: StageStep, Duration: seconds(10), From: 10, To: 40, Steps: 1},
+		{Type: StageSpike, Duration: seconds(10), Rate: 5, SpikeRate: 100, SpikeAt: seconds(4), SpikeDuration: seconds(2)},
+	}}
+	tests := []struct {
+		elapsed float64
+		rate    float64
+		stage   int
+	}{
+		{0, 5, 0},
+		{9.9, 5, 0},
+		{10, 10, 1},
+		{15, 20, 1},
+		{17.5, 25, 1},
+		{20, 10, 2},
+		{22.4, 10, 2},
+		{22.5, 20, 2},
+		{27.5, 40, 2},
+		{29.9, 40, 2},
+		{30, 40, 3},
+		{35, 40, 3},
+		{40, 5, 4},
+		{43.9, 5, 4},
+		{44, 100, 4},
+		{45.9, 100, 4},
+		{46, 5, 4},
+	}
+	for _, test := range tests {
+		rate, stage, ok := profile.rateAt(time.Duration(test.elapsed * float64(time.Second)))
+		if !ok || stage != test.stage || math.Abs(rate-test.rate) > 1e-9 {
+			t.Errorf("at %vs: rate %v in stage %d (ok %v), want %v in stage %d", test.elapsed, rate, stage, ok, test.rate, test.stage)
+		}
+	}
+	if _, _, ok := profile.rateAt(profile.Duration()); ok {
+		t.Error("rate past the last stage")
+	}
+}
+
+func TestProfilePickTaskFollowsWeights(t *testing.T) {
+	tests := []struct {
+		name string
+		mix  []TaskMix
+		want map[string]float64
+	}{
+		{"single", []TaskMix{{Type: "a", Weight: 3}}, map[string]float64{"a": 1}},
+		{"even", []TaskMix{{Type: "a", Weight: 1}, {Type: "b", Weight: 1}}, map[string]float64{"a": 0.5, "b": 0.5}},
+		{"weighted", []TaskMix{{Type: "a", Weight: 7}, {Type: "b", Weight: 2}, {Type: "c", Weight: 1}}, map[string]float64{"a": 0.7, "b": 0.2, "c": 0.1}},
+	}
+	const draws = 100_000
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := Profile{Mix: test.mix}
+			rng := rand.New(rand.NewSource(1))
+			counts := make(map[string]int)
+			for i := 0; i < draws; i++ {
+				counts[profile.pickTask(rng).Type]++
+			}
+			for taskType, share := range test.want {
+				if got := float64(counts[taskType]) / draws; math.Abs(got-share) > 0.01 {
+					t.Errorf("%s: share %.3f, want %.3f", taskType, got, share)
+				}
+			}
+			if len(counts) != len(test.want) {
+				t.Errorf("drew types %v", counts)
+			}
+		})
+	}
+}
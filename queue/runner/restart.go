@@ -0,0 +1,51 @@
+package runner
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A restarted server finds the number of listeners it inherits, as files 3
+// and up, the file to report it serves on and the socket the queued tasks
+// are handed over on in its environment.
+const (
+	envListenFDs  = "QUEUE_LISTEN_FDS"
+	envReadyFD    = "QUEUE_READY_FD"
+	envHandoverFD = "QUEUE_HANDOVER_FD"
+)
+
+// restartTimeout bounds how long a restarted server may take to serve.
+const restartTimeout = 30 * time.Second
+
+// connListener is a listener accepting one connection it was given.
+type connListener struct {
+	conns  chan net.Conn
+	addr   net.Addr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conns: make(chan net.Conn, 1), addr: conn.LocalAddr(), closed: make(chan struct{})}
+	l.conns <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package runner
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Restarting hands listeners and a socket to the new process as inherited
+// files, which Windows does not support.
+
+func notifyRestart(c chan<- os.Signal) {}
+
+func inheritedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+func inheritedHandover() (net.Listener, error) {
+	return nil, nil
+}
+
+func signalReady() {}
+
+func restart(listeners []net.Listener) (net.Conn, error) {
+	return nil, errors.New("restart is not supported on windows")
+}
@@ -0,0 +1,172 @@
+//go:build !windows
+
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// notifyRestart relays the signals that restart the server, or reload its
+// config file, to c.
+func notifyRestart(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR2)
+}
+
+// inheritedListeners returns the listeners handed over by the server that
+// restarted into this process, nil if it was started otherwise.
+func inheritedListeners() ([]net.Listener, error) {
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil {
+		return nil, nil
+	}
+	os.Unsetenv(envListenFDs)
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		file := os.NewFile(uintptr(3+i), "listener-"+strconv.Itoa(i))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, fmt.Errorf("inherited listener %d: %w", i, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// inheritedHandover returns a listener accepting the connection the server
+// that restarted into this process hands its queued tasks over on, nil if
+// it was started otherwise. The connection is private to the two processes,
+// unlike the shared listeners, which the old process may still accept on.
+func inheritedHandover() (net.Listener, error) {
+	fd, err := strconv.Atoi(os.Getenv(envHandoverFD))
+	if err != nil {
+		return nil, nil
+	}
+	os.Unsetenv(envHandoverFD)
+
+	file := os.NewFile(uintptr(fd), "handover")
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("handover connection: %w", err)
+	}
+	return newConnListener(conn), nil
+}
+
+// signalReady tells the server that restarted into this process that it
+// can stop accepting connections.
+func signalReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+
+	file := os.NewFile(uintptr(fd), "ready")
+	file.Write([]byte{1})
+	file.Close()
+}
+
+// restart starts this server again in a new process with the same
+// arguments, handing it listeners, and waits until it is ready to serve.
+// The listeners keep accepting meanwhile; once restart returns, the new
+// process accepts on them too, and closing them here leaves them to it.
+// The returned connection leads to the new process, for the handover.
+func restart(listeners []net.Listener) (net.Conn, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener on %s cannot be handed over", listener.Addr())
+		}
+		file, err := filer.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+
+	handoverFDs, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(handoverFDs[0])
+	ours := os.NewFile(uintptr(handoverFDs[0]), "handover")
+	defer ours.Close()
+	theirs := os.NewFile(uintptr(handoverFDs[1]), "handover")
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter, theirs)
+	cmd.Env = append(os.Environ(),
+		envListenFDs+"="+strconv.Itoa(len(files)),
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+		envHandoverFD+"="+strconv.Itoa(4+len(files)),
+	)
+	err = cmd.Start()
+	readyWriter.Close()
+	theirs.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(restartTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new server process did not start: %w", err)
+	}
+	go cmd.Wait()
+
+	conn, err := net.FileConn(ours)
+	if err != nil {
+		// The new process serves anyway; the queued tasks run here.
+		fmt.Println("handover connection:", err)
+	}
+
+	for _, listener := range listeners {
+		if unix, ok := listener.(*net.UnixListener); ok {
+			// The socket file is the new process's now.
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	fmt.Printf("Restarted as process %d\n", cmd.Process.Pid)
+	return conn, nil
+}
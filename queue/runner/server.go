@@ -1,12 +1,24 @@
 package runner
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"reflect"
+	"sort"
 	"syscall"
+	"time"
+	"vu/benchmark/queue/blob"
+	"vu/benchmark/queue/breaker"
+	"vu/benchmark/queue/cluster"
+	"vu/benchmark/queue/diag"
+	"vu/benchmark/queue/ha"
 	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/raft"
 	"vu/benchmark/queue/server"
+	"vu/benchmark/queue/tasks"
 )
 
 // ServerConfig collects the tunables for running the queue server.
@@ -14,13 +26,166 @@ type ServerConfig struct {
 	Addr     string
 	Capacity int
 	Workers  int
+	// UnixSocket, if set, is a Unix socket to accept clients on too, with
+	// permissions UnixSocketMode.
+	UnixSocket     string
+	UnixSocketMode os.FileMode
+	// Peers are the addresses of other queue servers to share work with.
+	Peers []string
+	// RaftAddr enables replication with raft: the node answers its peers on
+	// RaftAddr and uses Addr as its id, which is also the leader address
+	// followers send clients to.
+	RaftAddr string
+	// RaftPeers maps the Addr of every other replica to its RaftAddr.
+	RaftPeers map[string]string
+	// CPUAccounting and ProfileLabels are passed to internal.Config.
+	CPUAccounting bool
+	ProfileLabels bool
+	// DebugAddr starts an HTTP listener with pprof, runtime stats and trace
+	// capture (see package diag) when set.
+	DebugAddr string
+	// TraceDir is where traces captured through DebugAddr are written.
+	TraceDir string
+	// BlobDir enables the blob store for large task inputs and results.
+	// Results above ResultBlobThreshold bytes are stored there. Uploads
+	// nothing was appended to for UploadTimeout are discarded, and blobs
+	// neither stored nor read for BlobTTL removed; never if zero.
+	BlobDir             string
+	ResultBlobThreshold int
+	UploadTimeout       time.Duration
+	BlobTTL             time.Duration
+	// Handlers add task types run by external processes.
+	Handlers []HandlerConfig
+	// Breaker, if set, puts the outbound calls of IO tasks behind circuit
+	// breakers and bulkheads per target.
+	Breaker *breaker.Config
+	// MaxConns, IdleTimeout, ReadTimeout, WriteTimeout and KeepAlive manage
+	// client connections, see server.Config.
+	MaxConns     int
+	IdleTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	KeepAlive    time.Duration
+	// SubmitRate caps client submissions per second, in bursts of
+	// SubmitBurst; unlimited if zero.
+	SubmitRate  float64
+	SubmitBurst int
+	// LogLevel is LogDebug, the default, or LogInfo.
+	LogLevel string
+	// ConfigPath is the file cfg was loaded from with LoadServerConfig. SIGHUP
+	// then reloads it instead of restarting.
+	ConfigPath string
 }
 
-// RunServer starts the TCP server and blocks until shutdown.
+// RunServer starts the TCP server and blocks until shutdown. On SIGUSR2 it
+// restarts without dropping connections or queued tasks: a new process
+// inherits the listeners, and this one stops accepting, hands its queued
+// tasks over and exits once the tasks it runs are done. SIGHUP reloads the
+// config file if the server has one, applying the workers, limits, breakers
+// and log level live, or restarts otherwise.
 func RunServer(cfg ServerConfig) error {
-	queue := internal.NewQueue(cfg.Capacity, cfg.Workers, false)
+	if len(cfg.Peers) > 0 && cfg.RaftAddr != "" {
+		return errors.New("peers and raft replication cannot be combined")
+	}
+	if cfg.LogLevel != "" && cfg.LogLevel != LogDebug && cfg.LogLevel != LogInfo {
+		return fmt.Errorf("log level %q is not %s or %s", cfg.LogLevel, LogDebug, LogInfo)
+	}
 
 	done := make(chan struct{})
+
+	var blobs *blob.Store
+	if cfg.BlobDir != "" {
+		var err error
+		if blobs, err = blob.NewStore(cfg.BlobDir); err != nil {
+			return err
+		}
+		go sweepBlobs(blobs, cfg.UploadTimeout, cfg.BlobTTL, done)
+	}
+
+	if cfg.Breaker != nil {
+		tasks.SetBreakers(breaker.NewSet(*cfg.Breaker))
+	}
+	stopHandlers, err := startHandlers(cfg.Handlers)
+	if err != nil {
+		return err
+	}
+	defer stopHandlers()
+
+	local := internal.New(internal.Config{
+		Capacity:            cfg.Capacity,
+		Workers:             cfg.Workers,
+		CPUAccounting:       cfg.CPUAccounting,
+		ProfileLabels:       cfg.ProfileLabels,
+		Blobs:               blobs,
+		ResultBlobThreshold: cfg.ResultBlobThreshold,
+		LogDisabled:         cfg.LogLevel == LogInfo,
+	})
+	limiter := server.NewLimiter(cfg.SubmitRate, cfg.SubmitBurst)
+	var queue internal.IQueue = local
+	switch {
+	case len(cfg.Peers) > 0:
+		queue = cluster.NewQueue(queue, cluster.Config{Peers: cfg.Peers})
+	case cfg.RaftAddr != "":
+		replicated := newReplicatedQueue(cfg, queue)
+		go func() {
+			if err := raft.ServeTCP(cfg.RaftAddr, replicated.Node(), done); err != nil {
+				fmt.Println("raft server error:", err)
+			}
+		}()
+		queue = replicated
+	}
+
+	listeners, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	if listeners == nil {
+		if listeners, err = openListeners(cfg); err != nil {
+			return err
+		}
+	}
+	var serverListeners []server.Listener
+	for _, listener := range listeners {
+		serverListeners = append(serverListeners, server.Listener{Listener: listener})
+		fmt.Printf("Queue server listening on %s:%s\n", listener.Addr().Network(), listener.Addr())
+	}
+	handoverListener, err := inheritedHandover()
+	if err != nil {
+		fmt.Println(err, "- the restarted server's queued tasks run there")
+	}
+	if handoverListener != nil {
+		serverListeners = append(serverListeners, server.Listener{Listener: handoverListener})
+	}
+
+	// The debug server is stopped while restarting, so the new process can
+	// listen on its address.
+	var stopDebug func()
+	startDebug := func() {
+		if cfg.DebugAddr == "" {
+			stopDebug = func() {}
+			return
+		}
+		debugDone := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			err := diag.Serve(diag.Config{
+				Addr:     cfg.DebugAddr,
+				TraceDir: cfg.TraceDir,
+				Stats:    func() any { return queue.Stats() },
+			}, debugDone)
+			if err != nil {
+				fmt.Println("debug server error:", err)
+			}
+		}()
+		stopDebug = func() {
+			close(debugDone)
+			<-stopped
+		}
+	}
+	startDebug()
+	defer func() { stopDebug() }()
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
@@ -30,13 +195,171 @@ func RunServer(cfg ServerConfig) error {
 		fmt.Println("signal received, shutting down")
 	}()
 
-	fmt.Printf("Queue server listening on %s\n", cfg.Addr)
-	err := server.Serve(cfg.Addr, queue, done)
+	// SIGUSR2, and SIGHUP without a config file, restart the server in a
+	// new process, which takes over the listeners and the queued tasks while
+	// this one drains.
+	drain := make(chan struct{})
+	stopHandover := make(chan struct{})
+	handoverDone := make(chan struct{})
+	restartSigs := make(chan os.Signal, 1)
+	notifyRestart(restartSigs)
+	defer signal.Stop(restartSigs)
+	go func() {
+		defer close(handoverDone)
+		current := cfg
+		for {
+			var sig os.Signal
+			select {
+			case sig = <-restartSigs:
+			case <-done:
+				return
+			}
+			if sig == syscall.SIGHUP && cfg.ConfigPath != "" {
+				current = reload(cfg, current, local, limiter)
+				continue
+			}
+			if cfg.RaftAddr != "" {
+				fmt.Println("restart is not supported with raft replication")
+				continue
+			}
+
+			fmt.Println("restarting")
+			stopDebug()
+			conn, err := restart(listeners)
+			if err != nil {
+				fmt.Println("restart failed:", err)
+				startDebug()
+				continue
+			}
+			close(drain)
+			if conn != nil {
+				handover(local, conn, stopHandover)
+			}
+			return
+		}
+	}()
+
+	signalReady()
+	err = server.ServeConfig(server.Config{
+		Listeners:    serverListeners,
+		Blobs:        blobs,
+		MaxConns:     cfg.MaxConns,
+		IdleTimeout:  cfg.IdleTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		KeepAlive:    cfg.KeepAlive,
+		Limiter:      limiter,
+		Drain:        drain,
+	}, queue, done)
 	if err != nil {
 		fmt.Println("server error:", err)
 	}
+	close(stopHandover)
+	select {
+	case <-drain:
+		<-handoverDone
+	default:
+	}
 
 	queue.Shutdown()
+	printAccounting(local.Stats())
 	fmt.Println("queue drained, server exiting")
 	return err
 }
+
+// reload reads the config file of started again and applies the settings
+// that can change live, returning the settings now in effect. Those that
+// need a restart are only reported. A file that fails to load changes
+// nothing.
+func reload(started, current ServerConfig, local internal.IQueue, limiter *server.Limiter) ServerConfig {
+	next, err := LoadServerConfig(started.ConfigPath)
+	if err != nil {
+		fmt.Println("reload failed, configuration unchanged:", err)
+		return current
+	}
+	for _, setting := range restartOnlyChanges(started, next) {
+		fmt.Printf("reload: %s changed, restart (SIGUSR2) to apply it\n", setting)
+	}
+
+	tuner := local.(internal.Tuner)
+	tuner.SetWorkers(next.Workers)
+	tuner.SetCapacity(next.Capacity)
+	tuner.SetLogDisabled(next.LogLevel == LogInfo)
+	limiter.SetLimit(next.SubmitRate, next.SubmitBurst)
+	// New breakers forget the state of the circuits, so only when changed.
+	if !reflect.DeepEqual(current.Breaker, next.Breaker) {
+		if next.Breaker != nil {
+			tasks.SetBreakers(breaker.NewSet(*next.Breaker))
+		} else {
+			tasks.SetBreakers(nil)
+		}
+	}
+	fmt.Printf("configuration reloaded: %s\n", describeLimits(next))
+	return next
+}
+
+// blobSweepInterval is how often sweepBlobs looks for abandoned uploads and
+// expired blobs.
+const blobSweepInterval = time.Minute
+
+// sweepBlobs sweeps blobs every blobSweepInterval until done is closed.
+func sweepBlobs(blobs *blob.Store, uploadTimeout, ttl time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(blobSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		uploads, removed, err := blobs.Sweep(uploadTimeout, ttl)
+		if err != nil {
+			fmt.Println("blob sweep error:", err)
+		}
+		if uploads > 0 || removed > 0 {
+			fmt.Printf("blob sweep: %d abandoned uploads and %d expired blobs removed\n", uploads, removed)
+		}
+	}
+}
+
+// openListeners listens on the addresses in cfg.
+func openListeners(cfg ServerConfig) ([]net.Listener, error) {
+	listen := server.Config{Addr: cfg.Addr, KeepAlive: cfg.KeepAlive}
+	if cfg.UnixSocket != "" {
+		listen.Listeners = []server.Listener{{Network: "unix", Addr: cfg.UnixSocket, Mode: cfg.UnixSocketMode}}
+	}
+	return listen.Listen()
+}
+
+// printAccounting prints where the workers spent their time, per task type.
+func printAccounting(stats internal.Stats) {
+	taskTypes := make([]string, 0, len(stats.Types))
+	for taskType := range stats.Types {
+		taskTypes = append(taskTypes, taskType)
+	}
+	sort.Strings(taskTypes)
+
+	for _, taskType := range taskTypes {
+		t := stats.Types[taskType]
+		n := time.Duration(t.Tasks)
+		fmt.Printf("%s: %d tasks (%d failed), mean wait %v, mean wall %v, mean cpu %v, max wall %v\n",
+			taskType, t.Tasks, t.Failed, t.QueueWait/n, t.Wall/n, t.CPU/n, t.MaxWall)
+	}
+}
+
+func newReplicatedQueue(cfg ServerConfig, local internal.IQueue) *ha.Queue {
+	addrs := map[string]string{cfg.Addr: cfg.RaftAddr}
+	var peers []string
+	for id, addr := range cfg.RaftPeers {
+		addrs[id] = addr
+		peers = append(peers, id)
+	}
+
+	return ha.NewQueue(local, ha.Config{
+		Raft: raft.Config{
+			ID:        cfg.Addr,
+			Peers:     peers,
+			Transport: raft.NewTCPTransport(addrs, 0),
+		},
+	})
+}
@@ -0,0 +1,72 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"vu/benchmark/queue/blob"
+	"vu/benchmark/queue/breaker"
+	"vu/benchmark/queue/tasks"
+	"vu/benchmark/queue/worker"
+)
+
+// WorkerConfig collects the tunables for running a remote worker.
+type WorkerConfig struct {
+	// Addr is the queue server to pull tasks from.
+	Addr        string
+	Name        string
+	Types       []string
+	Concurrency int
+	// Visibility is the lease period of pulled tasks.
+	Visibility time.Duration
+	// BlobDir is the server's blob directory, for tasks with blob inputs.
+	BlobDir             string
+	ResultBlobThreshold int
+	// Handlers add task types run by external processes; the server must
+	// know them too.
+	Handlers []HandlerConfig
+	// Breaker, if set, puts the outbound calls of IO tasks behind circuit
+	// breakers and bulkheads per target.
+	Breaker *breaker.Config
+}
+
+// RunWorker runs tasks for the server until interrupted.
+func RunWorker(cfg WorkerConfig) error {
+	var blobs *blob.Store
+	if cfg.BlobDir != "" {
+		var err error
+		if blobs, err = blob.NewStore(cfg.BlobDir); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Breaker != nil {
+		tasks.SetBreakers(breaker.NewSet(*cfg.Breaker))
+	}
+	stopHandlers, err := startHandlers(cfg.Handlers)
+	if err != nil {
+		return err
+	}
+	defer stopHandlers()
+
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		close(done)
+		fmt.Println("signal received, finishing running tasks")
+	}()
+
+	return worker.Run(worker.Config{
+		Addr:                cfg.Addr,
+		Name:                cfg.Name,
+		Types:               cfg.Types,
+		Concurrency:         cfg.Concurrency,
+		Visibility:          cfg.Visibility,
+		Blobs:               blobs,
+		ResultBlobThreshold: cfg.ResultBlobThreshold,
+	}, done)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// drainPoll is how often a draining connection checks whether its work is
+// done.
+const drainPoll = 50 * time.Millisecond
+
+var errDrained = errors.New("connection drained")
+
+// deadlineReader applies the idle and read timeouts of Config to a
+// connection. Waiting for a request, it gives up after the idle timeout
+// unless busy reports work in flight; once a request starts arriving, the
+// rest must follow within the read timeout. Once draining, it gives up as
+// soon as nothing is in flight.
+type deadlineReader struct {
+	conn net.Conn
+	idle time.Duration
+	read time.Duration
+	busy func() bool
+	// started is when the current request started arriving, zero while
+	// waiting for one.
+	started time.Time
+
+	// mutex orders setting the deadline against drain.
+	mutex    sync.Mutex
+	draining bool
+}
+
+// next starts waiting for another request.
+func (r *deadlineReader) next() {
+	r.started = time.Time{}
+}
+
+// drain makes the reader give up waiting for requests once nothing is in
+// flight.
+func (r *deadlineReader) drain() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.draining = true
+	// Wake a Read waiting with a later deadline.
+	r.conn.SetReadDeadline(time.Now())
+}
+
+// setDeadline sets the deadline of the next read and reports whether the
+// connection is draining.
+func (r *deadlineReader) setDeadline() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var deadline time.Time
+	switch {
+	case !r.started.IsZero():
+		if r.read > 0 {
+			deadline = r.started.Add(r.read)
+		}
+	case r.draining:
+		deadline = time.Now().Add(drainPoll)
+	case r.idle > 0:
+		deadline = time.Now().Add(r.idle)
+	}
+	r.conn.SetReadDeadline(deadline)
+	return r.draining
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	for {
+		draining := r.setDeadline()
+		n, err := r.conn.Read(p)
+		if n > 0 && r.started.IsZero() {
+			r.started = time.Now()
+		}
+		if n == 0 && isTimeout(err) && r.started.IsZero() {
+			switch {
+			case r.busy():
+				// Silent while its tasks run; not idle.
+				continue
+			case draining:
+				return 0, errDrained
+			}
+			r.mutex.Lock()
+			draining = r.draining
+			r.mutex.Unlock()
+			if draining {
+				// Woken by drain.
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
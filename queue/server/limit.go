@@ -0,0 +1,68 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter caps the rate clients submit tasks at with a token bucket: Burst
+// tasks at once, refilled at Rate per second. Its limits can change while
+// the server runs.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of rate tasks per second, in bursts of up to
+// burst tasks, at least one. A rate of zero lets every task through.
+func NewLimiter(rate float64, burst int) *Limiter {
+	l := &Limiter{}
+	l.SetLimit(rate, burst)
+	return l
+}
+
+// SetLimit changes the rate and burst. The tokens left are kept, up to the
+// new burst, so changing the limits allows no extra burst; a new or
+// previously unlimited bucket starts full.
+func (l *Limiter) SetLimit(rate float64, burst int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.refill(time.Now())
+	if l.rate <= 0 {
+		l.tokens = math.MaxFloat64
+	}
+	l.rate = rate
+	l.burst = max(burst, 1)
+	l.tokens = min(l.tokens, float64(l.burst))
+}
+
+// refill adds the tokens earned since the last call. The caller must hold
+// l.mutex.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	l.last = now
+}
+
+// Allow takes a token if one is left. A nil Limiter allows everything.
+func (l *Limiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
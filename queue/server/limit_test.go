@@ -0,0 +1,30 @@
+package server
+
+import "testing"
+
+func TestSetLimitKeepsTokens(t *testing.T) {
+	limiter := NewLimiter(0.001, 3)
+	allowed := func() int {
+		n := 0
+		for limiter.Allow() {
+			n++
+		}
+		return n
+	}
+	if n := allowed(); n != 3 {
+		t.Fatalf("allowed %d at first, want the burst of 3", n)
+	}
+
+	// A reload does not refill the bucket.
+	limiter.SetLimit(0.001, 5)
+	if n := allowed(); n != 0 {
+		t.Errorf("allowed %d after raising the burst", n)
+	}
+
+	// Nor does going through unlimited keep more than the new burst.
+	limiter.SetLimit(0, 5)
+	limiter.SetLimit(0.001, 2)
+	if n := allowed(); n != 2 {
+		t.Errorf("allowed %d after limiting again, want the burst of 2", n)
+	}
+}
@@ -1,40 +1,124 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
+	"vu/benchmark/queue/blob"
 	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
 	"vu/benchmark/queue/tasks"
 )
 
-type response struct {
-	ID     string `json:"id"`
-	Result []byte `json:"result,omitempty"`
-	Error  string `json:"error,omitempty"`
-}
+// maxChunk bounds the chunks of blob uploads and downloads.
+const maxChunk = 4 << 20
+
+// defaultMaxUploads is Config.MaxUploads if zero.
+const defaultMaxUploads = 4
+
+// defaultStealVisibility is the lease of a stolen task whose steal request
+// gives no Visibility.
+const defaultStealVisibility = 30 * time.Second
+
+var errNoBlobs = errors.New("blobs are not enabled on this server")
 
 var waitingGoroutines int64
 
+// connectionSeq numbers accepted connections so task ids can be scoped to
+// the connection that submitted them.
+var connectionSeq int64
+
+// Config collects the options of a server.
+type Config struct {
+	// Addr is the TCP address to listen on; Listeners adds more places.
+	Addr      string
+	Listeners []Listener
+	// Blobs enables the blob operations and tasks with an InputBlob. It
+	// should be the store the queue runs tasks with.
+	Blobs *blob.Store
+	// MaxUploads caps the blob uploads a connection has in progress at
+	// once, 4 if zero.
+	MaxUploads int
+	// MaxConns caps the open connections; more are refused with an error.
+	// No cap if zero.
+	MaxConns int
+	// IdleTimeout closes connections that sent nothing for this long while
+	// nothing of theirs is in flight: tasks awaiting their result, pulls or
+	// leases. Clients keep idle connections open with heartbeats. Never if
+	// zero.
+	IdleTimeout time.Duration
+	// ReadTimeout bounds reading a request once it started arriving, and
+	// WriteTimeout writing a response; clients slower than that are
+	// disconnected. Unbounded if zero.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// KeepAlive is the period of the TCP keepalive probes that find clients
+	// gone without closing their connection, 15s if zero. Negative disables
+	// them.
+	KeepAlive time.Duration
+	// Limiter, if set, caps the rate of submissions from clients; those
+	// over it fail with internal.ErrRateLimited. Tasks forwarded by peers
+	// are not limited.
+	Limiter *Limiter
+	// Drain, once closed, stops accepting connections and closes every
+	// connection as soon as nothing of its is in flight, for a graceful
+	// restart; ServeConfig returns when all are closed. Closing done
+	// instead closes them right away.
+	Drain <-chan struct{}
+}
+
+var errTooManyConns = errors.New("too many connections")
+
+// Listener is a place to accept connections on besides Config.Addr.
+type Listener struct {
+	// Network is "tcp" or "unix", the latter listening on a socket file at
+	// Addr with permissions Mode, 0o660 by default.
+	Network string
+	Addr    string
+	Mode    os.FileMode
+	// Listener, if set, is an already open listener to use instead, e.g.
+	// one a test opened on a free port.
+	Listener net.Listener
+}
+
 // Serve listens for TCP connections and forwards incoming tasks to the queue.
 func Serve(addr string, queue internal.IQueue, done <-chan struct{}) error {
-	listener, err := net.Listen("tcp", addr)
+	return ServeConfig(Config{Addr: addr}, queue, done)
+}
+
+// ServeConfig is Serve with the options in cfg. It accepts connections on
+// Addr, unless empty, and on every listener in cfg.Listeners, until done is
+// closed or one of them fails.
+func ServeConfig(cfg Config, queue internal.IQueue, done <-chan struct{}) error {
+	listeners, err := cfg.Listen()
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
 
 	var wg sync.WaitGroup
+	var active atomic.Int64
 
-	// Stop accepting new connections when shutdown is signaled.
+	// Stop accepting new connections when shutdown or draining is
+	// signaled, or on all listeners when one fails.
+	failed := make(chan struct{})
+	var failOnce sync.Once
 	go func() {
-		<-done
-		listener.Close()
+		select {
+		case <-done:
+		case <-cfg.Drain:
+		case <-failed:
+		}
+		for _, listener := range listeners {
+			listener.Close()
+		}
 	}()
 
 	go func() {
@@ -51,12 +135,94 @@ func Serve(addr string, queue internal.IQueue, done <-chan struct{}) error {
 		}
 	}()
 
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			err := accept(listener, cfg, queue, done, &wg, &active)
+			if err != nil {
+				failOnce.Do(func() { close(failed) })
+			}
+			errs <- err
+		}()
+	}
+	for range listeners {
+		if acceptErr := <-errs; acceptErr != nil && err == nil {
+			err = acceptErr
+		}
+	}
+	wg.Wait()
+	return err
+}
+
+// Listen opens the listeners of cfg: a TCP one on Addr, unless empty, and
+// those in cfg.Listeners. ServeConfig calls it; a server restarting without
+// dropping connections opens them ahead and passes them on.
+func (cfg Config) Listen() ([]net.Listener, error) {
+	all := cfg.Listeners
+	if cfg.Addr != "" {
+		all = append([]Listener{{Network: "tcp", Addr: cfg.Addr}}, all...)
+	}
+	if len(all) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+
+	var listeners []net.Listener
+	for _, l := range all {
+		listener, err := l.Open(cfg.KeepAlive)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Open returns l.Listener, or listens as l describes. TCP connections get
+// keepalive probes with period keepAlive, see Config.KeepAlive.
+func (l Listener) Open(keepAlive time.Duration) (net.Listener, error) {
+	if l.Listener != nil {
+		return l.Listener, nil
+	}
+
+	switch l.Network {
+	case "tcp", "":
+		listenConfig := net.ListenConfig{KeepAlive: keepAlive}
+		return listenConfig.Listen(context.Background(), "tcp", l.Addr)
+	case "unix":
+		// A socket file left by a server that did not shut down cleanly
+		// would make listening fail; one a running server answers on is
+		// left to it.
+		if info, err := os.Stat(l.Addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", l.Addr, time.Second); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s: another server is listening on it", l.Addr)
+			}
+			os.Remove(l.Addr)
+		}
+		mode := l.Mode
+		if mode == 0 {
+			mode = 0o660
+		}
+		return listenUnix(l.Addr, mode)
+	}
+	return nil, fmt.Errorf("unknown network %q", l.Network)
+}
+
+// accept serves the connections of listener until it is closed, returning
+// nil if that was for shutdown.
+func accept(listener net.Listener, cfg Config, queue internal.IQueue, done <-chan struct{}, wg *sync.WaitGroup, active *atomic.Int64) error {
+	defer listener.Close()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-done:
-				wg.Wait()
+				return nil
+			case <-cfg.Drain:
 				return nil
 			default:
 			}
@@ -65,93 +231,532 @@ func Serve(addr string, queue internal.IQueue, done <-chan struct{}) error {
 				fmt.Println("temporary accept error:", err)
 				continue
 			}
-
-			wg.Wait()
+			if errors.Is(err, net.ErrClosed) {
+				// Closed because another listener failed.
+				return nil
+			}
 			return err
 		}
 
+		if cfg.MaxConns > 0 && active.Load() >= int64(cfg.MaxConns) {
+			fmt.Printf("refusing connection from %s: %d connections open\n", conn.RemoteAddr(), cfg.MaxConns)
+			go refuse(conn, errTooManyConns)
+			continue
+		}
+
+		active.Add(1)
 		wg.Add(1)
 		go func(c net.Conn) {
 			idx := atomic.AddInt64(&waitingGoroutines, 1)
 			defer func() {
+				active.Add(-1)
 				wg.Done()
 				fmt.Printf("Goroutine %d exits\n", idx+1)
 				atomic.AddInt64(&waitingGoroutines, -1)
 			}()
 			fmt.Printf("Goroutine %d accpet connection\n", idx+1)
-			handleConnection(c, queue, done)
+			handleConnection(c, atomic.AddInt64(&connectionSeq, 1), queue, cfg, done)
 		}(conn)
 	}
 }
 
-func handleConnection(conn net.Conn, queue internal.IQueue, done <-chan struct{}) {
+// refuse answers a connection the server cannot take with err and closes
+// it.
+func refuse(conn net.Conn, err error) {
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	json.NewEncoder(conn).Encode(protocol.Response{Error: err.Error()})
+}
+
+// queueID scopes a client task id to its client, or to its connection if it
+// gave no name, so clients cannot collide with each other's ids. Names are
+// not checked: connections giving the same name share the tasks, to let a
+// client wait for its tasks again after reconnecting, so names should be
+// hard to guess. A connection only cancels the tasks it submitted or waits
+// for.
+func queueID(connID int64, req protocol.Request) string {
+	if req.Client != "" {
+		return req.Client + "/" + req.Id
+	}
+	return "#" + strconv.FormatInt(connID, 10) + "/" + req.Id
+}
+
+func handleConnection(conn net.Conn, connID int64, queue internal.IQueue, cfg Config, done <-chan struct{}) {
 	defer conn.Close()
+	blobs := cfg.Blobs
 
-	decoder := json.NewDecoder(conn)
+	// Tasks submitted over the connection whose result is yet to be sent,
+	// and their queue ids, which only this connection may cancel.
+	var waiting atomic.Int64
+	var submitted sync.Map
+	// Tasks claimed by a peer or leased to a remote worker over this
+	// connection; released back to the queue if it goes away before
+	// completing them, and cancelled by telling the holder to stop.
+	leases := newLeases()
+	reader := &deadlineReader{
+		conn: conn,
+		idle: cfg.IdleTimeout,
+		read: cfg.ReadTimeout,
+		busy: func() bool { return waiting.Load() > 0 || leases.busy() },
+	}
+	decoder := json.NewDecoder(reader)
 	encoder := json.NewEncoder(conn)
 
 	// Results coming back from workers
-	results := make(chan response, 16)
+	results := make(chan protocol.Response, 16)
+	// Closed when the reader stops, so late waiters never block or send on
+	// a connection nobody is writing to any more.
+	connDone := make(chan struct{})
+
+	// The remote worker on this connection, once registered. Its pulls
+	// stop waiting when the connection closes.
+	var worker *protocol.WorkerInfo
+	// peer is set once a cluster node introduced itself.
+	peer := false
+	pulls, stopPulls := context.WithCancel(context.Background())
+	defer func() {
+		stopPulls()
+		n := leases.releaseAll()
+		if worker != nil {
+			fmt.Printf("Worker %s disconnected, %d leased tasks requeued\n", worker.Name, n)
+		}
+	}()
 
-	// Writer goroutine
+	// Uploads begun over this connection and not committed yet; nobody
+	// else knows their ids, so they are discarded when it closes.
+	uploads := make(map[string]bool)
+	maxUploads := cfg.MaxUploads
+	if maxUploads <= 0 {
+		maxUploads = defaultMaxUploads
+	}
+	defer func() {
+		for id := range uploads {
+			blobs.Abort(id)
+		}
+	}()
+
+	// Writer goroutine. Once a write fails the connection is closed, which
+	// stops the reader, and responses are dropped until it does.
 	writeDone := make(chan struct{})
 	go func() {
 		defer close(writeDone)
-		for resp := range results {
-			encoder.Encode(resp)
+		broken := false
+		write := func(resp protocol.Response) {
+			if broken {
+				return
+			}
+			if cfg.WriteTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
+			}
+			if err := encoder.Encode(resp); err != nil {
+				if isTimeout(err) {
+					fmt.Printf("write timeout to %s, closing connection\n", conn.RemoteAddr())
+				}
+				broken = true
+				conn.Close()
+			}
+		}
+		for {
+			select {
+			case resp := <-results:
+				write(resp)
+			case <-connDone:
+				// Flush whatever is already buffered, e.g. a decode error.
+				for {
+					select {
+					case resp := <-results:
+						write(resp)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(connDone)
+		<-writeDone
+	}()
+
+	// reply sends a response from another goroutine, dropping it if the
+	// connection or the server is going away.
+	reply := func(resp protocol.Response) {
+		select {
+		case results <- resp:
+		case <-connDone:
+		case <-done:
+		}
+	}
+	leases.cancelled = func(id string) {
+		reply(protocol.Response{ID: id, Op: protocol.OpCancel, Error: internal.ErrCancelled.Error()})
+	}
+
+	// Unblock the decoder on shutdown; peers keep their connections open
+	// for good, so waiting for them to hang up would never finish.
+	go func() {
+		select {
+		case <-done:
+			conn.Close()
+		case <-connDone:
+		}
+	}()
+
+	// Draining, stop the pulls of a remote worker, so it reconnects to the
+	// restarted server once its leased tasks are done.
+	go func() {
+		select {
+		case <-cfg.Drain:
+			stopPulls()
+			reader.drain()
+		case <-connDone:
 		}
 	}()
 
 	for {
-		var task tasks.Task
+		var req protocol.Request
 
 		// Detect shutdown
 		select {
 		case <-done:
-			// Tell writer goroutine to exit
-			close(results)
-			<-writeDone
 			return
 		default:
 		}
 
 		// Read next tasks
-		if err := decoder.Decode(&task); err != nil {
+		reader.next()
+		if err := decoder.Decode(&req); err != nil {
 			if errors.Is(err, io.EOF) {
 				// client closed connection normally
-				close(results)
-				<-writeDone
+				return
+			}
+			select {
+			case <-done:
+				// The connection was closed for shutdown.
+				return
+			default:
+			}
+			if errors.Is(err, errDrained) {
+				return
+			}
+			if isTimeout(err) && reader.started.IsZero() {
+				fmt.Printf("closing connection from %s, idle for %v\n", conn.RemoteAddr(), cfg.IdleTimeout)
 				return
 			}
 			fmt.Printf("decode error from %s: %v\n", conn.RemoteAddr(), err)
 
 			// send error to client before closing
-			results <- response{Error: err.Error()}
-			close(results)
-			<-writeDone
+			results <- protocol.Response{Error: err.Error()}
 			return
 		}
 
-		ch, err := queue.Put(&task)
+		switch req.Op {
+		case "", protocol.OpForward, protocol.OpWait:
+		case protocol.OpHeartbeat:
+			results <- protocol.Response{ID: req.Id, Op: req.Op}
+			continue
+		case protocol.OpPeer:
+			peer = true
+			results <- protocol.Response{ID: req.Id, Op: req.Op}
+			continue
+		case protocol.OpSteal:
+			if !peer {
+				results <- protocol.Response{ID: req.Id, Op: req.Op, Error: "steal is only for peers"}
+				continue
+			}
+			results <- handleSteal(req, queue, leases)
+			continue
+		case protocol.OpComplete, protocol.OpRelease:
+			if !peer && worker == nil {
+				results <- protocol.Response{ID: req.Id, Op: req.Op, Error: req.Op + " is only for peers and workers"}
+				continue
+			}
+			results <- handleComplete(req, leases)
+			continue
+		case protocol.OpRegister:
+			results <- handleRegister(req, &worker)
+			continue
+		case protocol.OpPull:
+			handlePull(pulls, req, queue, worker, leases, reply)
+			continue
+		case protocol.OpExtend:
+			results <- handleExtend(req, leases)
+			continue
+		case protocol.OpUpload, protocol.OpCommit, protocol.OpDownload:
+			results <- handleBlob(req, blobs, uploads, maxUploads)
+			continue
+		default:
+			results <- handleControl(req, connID, queue, &submitted)
+			continue
+		}
+
+		var emitter tasks.Emitter
+		if req.Stream && req.Op == "" {
+			id := req.Id
+			emitter = tasks.EmitterFunc(func(update tasks.Update) {
+				// Blocking here slows the handler down to the client's pace.
+				select {
+				case results <- protocol.Response{ID: id, Op: protocol.OpUpdate, Progress: update.Progress, Chunk: update.Chunk}:
+				case <-connDone:
+				case <-done:
+				}
+			})
+		}
+
+		if req.Op == "" && !cfg.Limiter.Allow() {
+			results <- errorResponse(req, internal.ErrRateLimited)
+			continue
+		}
+		ch, err := submit(req, connID, queue, blobs, emitter)
 		if err != nil {
-			results <- response{ID: task.Id, Error: err.Error()}
+			results <- errorResponse(req, err)
 			continue
 		}
+		if req.Op == protocol.OpForward {
+			// Forwarding peers wait for this ack before giving up on the task.
+			results <- protocol.Response{ID: req.Id, Op: req.Op}
+		}
 
 		// Spawn worker response waiters
+		waiting.Add(1)
+		queueID := queueID(connID, req)
+		submitted.Store(queueID, true)
 		go func(id string, workerCh <-chan internal.Output) {
+			defer waiting.Add(-1)
 			output := <-workerCh
-			resp := response{ID: id, Result: output.Res}
+			submitted.Delete(queueID)
+			resp := protocol.Response{ID: id, Result: output.Res, Blob: output.Blob}
 			if output.Err != nil {
 				resp.Error = output.Err.Error()
-				resp.Result = nil
+				resp.Result, resp.Blob = nil, ""
 			}
 
-			// Avoid panic if `results` is already closed during shutdown
-			select {
-			case results <- resp:
-			case <-done:
+			reply(resp)
+		}(req.Id, ch)
+	}
+}
+
+// LocalQueue is implemented by queues that may hand submissions over to
+// other nodes. Tasks forwarded by a peer are put with PutLocal so they are
+// never forwarded again.
+type LocalQueue interface {
+	PutLocal(task *tasks.Task) (<-chan internal.Output, error)
+}
+
+// Waiter is implemented by queues that let clients wait for a task they
+// submitted earlier.
+type Waiter interface {
+	Wait(id string) (<-chan internal.Output, error)
+}
+
+// submit queues the task of req. Updates go to emitter when it is set and
+// the queue can stream.
+func submit(req protocol.Request, connID int64, queue internal.IQueue, blobs *blob.Store, emitter tasks.Emitter) (<-chan internal.Output, error) {
+	task := req.Task
+	task.Id = queueID(connID, req)
+
+	// Reject malformed input now rather than when a worker gets to it.
+	if req.Op != protocol.OpWait {
+		if err := validate(&task, blobs); err != nil {
+			return nil, err
+		}
+	}
+
+	switch req.Op {
+	case protocol.OpWait:
+		waiter, ok := queue.(Waiter)
+		if !ok {
+			return nil, fmt.Errorf("op %q is not supported by this queue", req.Op)
+		}
+		return waiter.Wait(task.Id)
+	case protocol.OpForward:
+		if local, ok := queue.(LocalQueue); ok {
+			return local.PutLocal(&task)
+		}
+	}
+	if streamer, ok := queue.(internal.Streamer); ok && emitter != nil {
+		return streamer.PutStream(&task, emitter)
+	}
+	return queue.Put(&task)
+}
+
+// validate checks the input of task. Blob inputs are only checked to
+// exist, reading them would take as long as running the task.
+func validate(task *tasks.Task, blobs *blob.Store) error {
+	if task.InputBlob == "" {
+		return tasks.ValidateInput(task.Type, task.Input)
+	}
+	if _, ok := tasks.SchemaFor(task.Type); !ok {
+		return tasks.ValidateInput(task.Type, nil)
+	}
+	if blobs == nil {
+		return errNoBlobs
+	}
+	_, err := blobs.Size(task.InputBlob)
+	return err
+}
+
+// errorResponse reports err for req, pointing the client at the leader if
+// this node cannot accept the request.
+func errorResponse(req protocol.Request, err error) protocol.Response {
+	resp := protocol.Response{ID: req.Id, Op: req.Op, Error: err.Error()}
+	var notLeader *internal.NotLeaderError
+	if errors.As(err, &notLeader) {
+		resp.Leader = notLeader.Leader
+	}
+	var invalid *tasks.ValidationError
+	if errors.As(err, &invalid) {
+		resp.Validation = invalid
+	}
+	return resp
+}
+
+// handleSteal leases the oldest queued task to the peer asking for work,
+// so it comes back if the peer gets stuck on it.
+func handleSteal(req protocol.Request, queue internal.IQueue, leases *leases) protocol.Response {
+	claim, ok := queue.TryClaim()
+	if !ok {
+		return protocol.Response{ID: req.Id, Op: req.Op}
+	}
+	visibility := req.Visibility
+	if visibility <= 0 {
+		visibility = defaultStealVisibility
+	}
+	if err := claim.Lease(visibility); err != nil {
+		claim.Release()
+		return errorResponse(req, err)
+	}
+
+	task := claim.Task()
+	leases.add(claim)
+	return protocol.Response{ID: req.Id, Op: req.Op, Task: task}
+}
+
+// handleComplete records the result a peer or remote worker reports for a
+// task it claimed, or puts the task back into the queue if it released it.
+// A result for a lease that expired meanwhile is refused; the task runs
+// again.
+func handleComplete(req protocol.Request, leases *leases) protocol.Response {
+	claim, ok := leases.take(req.Id)
+	if !ok {
+		return protocol.Response{ID: req.Id, Op: req.Op, Error: internal.ErrTaskNotFound.Error()}
+	}
+
+	if req.Op == protocol.OpRelease {
+		claim.Release()
+		return protocol.Response{ID: req.Id, Op: req.Op}
+	}
+
+	output := internal.Output{Res: req.Result, Blob: req.Blob}
+	if req.Error != "" {
+		output = internal.Output{Err: errors.New(req.Error)}
+	}
+	if err := claim.Ack(output); err != nil {
+		return errorResponse(req, err)
+	}
+	return protocol.Response{ID: req.Id, Op: req.Op}
+}
+
+// handleBlob runs a blob operation. uploads tracks the uploads of the
+// connection, up to maxUploads at once. Those the store discarded as
+// abandoned are forgotten once they are found gone.
+func handleBlob(req protocol.Request, blobs *blob.Store, uploads map[string]bool, maxUploads int) protocol.Response {
+	resp := protocol.Response{ID: req.Id, Op: req.Op}
+	fail := func(err error) protocol.Response {
+		resp.Error = err.Error()
+		return resp
+	}
+	if blobs == nil {
+		return fail(errNoBlobs)
+	}
+
+	switch req.Op {
+	case protocol.OpUpload:
+		if len(req.Chunk) > maxChunk {
+			return fail(fmt.Errorf("chunks are limited to %d bytes", maxChunk))
+		}
+		id := req.Upload
+		if id == "" {
+			if len(uploads) >= maxUploads {
+				return fail(fmt.Errorf("uploads are limited to %d at once per connection", maxUploads))
+			}
+			var err error
+			if id, err = blobs.Begin(); err != nil {
+				return fail(err)
 			}
-		}(task.Id, ch)
+			uploads[id] = true
+		} else if !uploads[id] {
+			return fail(blob.ErrUploadNotFound)
+		}
+		resp.Upload = id
+		size, err := blobs.Append(id, req.Offset, req.Chunk)
+		resp.Size = size
+		if errors.Is(err, blob.ErrUploadNotFound) {
+			delete(uploads, id)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	case protocol.OpCommit:
+		if !uploads[req.Upload] {
+			return fail(blob.ErrUploadNotFound)
+		}
+		delete(uploads, req.Upload)
+		hash, size, err := blobs.Commit(req.Upload, req.Blob)
+		if err != nil {
+			return fail(err)
+		}
+		resp.Blob, resp.Size = hash, size
+	case protocol.OpDownload:
+		if req.Offset < 0 {
+			return fail(errors.New("negative offset"))
+		}
+		file, err := blobs.Open(req.Blob)
+		if err != nil {
+			return fail(err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return fail(err)
+		}
+		length := req.Length
+		if length <= 0 || length > maxChunk {
+			length = maxChunk
+		}
+		length = max(0, min(length, info.Size()-req.Offset))
+		resp.Blob, resp.Size = req.Blob, info.Size()
+		resp.Chunk = make([]byte, length)
+		if _, err := file.ReadAt(resp.Chunk, req.Offset); err != nil {
+			resp.Chunk = nil
+			return fail(err)
+		}
 	}
+	return resp
+}
+
+// handleControl applies a control operation and answers with the resulting
+// queue stats. A cancelled task additionally gets its own result message
+// carrying the cancellation error.
+func handleControl(req protocol.Request, connID int64, queue internal.IQueue, submitted *sync.Map) protocol.Response {
+	switch req.Op {
+	case protocol.OpPause:
+		queue.Pause()
+	case protocol.OpResume:
+		queue.Resume()
+	case protocol.OpStats:
+	case protocol.OpCancel:
+		id := queueID(connID, req)
+		if _, ok := submitted.Load(id); !ok {
+			return errorResponse(req, internal.ErrTaskNotFound)
+		}
+		if err := queue.Cancel(id); err != nil {
+			return errorResponse(req, err)
+		}
+	default:
+		return protocol.Response{ID: req.Id, Op: req.Op, Error: fmt.Sprintf("unknown op %q", req.Op)}
+	}
+
+	stats := queue.Stats()
+	return protocol.Response{ID: req.Id, Op: req.Op, Stats: &stats}
 }
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"vu/benchmark/queue/blob"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/tasks"
+)
+
+// startServer serves queue with cfg on a local port and returns its address.
+func startServer(t *testing.T, queue internal.IQueue, cfg Config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners = append(cfg.Listeners, Listener{Listener: ln})
+	done := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		ServeConfig(cfg, queue, done)
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-served
+		queue.Shutdown()
+	})
+	return ln.Addr().String()
+}
+
+type testConn struct {
+	net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}
+}
+
+func (c *testConn) send(t *testing.T, req protocol.Request) {
+	t.Helper()
+	if err := c.encoder.Encode(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testConn) receive(t *testing.T) protocol.Response {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var resp protocol.Response
+	if err := c.decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func sumRequest(id string) protocol.Request {
+	input, _ := json.Marshal(tasks.SumTaskInput{A: 1, B: 1})
+	return protocol.Request{Task: tasks.Task{Id: id, Type: tasks.SumTaskType, Input: input}}
+}
+
+func TestCancelOnlyOwnTasks(t *testing.T) {
+	queue := internal.New(internal.Config{Capacity: 10, Workers: 1, LogDisabled: true})
+	queue.Pause()
+	addr := startServer(t, queue, Config{})
+
+	owner := dial(t, addr)
+	req := sumRequest("1")
+	req.Client = "c"
+	owner.send(t, req)
+	// Answered once the task is queued.
+	owner.send(t, protocol.Request{Op: protocol.OpStats})
+	if resp := owner.receive(t); resp.Stats == nil || resp.Stats.Size != 1 {
+		t.Fatalf("stats: %+v", resp)
+	}
+
+	// Another connection giving the same name cannot cancel it.
+	other := dial(t, addr)
+	other.send(t, protocol.Request{Op: protocol.OpCancel, Client: "c", Task: tasks.Task{Id: "1"}})
+	if resp := other.receive(t); resp.Error != internal.ErrTaskNotFound.Error() {
+		t.Fatalf("cancel from another connection: %+v", resp)
+	}
+
+	owner.send(t, protocol.Request{Op: protocol.OpCancel, Client: "c", Task: tasks.Task{Id: "1"}})
+	for i := 0; i < 2; i++ {
+		resp := owner.receive(t)
+		if resp.Op == "" && resp.Error != internal.ErrCancelled.Error() {
+			t.Fatalf("task after cancelling: %+v", resp)
+		}
+		if resp.Op == protocol.OpCancel && resp.Error != "" {
+			t.Fatalf("cancel: %+v", resp)
+		}
+	}
+}
+
+func TestStealIsLeasedToPeers(t *testing.T) {
+	queue := internal.New(internal.Config{Capacity: 10, Workers: 0, LogDisabled: true})
+	queue.Put(&tasks.Task{Id: "a", Type: tasks.SumTaskType})
+	addr := startServer(t, queue, Config{})
+
+	c := dial(t, addr)
+	c.send(t, protocol.Request{Op: protocol.OpSteal, Task: tasks.Task{Id: "s1"}})
+	if resp := c.receive(t); resp.Task != nil || resp.Error == "" {
+		t.Fatalf("steal from a client connection: %+v", resp)
+	}
+
+	c.send(t, protocol.Request{Op: protocol.OpPeer})
+	c.receive(t)
+	c.send(t, protocol.Request{Op: protocol.OpSteal, Task: tasks.Task{Id: "s2"}, Visibility: 20 * time.Millisecond})
+	if resp := c.receive(t); resp.Task == nil || resp.Task.Id != "a" {
+		t.Fatalf("steal: %+v", resp)
+	}
+
+	// The peer never extends its lease, so the task is queued again.
+	deadline := time.Now().Add(time.Second)
+	for queue.Stats().ExpiredLeases != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("stolen task did not come back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.send(t, protocol.Request{Op: protocol.OpSteal, Task: tasks.Task{Id: "s3"}})
+	if resp := c.receive(t); resp.Task == nil || resp.Task.Id != "a" {
+		t.Fatalf("steal after the lease ran out: %+v", resp)
+	}
+	c.send(t, protocol.Request{Op: protocol.OpComplete, Task: tasks.Task{Id: "a"}, Result: []byte("{}")})
+	if resp := c.receive(t); resp.Error != "" {
+		t.Fatalf("complete: %+v", resp)
+	}
+}
+
+// closedByServer reports whether the server closed c within a second,
+// without sending anything first.
+func (c *testConn) closedByServer() error {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	var resp protocol.Response
+	if err := c.decoder.Decode(&resp); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("got %+v, %v instead of EOF", resp, err)
+	}
+	return nil
+}
+
+func TestServerClosesIdleConnections(t *testing.T) {
+	queue := internal.NewQueue(10, 0, true)
+	addr := startServer(t, queue, Config{IdleTimeout: 100 * time.Millisecond})
+
+	// Silent and with nothing in flight: closed.
+	idle := dial(t, addr)
+	start := time.Now()
+	if err := idle.closedByServer(); err != nil {
+		t.Fatalf("idle connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("closed after %v", elapsed)
+	}
+
+	// Heartbeats keep it open.
+	beating := dial(t, addr)
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		beating.send(t, protocol.Request{Op: protocol.OpHeartbeat, Task: tasks.Task{Id: "hb"}})
+		if resp := beating.receive(t); resp.Op != protocol.OpHeartbeat || resp.ID != "hb" {
+			t.Fatalf("heartbeat %d: %+v", i, resp)
+		}
+	}
+
+	// Waiting for a task: not idle, however long it takes.
+	waiting := dial(t, addr)
+	waiting.send(t, sumRequest("slow"))
+	claim, err := queue.(internal.Puller).Pull(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	claim.Complete(internal.Output{Res: []byte("2")})
+	if resp := waiting.receive(t); string(resp.Result) != "2" {
+		t.Fatalf("long task: %+v", resp)
+	}
+}
+
+func TestServerRefusesConnectionsOverMax(t *testing.T) {
+	addr := startServer(t, internal.NewQueue(10, 1, true), Config{MaxConns: 1})
+
+	first := dial(t, addr)
+	first.send(t, protocol.Request{Op: protocol.OpStats})
+	if resp := first.receive(t); resp.Error != "" {
+		t.Fatalf("first connection: %+v", resp)
+	}
+
+	second := dial(t, addr)
+	if resp := second.receive(t); resp.Error != "too many connections" {
+		t.Fatalf("connection over the limit: %+v", resp)
+	}
+	if err := second.closedByServer(); err != nil {
+		t.Fatalf("connection over the limit: %v", err)
+	}
+}
+
+func TestServeOnSeveralListeners(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "queue.sock")
+	given, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := internal.NewQueue(100, 2, true)
+	defer queue.Shutdown()
+	done := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeConfig(Config{
+			Addr: "127.0.0.1:0",
+			Listeners: []Listener{
+				{Network: "unix", Addr: socket, Mode: 0o600},
+				{Listener: given},
+			},
+		}, queue, done)
+	}()
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("socket never appeared")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, _ := os.Stat(socket); info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v", info.Mode().Perm())
+	}
+
+	for _, network := range []struct{ name, addr string }{{"unix", socket}, {"tcp", given.Addr().String()}} {
+		conn, err := net.Dial(network.name, network.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &testConn{Conn: conn, encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}
+		c.send(t, sumRequest("1"))
+		if resp := c.receive(t); string(resp.Result) == "" || resp.Error != "" {
+			t.Errorf("task over %s: %+v", network.name, resp)
+		}
+		conn.Close()
+	}
+
+	close(done)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	if _, err := net.Dial("tcp", given.Addr().String()); err == nil {
+		t.Error("given listener still accepts")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
+
+func TestDrainClosesConnectionsOnceIdle(t *testing.T) {
+	queue := internal.NewQueue(10, 0, true)
+	drain := make(chan struct{})
+	addr := startServer(t, queue, Config{Drain: drain})
+
+	idle := dial(t, addr)
+	busy := dial(t, addr)
+	busy.send(t, sumRequest("a"))
+	claim, err := queue.(internal.Puller).Pull(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(drain)
+	if err := idle.closedByServer(); err != nil {
+		t.Fatalf("idle connection: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+		t.Error("draining server accepted a connection")
+	}
+
+	// The busy connection gets its result, then is closed.
+	time.Sleep(100 * time.Millisecond)
+	claim.Complete(internal.Output{Res: []byte("2")})
+	if resp := busy.receive(t); string(resp.Result) != "2" {
+		t.Fatalf("busy connection: %+v", resp)
+	}
+	if err := busy.closedByServer(); err != nil {
+		t.Fatalf("busy connection after its result: %v", err)
+	}
+}
+
+func TestUnixSocketOfRunningServerIsNotTaken(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "queue.sock")
+	running, err := Listener{Network: "unix", Addr: socket}.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(socket); info.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode %v", info.Mode().Perm())
+	}
+	if _, err := (Listener{Network: "unix", Addr: socket}).Open(0); err == nil {
+		t.Fatal("listened on the socket of a running server")
+	}
+
+	// Once nothing answers on it, the socket file is stale and replaced.
+	running.(*net.UnixListener).SetUnlinkOnClose(false)
+	running.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := Listener{Network: "unix", Addr: socket}.Open(0)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	replaced.Close()
+}
+
+func TestUploadsPerConnectionAreCapped(t *testing.T) {
+	store, err := blob.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, internal.NewQueue(10, 1, true), Config{Blobs: store, MaxUploads: 2})
+
+	c := dial(t, addr)
+	var ids []string
+	for i := 0; i < 2; i++ {
+		c.send(t, protocol.Request{Op: protocol.OpUpload, Chunk: []byte("chunk")})
+		resp := c.receive(t)
+		if resp.Error != "" || resp.Upload == "" {
+			t.Fatalf("upload %d: %+v", i, resp)
+		}
+		ids = append(ids, resp.Upload)
+	}
+	c.send(t, protocol.Request{Op: protocol.OpUpload, Chunk: []byte("chunk")})
+	if resp := c.receive(t); resp.Error == "" {
+		t.Fatalf("upload over the limit: %+v", resp)
+	}
+	// Another connection has its own uploads.
+	other := dial(t, addr)
+	other.send(t, protocol.Request{Op: protocol.OpUpload, Chunk: []byte("chunk")})
+	if resp := other.receive(t); resp.Error != "" {
+		t.Fatalf("upload on another connection: %+v", resp)
+	}
+
+	// A committed upload, or one the store swept, makes room.
+	c.send(t, protocol.Request{Op: protocol.OpCommit, Upload: ids[0]})
+	if resp := c.receive(t); resp.Error != "" {
+		t.Fatalf("commit: %+v", resp)
+	}
+	c.send(t, protocol.Request{Op: protocol.OpUpload, Chunk: []byte("chunk")})
+	if resp := c.receive(t); resp.Error != "" {
+		t.Fatalf("upload after a commit: %+v", resp)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if uploads, _, err := store.Sweep(time.Millisecond, 0); err != nil || uploads != 3 {
+		t.Fatalf("swept %d uploads: %v", uploads, err)
+	}
+	c.send(t, protocol.Request{Op: protocol.OpUpload, Upload: ids[1], Offset: 5, Chunk: []byte("more")})
+	if resp := c.receive(t); resp.Error != blob.ErrUploadNotFound.Error() {
+		t.Fatalf("append to a swept upload: %+v", resp)
+	}
+	c.send(t, protocol.Request{Op: protocol.OpUpload, Chunk: []byte("chunk")})
+	if resp := c.receive(t); resp.Error != "" {
+		t.Fatalf("upload after one was swept: %+v", resp)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package server
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix listens on a socket file at path with mode. Windows has no
+// umask, so the mode is set once the file exists.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package server
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMutex serializes the umask changes of listenUnix, as the umask is
+// shared by the whole process.
+var umaskMutex sync.Mutex
+
+// listenUnix listens on a socket file at path that is created with mode, so
+// it is never open to more users than that, not even briefly. Files other
+// goroutines create meanwhile get the same umask.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	umaskMutex.Lock()
+	defer umaskMutex.Unlock()
+
+	old := syscall.Umask(int(^mode & 0o777))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/tasks"
+)
+
+// leases are the tasks claimed over one connection, by a peer stealing
+// work or a remote worker, until they are completed or released.
+type leases struct {
+	mutex  sync.Mutex
+	claims map[string]*internal.Claim
+	// cancelled tells the holder of a claim that its task was cancelled.
+	cancelled func(id string)
+	// pulling counts the pulls waiting for a task.
+	pulling int
+	closed  bool
+}
+
+func newLeases() *leases {
+	return &leases{claims: make(map[string]*internal.Claim)}
+}
+
+func (l *leases) add(claim *internal.Claim) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.claims[claim.Task().Id] = claim
+	l.watch(claim)
+}
+
+// watch calls cancelled once the task of claim is cancelled, unless the
+// claim was completed or released before.
+func (l *leases) watch(claim *internal.Claim) {
+	go func() {
+		<-claim.Done()
+		id := claim.Task().Id
+		if held, ok := l.get(id); ok && held == claim && claim.Cancelled() {
+			l.cancelled(id)
+		}
+	}()
+}
+
+func (l *leases) get(id string) (*internal.Claim, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	claim, ok := l.claims[id]
+	return claim, ok
+}
+
+func (l *leases) take(id string) (*internal.Claim, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	claim, ok := l.claims[id]
+	delete(l.claims, id)
+	return claim, ok
+}
+
+// reserve starts a pull unless limit tasks are already leased or pulled.
+func (l *leases) reserve(limit int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.claims)+l.pulling >= limit {
+		return false
+	}
+	l.pulling++
+	return true
+}
+
+// fill ends a pull with the claim it got, or nil if it failed. A claim
+// arriving after the connection closed is released right away.
+func (l *leases) fill(claim *internal.Claim) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.pulling--
+	if claim == nil {
+		return false
+	}
+	if l.closed {
+		claim.Release()
+		return false
+	}
+	l.claims[claim.Task().Id] = claim
+	l.watch(claim)
+	return true
+}
+
+// busy reports whether tasks are leased or pulls waiting.
+func (l *leases) busy() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.claims) > 0 || l.pulling > 0
+}
+
+// releaseAll puts every leased task back into the queue for others to run
+// and returns how many there were.
+func (l *leases) releaseAll() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	for _, claim := range l.claims {
+		claim.Release()
+	}
+	n := len(l.claims)
+	clear(l.claims)
+	return n
+}
+
+// handleRegister records the remote worker req registers for the
+// connection.
+func handleRegister(req protocol.Request, worker **protocol.WorkerInfo) protocol.Response {
+	info := req.Worker
+	switch {
+	case *worker != nil:
+		return protocol.Response{ID: req.Id, Op: req.Op, Error: "worker already registered"}
+	case info == nil || info.Concurrency <= 0:
+		return protocol.Response{ID: req.Id, Op: req.Op, Error: "register needs a worker with a positive concurrency"}
+	}
+	for _, taskType := range info.Types {
+		if _, ok := tasks.SchemaFor(taskType); !ok {
+			return protocol.Response{ID: req.Id, Op: req.Op, Error: fmt.Sprintf("unknown task type %q", taskType)}
+		}
+	}
+
+	*worker = info
+	types := "all"
+	if len(info.Types) > 0 {
+		types = strings.Join(info.Types, ",")
+	}
+	fmt.Printf("Worker %s registered, types %s, concurrency %d\n", info.Name, types, info.Concurrency)
+	return protocol.Response{ID: req.Id, Op: req.Op}
+}
+
+// handlePull leases the next queued task the worker can run to it. The
+// pull waits for one on its own goroutine, until ctx is done when the
+// connection closes.
+func handlePull(ctx context.Context, req protocol.Request, queue internal.IQueue, worker *protocol.WorkerInfo, leases *leases, reply func(protocol.Response)) {
+	if worker == nil {
+		reply(protocol.Response{ID: req.Id, Op: req.Op, Error: "register before pulling"})
+		return
+	}
+	puller, ok := queue.(internal.Puller)
+	if !ok {
+		reply(errorResponse(req, internal.ErrPullUnsupported))
+		return
+	}
+	if !leases.reserve(worker.Concurrency) {
+		reply(protocol.Response{ID: req.Id, Op: req.Op, Error: fmt.Sprintf("worker %s has %d tasks leased or pulling already", worker.Name, worker.Concurrency)})
+		return
+	}
+
+	go func() {
+		var claim *internal.Claim
+		var err error
+		if req.Visibility > 0 {
+			claim, err = puller.Lease(ctx, worker.Types, req.Visibility)
+		} else {
+			claim, err = puller.Pull(ctx, worker.Types)
+		}
+		if !leases.fill(claim) {
+			if err == nil || errors.Is(err, context.Canceled) {
+				// The connection is gone.
+				return
+			}
+			reply(errorResponse(req, err))
+			return
+		}
+		reply(protocol.Response{ID: req.Id, Op: req.Op, Task: claim.Task()})
+	}()
+}
+
+// handleExtend prolongs the lease of a task a worker is still running.
+func handleExtend(req protocol.Request, leases *leases) protocol.Response {
+	claim, ok := leases.get(req.Id)
+	if !ok {
+		return errorResponse(req, internal.ErrTaskNotFound)
+	}
+	if req.Visibility <= 0 {
+		return protocol.Response{ID: req.Id, Op: req.Op, Error: "extend needs a positive visibility"}
+	}
+	if err := claim.Extend(req.Visibility); err != nil {
+		return errorResponse(req, err)
+	}
+	return protocol.Response{ID: req.Id, Op: req.Op}
+}
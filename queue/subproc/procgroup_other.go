@@ -0,0 +1,13 @@
+//go:build windows
+
+package subproc
+
+import "os/exec"
+
+// Process groups are Unix only; on Windows only the process itself is
+// killed.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
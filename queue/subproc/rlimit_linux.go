@@ -0,0 +1,89 @@
+package subproc
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// limitsEnv carries the limits to the wrapper process setLimits starts, as
+// "memory,cpu-seconds".
+const limitsEnv = "SUBPROC_LIMITS"
+
+// init turns this process into the wrapper of setLimits when started as
+// one: it sets its own limits, then execs the real command in its place,
+// so the command runs under them from its first instruction and every
+// process it forks inherits them. Any program importing the package can
+// be the wrapper, being the executable that started the command.
+func init() {
+	spec, ok := os.LookupEnv(limitsEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(limitsEnv)
+	if err := applyLimits(spec); err != nil {
+		fmt.Fprintln(os.Stderr, "subproc: limits:", err)
+		os.Exit(126)
+	}
+	err := syscall.Exec(os.Args[1], os.Args[2:], os.Environ())
+	fmt.Fprintln(os.Stderr, "subproc: exec:", err)
+	os.Exit(127)
+}
+
+// setLimits makes cmd run under an address space limit of memory bytes and
+// a CPU time limit, by starting it through a wrapper: this executable,
+// which sets the limits with setrlimit(2) and execs the command. Zero
+// leaves a limit alone. The wrapper's own start counts towards the CPU
+// time, as the process stays the same across exec.
+func setLimits(cmd *exec.Cmd, memory uint64, cpu time.Duration) error {
+	if memory == 0 && cpu <= 0 {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// RLIMIT_CPU counts whole seconds; round up so a limit never vanishes.
+	var seconds uint64
+	if cpu > 0 {
+		seconds = uint64((cpu + time.Second - 1) / time.Second)
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, fmt.Sprintf("%s=%d,%d", limitsEnv, memory, seconds))
+	cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+func applyLimits(spec string) error {
+	memory, cpu, ok := strings.Cut(spec, ",")
+	if !ok {
+		return fmt.Errorf("malformed %s %q", limitsEnv, spec)
+	}
+	for _, limit := range []struct {
+		resource int
+		value    string
+	}{
+		{syscall.RLIMIT_AS, memory},
+		{syscall.RLIMIT_CPU, cpu},
+	} {
+		value, err := strconv.ParseUint(limit.value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed %s %q", limitsEnv, spec)
+		}
+		if value == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
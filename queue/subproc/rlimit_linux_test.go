@@ -0,0 +1,31 @@
+package subproc
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	// limits reports the address space and CPU rlimits of the helper.
+	helperModes["limits"] = func() []byte {
+		var memory, cpu syscall.Rlimit
+		syscall.Getrlimit(syscall.RLIMIT_AS, &memory)
+		syscall.Getrlimit(syscall.RLIMIT_CPU, &cpu)
+		return []byte(fmt.Sprint(memory.Cur, cpu.Cur))
+	}
+}
+
+func TestLimitsApplied(t *testing.T) {
+	pool := startHelper(t, "limits", Config{MaxMemory: 8 << 30, MaxCPU: 1500 * time.Millisecond})
+
+	result, err := pool.Handle(context.Background(), []byte("limit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprint(8<<30, 2); string(result) != want {
+		t.Errorf("RLIMIT_AS and RLIMIT_CPU %s, want %s", result, want)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package subproc
+
+import (
+	"os/exec"
+	"time"
+)
+
+// setLimits is only implemented on Linux.
+func setLimits(cmd *exec.Cmd, memory uint64, cpu time.Duration) error {
+	return nil
+}
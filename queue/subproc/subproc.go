@@ -0,0 +1,386 @@
+// Package subproc runs tasks in external executables, written in any
+// language, without linking them into the queue. A Pool keeps a number of
+// processes running and hands each one task at a time over its stdin; the
+// process answers on its stdout. Its stderr goes to ours.
+//
+// Every message is a frame: a 4-byte big-endian length followed by that
+// many bytes of JSON. The queue sends
+//
+//	{"id": "1", "input": "<base64>"}
+//
+// and the process answers with the same id and either a result or an error:
+//
+//	{"id": "1", "result": "<base64>"}
+//	{"id": "1", "error": "bad input"}
+//
+// A process that exits, breaks the protocol or overruns the task timeout
+// is killed and replaced by a new one on the next task.
+package subproc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxFrame bounds the frames a process may send.
+const maxFrame = 64 << 20
+
+var (
+	ErrTimeout = errors.New("handler timed out")
+	ErrClosed  = errors.New("handler pool closed")
+)
+
+// Config describes the processes of a pool.
+type Config struct {
+	// Command is the executable and its arguments.
+	Command []string
+	Dir     string
+	// Env is the environment of the processes, ours if nil.
+	Env []string
+	// Size is the number of processes, and so of tasks run at once; 1 by
+	// default.
+	Size int
+	// Timeout bounds every task, 30s by default.
+	Timeout time.Duration
+	// MaxMemory limits the address space of each process, in bytes, and
+	// MaxCPU its CPU time over its whole life; Linux only. They are set
+	// before the command starts, by this executable acting as a wrapper,
+	// and hold for whatever it spawns. A process exceeding them is killed
+	// by the kernel and restarted.
+	MaxMemory uint64
+	MaxCPU    time.Duration
+	// RestartDelay is waited before restarting a process that crashed, so
+	// a broken executable does not spin; 100ms by default.
+	RestartDelay time.Duration
+	LogDisabled  bool
+}
+
+// Stats counts the lifecycle events of a pool.
+type Stats struct {
+	Tasks    int64 `json:"tasks"`
+	Started  int64 `json:"started"`
+	Crashes  int64 `json:"crashes"`
+	Timeouts int64 `json:"timeouts"`
+}
+
+// Pool is a set of processes running the tasks of one type.
+type Pool struct {
+	cfg  Config
+	idle chan *process
+	seq  uint64
+
+	tasks    atomic.Int64
+	started  atomic.Int64
+	crashes  atomic.Int64
+	timeouts atomic.Int64
+
+	mutex  sync.Mutex
+	all    []*process
+	closed bool
+}
+
+type process struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	// exited is closed once the process is reaped; err is why it exited.
+	exited chan struct{}
+	err    error
+	// crashed is when the previous process in this slot died.
+	crashed time.Time
+}
+
+type request struct {
+	ID    string `json:"id"`
+	Input []byte `json:"input"`
+}
+
+type response struct {
+	ID     string `json:"id"`
+	Result []byte `json:"result"`
+	Error  string `json:"error"`
+}
+
+// Start launches the pool's processes.
+func Start(cfg Config) (*Pool, error) {
+	if len(cfg.Command) == 0 {
+		return nil, errors.New("subproc: no command")
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.RestartDelay <= 0 {
+		cfg.RestartDelay = 100 * time.Millisecond
+	}
+
+	p := &Pool{cfg: cfg, idle: make(chan *process, cfg.Size)}
+	for i := 0; i < cfg.Size; i++ {
+		proc, err := p.start()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle <- proc
+	}
+	return p, nil
+}
+
+func (p *Pool) logf(format string, args ...any) {
+	if p.cfg.LogDisabled {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// start launches a process, unless the pool is closed. Close kills every
+// process start added to the pool.
+func (p *Pool) start() (*process, error) {
+	p.mutex.Lock()
+	closed := p.closed
+	p.mutex.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	cmd := exec.Command(p.cfg.Command[0], p.cfg.Command[1:]...)
+	cmd.Dir = p.cfg.Dir
+	cmd.Env = p.cfg.Env
+	cmd.Stderr = os.Stderr
+	// Its own process group, so a timeout kills whatever it spawned too.
+	setProcessGroup(cmd)
+	if err := setLimits(cmd, p.cfg.MaxMemory, p.cfg.MaxCPU); err != nil {
+		return nil, fmt.Errorf("subproc: limits: %w", err)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	proc := &process{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.exited)
+		p.forget(proc)
+	}()
+
+	// Close may have run while the process started; it would not see it.
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		proc.kill()
+		return nil, ErrClosed
+	}
+	p.all = append(p.all, proc)
+	p.mutex.Unlock()
+	p.started.Add(1)
+	return proc, nil
+}
+
+// forget drops a reaped process from the pool.
+func (p *Pool) forget(proc *process) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, other := range p.all {
+		if other == proc {
+			p.all = append(p.all[:i], p.all[i+1:]...)
+			return
+		}
+	}
+}
+
+// kill ends the process and its children and waits until it is reaped.
+func (proc *process) kill() {
+	killProcessGroup(proc.cmd)
+	<-proc.exited
+}
+
+func (proc *process) dead() bool {
+	select {
+	case <-proc.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handle runs one task on an idle process, waiting for one if all are
+// busy. It matches internal.Handler.
+func (p *Pool) Handle(ctx context.Context, input []byte) ([]byte, error) {
+	var proc *process
+	select {
+	case proc = <-p.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	proc, err := p.ensure(proc)
+	if err != nil {
+		// Keep the slot; the next task tries to start a process again.
+		p.idle <- &process{exited: closedChan, crashed: time.Now()}
+		return nil, err
+	}
+
+	result, err := p.call(ctx, proc, input)
+	p.idle <- proc
+	return result, err
+}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// ensure replaces a dead process, after RestartDelay if it crashed.
+func (p *Pool) ensure(proc *process) (*process, error) {
+	if !proc.dead() {
+		return proc, nil
+	}
+
+	if wait := p.cfg.RestartDelay - time.Since(proc.crashed); wait > 0 {
+		time.Sleep(wait)
+	}
+	return p.start()
+}
+
+// call sends input to proc and waits for its answer. A process that fails
+// to answer properly is killed; ensure restarts it for the next task.
+func (p *Pool) call(ctx context.Context, proc *process, input []byte) ([]byte, error) {
+	p.tasks.Add(1)
+	id := strconv.FormatUint(atomic.AddUint64(&p.seq, 1), 10)
+
+	timeout, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	answered := make(chan error, 1)
+	var resp response
+	go func() {
+		if err := writeFrame(proc.stdin, request{ID: id, Input: input}); err != nil {
+			answered <- err
+			return
+		}
+		answered <- readFrame(proc.stdout, &resp)
+	}()
+
+	select {
+	case err := <-answered:
+		if err == nil && resp.ID != id {
+			err = fmt.Errorf("answered task %q instead of %q", resp.ID, id)
+		}
+		if err != nil {
+			return nil, p.crashed(proc, err)
+		}
+	case <-timeout.Done():
+		proc.kill()
+		proc.crashed = time.Now()
+		if ctx.Err() == nil {
+			p.timeouts.Add(1)
+			p.logf("subproc %s: task timed out after %v, process killed\n", p.cfg.Command[0], p.cfg.Timeout)
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// crashed kills a process that failed mid-task and describes why.
+func (p *Pool) crashed(proc *process, err error) error {
+	proc.kill()
+	proc.crashed = time.Now()
+	p.crashes.Add(1)
+
+	if proc.err != nil {
+		// The exit status says more than the broken pipe.
+		err = proc.err
+	}
+	p.logf("subproc %s: process crashed: %v\n", p.cfg.Command[0], err)
+	return fmt.Errorf("handler crashed: %w", err)
+}
+
+func writeFrame(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, v any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds %d", size, maxFrame)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Tasks:    p.tasks.Load(),
+		Started:  p.started.Load(),
+		Crashes:  p.crashes.Load(),
+		Timeouts: p.timeouts.Load(),
+	}
+}
+
+// Close stops every process, interrupting running tasks.
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	all := append([]*process(nil), p.all...)
+	p.mutex.Unlock()
+
+	for _, proc := range all {
+		// Closing stdin lets well-behaved processes exit on their own.
+		proc.stdin.Close()
+		select {
+		case <-proc.exited:
+		case <-time.After(time.Second):
+			proc.kill()
+		}
+	}
+	return nil
+}
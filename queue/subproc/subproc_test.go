@@ -0,0 +1,180 @@
+package subproc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// helperEnv makes the test binary act as a handler process instead of
+// running the tests.
+const helperEnv = "SUBPROC_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(helperEnv); mode != "" {
+		helper(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// helperModes answers every task of a helper in one of these modes, see
+// rlimit_linux_test.go.
+var helperModes = map[string]func() []byte{}
+
+// helper answers tasks according to mode: echo returns the input, except
+// that it exits on "crash", hangs on "sleep" and fails "fail"; modes in
+// helperModes answer with their result.
+func helper(mode string) {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		var req request
+		if err := readFrame(in, &req); err != nil {
+			return
+		}
+		resp := response{ID: req.ID, Result: req.Input}
+		switch {
+		case string(req.Input) == "crash":
+			os.Exit(3)
+		case string(req.Input) == "sleep":
+			time.Sleep(time.Hour)
+		case string(req.Input) == "fail":
+			resp = response{ID: req.ID, Error: "failed on purpose"}
+		case helperModes[mode] != nil:
+			resp.Result = helperModes[mode]()
+		}
+		if err := writeFrame(os.Stdout, resp); err != nil {
+			return
+		}
+	}
+}
+
+func startHelper(t *testing.T, mode string, cfg Config) *Pool {
+	t.Helper()
+	cfg.Command = []string{os.Args[0]}
+	cfg.Env = append(os.Environ(), helperEnv+"="+mode)
+	cfg.RestartDelay = time.Millisecond
+	cfg.LogDisabled = true
+	pool, err := Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+func TestHandleConcurrently(t *testing.T) {
+	pool := startHelper(t, "echo", Config{Size: 4})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			input := fmt.Sprint("task ", i)
+			result, err := pool.Handle(context.Background(), []byte(input))
+			if err != nil || string(result) != input {
+				t.Errorf("%s: result %q, err %v", input, result, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := pool.Handle(context.Background(), []byte("fail")); err == nil || err.Error() != "failed on purpose" {
+		t.Errorf("failing task: %v", err)
+	}
+	if stats := pool.Stats(); stats.Tasks != 101 || stats.Started != 4 || stats.Crashes != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestCrashRestartsProcess(t *testing.T) {
+	pool := startHelper(t, "echo", Config{})
+
+	_, err := pool.Handle(context.Background(), []byte("crash"))
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("crashing task: %v", err)
+	}
+	if result, err := pool.Handle(context.Background(), []byte("after")); err != nil || string(result) != "after" {
+		t.Fatalf("task after crash: result %q, err %v", result, err)
+	}
+	if stats := pool.Stats(); stats.Crashes != 1 || stats.Started != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestPoolForgetsDeadProcesses(t *testing.T) {
+	pool := startHelper(t, "echo", Config{})
+
+	for i := 0; i < 5; i++ {
+		pool.Handle(context.Background(), []byte("crash"))
+	}
+	pool.Handle(context.Background(), []byte("after"))
+	pool.mutex.Lock()
+	tracked := len(pool.all)
+	pool.mutex.Unlock()
+	if tracked != 1 {
+		t.Errorf("pool tracks %d processes, want 1", tracked)
+	}
+}
+
+func TestCloseWhileRestarting(t *testing.T) {
+	pool := startHelper(t, "echo", Config{Size: 4})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// Each crash restarts a process, racing Close.
+				_, err := pool.Handle(context.Background(), []byte("crash"))
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	pool.Close()
+	wg.Wait()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, proc := range pool.all {
+		if !proc.dead() {
+			t.Errorf("process %d outlived Close", proc.cmd.Process.Pid)
+		}
+	}
+}
+
+func TestTimeoutKillsProcess(t *testing.T) {
+	pool := startHelper(t, "echo", Config{Timeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := pool.Handle(context.Background(), []byte("sleep")); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("hanging task: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+
+	// A cancelled task kills its process too.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Handle(ctx, []byte("sleep")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled task: %v", err)
+	}
+
+	if result, err := pool.Handle(context.Background(), []byte("after")); err != nil || string(result) != "after" {
+		t.Fatalf("task after timeout: result %q, err %v", result, err)
+	}
+	if stats := pool.Stats(); stats.Timeouts != 1 || stats.Started != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+}
@@ -1,10 +1,14 @@
 package tasks
 
 import (
+	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
 const (
@@ -12,12 +16,19 @@ const (
 	HashTaskType    = "hash"
 	BurnCPUTaskType = "BurnCPUTask"
 	SlowAPITaskType = "SlowAPITask"
+	SHA256TaskType  = "sha256"
 )
 
 type Task struct {
 	Id    string `json:"id"`
 	Type  string `json:"type"`
 	Input []byte `json:"input"`
+	// InputBlob, if set, is the hash of a blob the server stores (see
+	// package blob) that is the task's input instead of Input.
+	InputBlob string `json:"inputBlob,omitempty"`
+	// Key, if set, orders the task after earlier tasks with the same key:
+	// they run one at a time, in the order they were put.
+	Key string `json:"key,omitempty"`
 }
 
 type SumTaskInput struct {
@@ -49,15 +60,22 @@ type HashTaskOutput struct {
 	Res string `json:"res"`
 }
 
-func HashTask(iterations int) []byte {
+// hashCheckEvery is how many iterations HashTask runs between
+// cancellation checks.
+const hashCheckEvery = 1 << 14
+
+func HashTask(ctx context.Context, iterations int) ([]byte, error) {
 	data := []byte("benchmark")
 	var sum [32]byte
 
 	for i := 0; i < iterations; i++ {
+		if i%hashCheckEvery == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		sum = sha256.Sum256(data)
 	}
 
-	return sum[:]
+	return sum[:], nil
 }
 
 type BurnCPUTaskInput struct {
@@ -68,14 +86,35 @@ type BurnCPUTaskOutput struct {
 	Res int `json:"res"`
 }
 
-func BurnCPUTask(input []byte) ([]byte, error) {
+// burnCPUCheckEvery is how many iterations BurnCPUTask runs between
+// cancellation checks.
+const burnCPUCheckEvery = 1 << 20
+
+// burnCPUUpdates is how many progress updates BurnCPUTask streams.
+const burnCPUUpdates = 10
+
+func BurnCPUTask(ctx context.Context, input []byte) ([]byte, error) {
 	inputType := BurnCPUTaskInput{}
 	if err := json.Unmarshal(input, &inputType); err != nil {
 		return nil, err
 	}
 
 	var x uint64 = 1
+	total := int64(inputType.Iteration)
+	step := max(total/burnCPUUpdates, 1)
+	next := step
 	for i := 0; i < inputType.Iteration; i++ {
+		if i%burnCPUCheckEvery == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if int64(i) == next {
+			// Report progress with the state so far as a checkpoint.
+			Emit(ctx, Update{
+				Progress: &Progress{Done: int64(i), Total: total},
+				Chunk:    []byte(fmt.Sprintf(`{"iteration":%d,"x":%d}`, i, x)),
+			})
+			next += step
+		}
 		x = x*1664525 + 1013904223 // LCG, prevents optimization
 	}
 
@@ -85,23 +124,62 @@ func BurnCPUTask(input []byte) ([]byte, error) {
 
 type SlowAPITaskInput struct {
 	Addr string `json:"addr"`
+	// TimeoutMs bounds the call to the backend, defaultAPITimeout if zero.
+	TimeoutMs int `json:"timeoutMs,omitempty"`
 }
 
-func SlowAPITask(input []byte) ([]byte, error) {
+// defaultAPITimeout is how long SlowAPITask waits for its backend by
+// default, so one that hangs fails the call instead of holding the worker.
+const defaultAPITimeout = 5 * time.Second
+
+func SlowAPITask(ctx context.Context, input []byte) ([]byte, error) {
 	inputType := SlowAPITaskInput{}
 	if err := json.Unmarshal(input, &inputType); err != nil {
 		return nil, err
 	}
 
-	conn, err := net.Dial("tcp", inputType.Addr)
+	timeout := time.Duration(inputType.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultAPITimeout
+	}
+
+	// While the backend is down, fail fast instead of dialing it.
+	err := Breakers().Do(ctx, inputType.Addr, func(ctx context.Context) error {
+		return callAPI(ctx, inputType.Addr, timeout)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return []byte("ok"), nil
+}
+
+// callAPI pings the backend at addr and checks its reply, within timeout.
+func callAPI(ctx context.Context, addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	// Unblock the read below if the task is cancelled mid-call.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	fmt.Fprintln(conn, "ping")
 
-	buf := make([]byte, 16)
-	_, err = conn.Read(buf)
-	return []byte("ok"), err
+	// A truncated or garbled reply is a failure, not a success.
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
 }
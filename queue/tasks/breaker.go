@@ -0,0 +1,29 @@
+package tasks
+
+import (
+	"sync"
+	"vu/benchmark/queue/breaker"
+)
+
+var (
+	breakersMutex sync.RWMutex
+	breakers      *breaker.Set
+)
+
+// SetBreakers puts the outbound calls of IO tasks, like SlowAPITask's,
+// behind the circuit breakers and bulkheads of set, one per target address.
+// They have none by default, or if set is nil.
+func SetBreakers(set *breaker.Set) {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	breakers = set
+}
+
+// Breakers returns the breakers outbound calls go through, nil if none.
+func Breakers() *breaker.Set {
+	breakersMutex.RLock()
+	defer breakersMutex.RUnlock()
+
+	return breakers
+}
@@ -0,0 +1,61 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"vu/benchmark/queue/breaker"
+)
+
+func TestSlowAPITaskFailsFastWhileBackendIsDown(t *testing.T) {
+	SetBreakers(breaker.NewSet(breaker.Config{Failures: 2, Cooldown: time.Minute, LogDisabled: true}))
+	defer SetBreakers(nil)
+
+	// Nothing listens on the port of a closed listener.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	input, _ := json.Marshal(SlowAPITaskInput{Addr: listener.Addr().String()})
+
+	for i := 0; i < 2; i++ {
+		if _, err := SlowAPITask(context.Background(), input); err == nil || errors.Is(err, breaker.ErrOpen) {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if _, err := SlowAPITask(context.Background(), input); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("call to a backend that failed twice: %v", err)
+	}
+}
+
+func TestSlowAPITaskTimesOutOnHungBackend(t *testing.T) {
+	// Accepts connections and never replies.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	input, _ := json.Marshal(SlowAPITaskInput{Addr: listener.Addr().String(), TimeoutMs: 50})
+
+	start := time.Now()
+	_, err = SlowAPITask(context.Background(), input)
+	if err == nil {
+		t.Fatal("call to a hung backend succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call took %v with a 50ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,58 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+type inputKey struct{}
+
+// WithInput returns a context carrying r as the input of the task it runs,
+// typically an opened blob.
+func WithInput(ctx context.Context, r io.Reader) context.Context {
+	return context.WithValue(ctx, inputKey{}, r)
+}
+
+// InputReader returns the input of the task ctx runs: the reader set with
+// WithInput, or the inline input otherwise. Handlers of large inputs should
+// stream from it.
+func InputReader(ctx context.Context, inline []byte) io.Reader {
+	if r, ok := ctx.Value(inputKey{}).(io.Reader); ok {
+		return r
+	}
+	return bytes.NewReader(inline)
+}
+
+// ReadInput returns the whole input of the task ctx runs, for handlers that
+// decode it in one go.
+func ReadInput(ctx context.Context, inline []byte) ([]byte, error) {
+	if r, ok := ctx.Value(inputKey{}).(io.Reader); ok {
+		return io.ReadAll(r)
+	}
+	return inline, nil
+}
+
+// SHA256Task hashes its input, which may be any bytes, and returns the hex
+// digest.
+func SHA256Task(ctx context.Context, input io.Reader) ([]byte, error) {
+	h := sha256.New()
+	// Copy in pieces so a cancelled task stops between them.
+	buf := make([]byte, 64<<10)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := input.Read(buf)
+		h.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(hex.EncodeToString(h.Sum(nil))), nil
+}
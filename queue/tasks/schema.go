@@ -0,0 +1,326 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Schema describes a JSON value in the vocabulary of JSON Schema. It is
+// derived from Go types with SchemaOf.
+type Schema struct {
+	Type       string             `json:"type"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	// Required is only enforced for strict types, see TypeSchema.
+	Required []string `json:"required,omitempty"`
+	Items    *Schema  `json:"items,omitempty"`
+	// AdditionalProperties is the schema of map values.
+	AdditionalProperties *Schema  `json:"additionalProperties,omitempty"`
+	Minimum              *float64 `json:"minimum,omitempty"`
+	Maximum              *float64 `json:"maximum,omitempty"`
+}
+
+// TypeSchema is what a task type accepts and, if its result is JSON,
+// returns. A nil Input accepts any bytes.
+//
+// Inputs are checked the way json.Unmarshal decodes them into the input
+// struct: values of the wrong type or out of range are refused, while
+// missing and unknown fields and nulls are not. Strict types also refuse
+// unknown fields, and missing or null required ones.
+type TypeSchema struct {
+	Input  *Schema `json:"input"`
+	Output *Schema `json:"output,omitempty"`
+	Strict bool    `json:"strict,omitempty"`
+}
+
+var (
+	schemasMutex sync.RWMutex
+	schemas      = map[string]TypeSchema{
+		SumTaskType:     {Input: SchemaOf(SumTaskInput{}), Output: SchemaOf(SumTaskOutput{})},
+		HashTaskType:    {Input: SchemaOf(HashTaskInput{})},
+		BurnCPUTaskType: {Input: SchemaOf(BurnCPUTaskInput{}), Output: SchemaOf(BurnCPUTaskInput{})},
+		SlowAPITaskType: {Input: SchemaOf(SlowAPITaskInput{})},
+		SHA256TaskType:  {},
+	}
+)
+
+// SchemaFor returns the schema of a task type.
+func SchemaFor(taskType string) (TypeSchema, bool) {
+	schemasMutex.RLock()
+	defer schemasMutex.RUnlock()
+
+	schema, ok := schemas[taskType]
+	return schema, ok
+}
+
+// RegisterSchema makes a task type known, for types handled outside this
+// package.
+func RegisterSchema(taskType string, schema TypeSchema) {
+	schemasMutex.Lock()
+	defer schemasMutex.Unlock()
+
+	schemas[taskType] = schema
+}
+
+// Types lists the known task types.
+func Types() []string {
+	schemasMutex.RLock()
+	defer schemasMutex.RUnlock()
+
+	types := make([]string, 0, len(schemas))
+	for taskType := range schemas {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// SchemaOf derives the schema of v's type. Struct fields are named as
+// encoding/json names them and are required unless tagged omitempty.
+func SchemaOf(v any) *Schema {
+	return schemaOf(reflect.TypeOf(v))
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+func schemaOf(t reflect.Type) *Schema {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits := t.Bits()
+		return &Schema{
+			Type:    "integer",
+			Minimum: bound(-math.Pow(2, float64(bits-1))),
+			Maximum: bound(math.Pow(2, float64(bits-1)) - 1),
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Minimum: bound(0), Maximum: bound(math.Pow(2, float64(t.Bits())) - 1)}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json writes []byte as base64.
+			return &Schema{Type: "string"}
+		}
+		return &Schema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" && options == "" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			schema.Properties[name] = schemaOf(field.Type)
+			if !strings.Contains(options, "omitempty") {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		return schema
+	}
+	// Interfaces and anything else accept any value.
+	return &Schema{}
+}
+
+// FieldError is one problem with a value. Field is a path like
+// "items[2].name", empty for the value itself.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists everything wrong with the input of a task.
+type ValidationError struct {
+	Type   string       `json:"type"`
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		if f.Field == "" {
+			problems[i] = f.Message
+		} else {
+			problems[i] = f.Field + ": " + f.Message
+		}
+	}
+	return fmt.Sprintf("invalid input for %s task: %s", e.Type, strings.Join(problems, "; "))
+}
+
+// ValidateInput checks input against the schema of taskType. It returns a
+// *ValidationError if the input would not decode into the type's input
+// struct, or if the type is unknown. Strict types are checked further, see
+// TypeSchema.
+func ValidateInput(taskType string, input []byte) error {
+	schema, ok := SchemaFor(taskType)
+	if !ok {
+		return &ValidationError{Type: taskType, Fields: []FieldError{{Message: "unknown task type"}}}
+	}
+	if schema.Input == nil {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return &ValidationError{Type: taskType, Fields: []FieldError{{Message: "not JSON: " + err.Error()}}}
+	}
+	if decoder.More() {
+		return &ValidationError{Type: taskType, Fields: []FieldError{{Message: "trailing data after JSON value"}}}
+	}
+
+	var problems []FieldError
+	schema.Input.validate("", value, schema.Strict, &problems)
+	if len(problems) > 0 {
+		return &ValidationError{Type: taskType, Fields: problems}
+	}
+	return nil
+}
+
+func (s *Schema) validate(path string, value any, strict bool, problems *[]FieldError) {
+	fail := func(format string, args ...any) {
+		*problems = append(*problems, FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if value == nil && !strict {
+		// json.Unmarshal leaves the zero value.
+		return
+	}
+
+	switch s.Type {
+	case "":
+		return
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("want a boolean, got %s", jsonType(value))
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			fail("want a string, got %s", jsonType(value))
+		}
+	case "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			fail("want a number, got %s", jsonType(value))
+			return
+		}
+		if f, err := strconv.ParseFloat(string(number), 64); err != nil || !s.inRange(f) {
+			fail("%s is out of range", number)
+		}
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok || strings.ContainsAny(string(number), ".eE") {
+			// encoding/json does not decode 1.0 or 1e3 into integers either.
+			fail("want an integer, got %s", jsonType(value))
+			return
+		}
+		var err error
+		if s.Minimum != nil && *s.Minimum >= 0 {
+			_, err = strconv.ParseUint(string(number), 10, 64)
+		} else {
+			_, err = strconv.ParseInt(string(number), 10, 64)
+		}
+		f, _ := strconv.ParseFloat(string(number), 64)
+		if err != nil || !s.inRange(f) {
+			fail("%s is out of range", number)
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			fail("want an array, got %s", jsonType(value))
+			return
+		}
+		for i, item := range items {
+			s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, strict, problems)
+		}
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			fail("want an object, got %s", jsonType(value))
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok && strict {
+				*problems = append(*problems, FieldError{Field: join(path, name), Message: "required"})
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch property, ok := s.property(name); {
+			case ok:
+				property.validate(join(path, name), object[name], strict, problems)
+			case s.AdditionalProperties != nil:
+				s.AdditionalProperties.validate(join(path, name), object[name], strict, problems)
+			case strict:
+				*problems = append(*problems, FieldError{Field: join(path, name), Message: "unknown field"})
+			}
+		}
+	}
+}
+
+// property looks name up the way encoding/json matches fields: exactly,
+// or else ignoring case.
+func (s *Schema) property(name string) (*Schema, bool) {
+	if property, ok := s.Properties[name]; ok {
+		return property, true
+	}
+	for key, property := range s.Properties {
+		if strings.EqualFold(key, name) {
+			return property, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Schema) inRange(f float64) bool {
+	return (s.Minimum == nil || f >= *s.Minimum) && (s.Maximum == nil || f <= *s.Maximum)
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case string:
+		return "a string"
+	case json.Number:
+		return "the number " + string(value.(json.Number))
+	case []any:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
@@ -0,0 +1,108 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidateInput(t *testing.T) {
+	RegisterSchema("strictSum", TypeSchema{Input: SchemaOf(SumTaskInput{}), Strict: true})
+
+	cases := []struct {
+		taskType string
+		input    string
+		want     []FieldError
+	}{
+		{SumTaskType, `{"a": 1, "b": 2}`, nil},
+		{SumTaskType, `{"a": 1}`, nil},
+		{SumTaskType, `{"A": 1, "b": null, "c": 3}`, nil},
+		{SumTaskType, `{"a": "1", "b": 2.5, "c": 3}`, []FieldError{
+			{"a", "want an integer, got a string"},
+			{"b", "want an integer, got the number 2.5"},
+		}},
+		{SumTaskType, `{"A": "1"}`, []FieldError{{"A", "want an integer, got a string"}}},
+		{SumTaskType, `{"a": 1, "b": 9223372036854775808}`, []FieldError{{"b", "9223372036854775808 is out of range"}}},
+		{SumTaskType, `[1, 2]`, []FieldError{{"", "want an object, got an array"}}},
+		{SlowAPITaskType, `{"addr": "127.0.0.1:80"}`, nil},
+		{"nope", `{}`, []FieldError{{"", "unknown task type"}}},
+		{"strictSum", `{"a": 1}`, []FieldError{{"b", "required"}}},
+		{"strictSum", `{"a": 1, "b": null, "c": 3}`, []FieldError{
+			{"b", "want an integer, got null"},
+			{"c", "unknown field"},
+		}},
+	}
+	for _, c := range cases {
+		err := ValidateInput(c.taskType, []byte(c.input))
+		if c.want == nil {
+			if err != nil {
+				t.Errorf("%s %s: %v", c.taskType, c.input, err)
+			}
+			continue
+		}
+
+		var invalid *ValidationError
+		if !errors.As(err, &invalid) {
+			t.Errorf("%s %s: got %v, want a validation error", c.taskType, c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(invalid.Fields, c.want) {
+			t.Errorf("%s %s: got %+v, want %+v", c.taskType, c.input, invalid.Fields, c.want)
+		}
+	}
+}
+
+func TestValidInputsDecode(t *testing.T) {
+	// Whatever passes validation must decode into the input struct.
+	for _, input := range []string{`{"a": 0, "b": -3}`, `{"a": 2147483648, "b": 1}`, `{"a": 1}`, `{"A": 1, "extra": true}`, `null`} {
+		if err := ValidateInput(SumTaskType, []byte(input)); err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		var v SumTaskInput
+		if err := json.Unmarshal([]byte(input), &v); err != nil {
+			t.Errorf("%s passed validation but does not decode: %v", input, err)
+		}
+	}
+}
+
+func TestSchemaOfNestedTypes(t *testing.T) {
+	type item struct {
+		Name string `json:"name"`
+		Note string `json:"note,omitempty"`
+	}
+	type input struct {
+		Items  []item         `json:"items"`
+		Labels map[string]int `json:"labels,omitempty"`
+		Count  uint8          `json:"count"`
+		Hidden string         `json:"-"`
+	}
+	schema := SchemaOf(input{})
+
+	var problems []FieldError
+	var value any
+	json.Unmarshal([]byte(`{"items": [{"name": "x"}, {"note": "y"}], "labels": {"a": "b"}, "count": 256, "Hidden": ""}`), &value)
+	// Numbers must be json.Number as ValidateInput decodes them.
+	value.(map[string]any)["count"] = json.Number("256")
+	schema.validate("", value, true, &problems)
+
+	want := []FieldError{
+		{"Hidden", "unknown field"},
+		{"count", "256 is out of range"},
+		{"items[1].name", "required"},
+		{"labels.a", "want an integer, got a string"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("strict: got %+v, want %+v", problems, want)
+	}
+
+	problems = nil
+	schema.validate("", value, false, &problems)
+	want = []FieldError{
+		{"count", "256 is out of range"},
+		{"labels.a", "want an integer, got a string"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("got %+v, want %+v", problems, want)
+	}
+}
@@ -0,0 +1,65 @@
+package tasks
+
+import (
+	"context"
+	"io"
+)
+
+// Progress reports how far a task got, in units of the handler's choosing.
+type Progress struct {
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+}
+
+// Update is an intermediate message of a running task: its progress, a
+// chunk of partial result, or both.
+type Update struct {
+	Progress *Progress `json:"progress,omitempty"`
+	Chunk    []byte    `json:"chunk,omitempty"`
+}
+
+// Emitter receives the updates of a running task. Emit may block to apply
+// backpressure to the handler.
+type Emitter interface {
+	Emit(update Update)
+}
+
+// EmitterFunc adapts a function to Emitter.
+type EmitterFunc func(update Update)
+
+func (f EmitterFunc) Emit(update Update) {
+	f(update)
+}
+
+type emitterKey struct{}
+
+// WithEmitter returns a context that handlers stream their updates to.
+func WithEmitter(ctx context.Context, emitter Emitter) context.Context {
+	return context.WithValue(ctx, emitterKey{}, emitter)
+}
+
+// Emit sends an update if ctx has an emitter; without one it does nothing,
+// so handlers can emit whether or not anybody is listening.
+func Emit(ctx context.Context, update Update) {
+	if emitter, ok := ctx.Value(emitterKey{}).(Emitter); ok {
+		emitter.Emit(update)
+	}
+}
+
+func EmitProgress(ctx context.Context, done, total int64) {
+	Emit(ctx, Update{Progress: &Progress{Done: done, Total: total}})
+}
+
+// ChunkWriter returns a writer whose every Write is emitted as a chunk.
+func ChunkWriter(ctx context.Context) io.Writer {
+	return &chunkWriter{ctx: ctx}
+}
+
+type chunkWriter struct {
+	ctx context.Context
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	Emit(w.ctx, Update{Chunk: append([]byte(nil), p...)})
+	return len(p), nil
+}
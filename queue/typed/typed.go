@@ -0,0 +1,151 @@
+// Package typed embeds the queue in a Go program with typed values instead
+// of JSON task inputs. A Queue[In, Out] runs one handler on the worker pool
+// of an internal queue, with its capacity, pausing, keyed ordering,
+// cancellation and accounting, but passes In and Out values through without
+// marshalling them or looking up a handler by task type.
+package typed
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/tasks"
+)
+
+// Handler runs one submitted value. ctx is cancelled when the task is.
+type Handler[In, Out any] func(ctx context.Context, in In) (Out, error)
+
+// Config collects the options of a Queue.
+type Config struct {
+	Capacity    int
+	Workers     int
+	LogDisabled bool
+	// Name labels the queue's tasks in Stats, "typed" by default.
+	Name string
+	// CPUAccounting and ProfileLabels are passed to internal.Config.
+	CPUAccounting bool
+	ProfileLabels bool
+}
+
+// Queue runs values of type In through a Handler on a pool of workers. It
+// is safe for concurrent use.
+type Queue[In, Out any] struct {
+	queue   internal.IQueue
+	funcs   internal.FuncQueue
+	handler Handler[In, Out]
+	name    string
+	seq     atomic.Uint64
+}
+
+func New[In, Out any](cfg Config, handler Handler[In, Out]) *Queue[In, Out] {
+	if cfg.Name == "" {
+		cfg.Name = "typed"
+	}
+	queue := internal.New(internal.Config{
+		Capacity:      cfg.Capacity,
+		Workers:       cfg.Workers,
+		LogDisabled:   cfg.LogDisabled,
+		CPUAccounting: cfg.CPUAccounting,
+		ProfileLabels: cfg.ProfileLabels,
+	})
+	return &Queue[In, Out]{
+		queue:   queue,
+		funcs:   queue.(internal.FuncQueue),
+		handler: handler,
+		name:    cfg.Name,
+	}
+}
+
+// Submit queues in. It fails with internal.ErrQueueFull when the queue is
+// at capacity and internal.ErrQueueClosed after Shutdown.
+func (q *Queue[In, Out]) Submit(in In) (*Future[Out], error) {
+	return q.SubmitKey("", in)
+}
+
+// SubmitKey queues in behind the earlier values submitted with the same
+// key, which run one at a time in order. An empty key orders nothing.
+func (q *Queue[In, Out]) SubmitKey(key string, in In) (*Future[Out], error) {
+	future := &Future[Out]{
+		id:     strconv.FormatUint(q.seq.Add(1), 10),
+		queue:  q.queue,
+		result: make(chan struct{}),
+	}
+	task := &tasks.Task{Id: future.id, Type: q.name, Key: key}
+	ch, err := q.funcs.PutFunc(task, func(ctx context.Context) error {
+		var err error
+		future.value, err = q.handler(ctx, in)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	future.ch = ch
+	return future, nil
+}
+
+func (q *Queue[In, Out]) Pause() {
+	q.queue.Pause()
+}
+
+func (q *Queue[In, Out]) Resume() {
+	q.queue.Resume()
+}
+
+func (q *Queue[In, Out]) Stats() internal.Stats {
+	return q.queue.Stats()
+}
+
+// Shutdown stops accepting values and waits for the queued ones to run.
+func (q *Queue[In, Out]) Shutdown() error {
+	return q.queue.Shutdown()
+}
+
+// Future is the pending result of a submitted value.
+type Future[Out any] struct {
+	id    string
+	queue internal.IQueue
+	ch    <-chan internal.Output
+	// value is set by the worker before the Output is sent on ch. result
+	// is closed once the first Wait received it into err.
+	value  Out
+	err    error
+	result chan struct{}
+}
+
+// Wait blocks until the value ran, or ctx ends. It can be called any number
+// of times, from any goroutine.
+func (f *Future[Out]) Wait(ctx context.Context) (Out, error) {
+	select {
+	case output, ok := <-f.ch:
+		if ok {
+			f.err = output.Err
+			close(f.result)
+		}
+	case <-f.result:
+	case <-ctx.Done():
+		var zero Out
+		return zero, ctx.Err()
+	}
+
+	// Another Wait may be storing the result it received.
+	select {
+	case <-f.result:
+	case <-ctx.Done():
+		var zero Out
+		return zero, ctx.Err()
+	}
+	if f.err != nil {
+		var zero Out
+		return zero, f.err
+	}
+	return f.value, nil
+}
+
+// Cancel removes the value from the queue if it did not run yet, or
+// cancels the ctx of its handler. Wait then fails with
+// internal.ErrCancelled, unless it finished first.
+func (f *Future[Out]) Cancel() {
+	// The queue forgets finished tasks, and ids are not reused.
+	f.queue.Cancel(f.id)
+}
@@ -0,0 +1,126 @@
+package typed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"vu/benchmark/queue/internal"
+)
+
+type point struct{ X, Y int }
+
+func TestSubmitReturnsTypedResults(t *testing.T) {
+	queue := New(Config{Capacity: 100, Workers: 4, LogDisabled: true}, func(ctx context.Context, p point) (int, error) {
+		if p.X < 0 {
+			return 0, errors.New("negative")
+		}
+		return p.X * p.Y, nil
+	})
+	defer queue.Shutdown()
+
+	var futures []*Future[int]
+	for i := 0; i < 50; i++ {
+		future, err := queue.Submit(point{i, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, future)
+	}
+	for i, future := range futures {
+		if res, err := future.Wait(context.Background()); err != nil || res != i*2 {
+			t.Errorf("value %d: %d, %v", i, res, err)
+		}
+	}
+
+	failing, _ := queue.Submit(point{-1, 0})
+	if _, err := failing.Wait(context.Background()); err == nil || err.Error() != "negative" {
+		t.Errorf("failing handler: %v", err)
+	}
+	if stats := queue.Stats(); stats.Types["typed"].Tasks != 51 || stats.Types["typed"].Failed != 1 {
+		t.Errorf("accounted %+v", stats.Types)
+	}
+}
+
+func TestWaitFromSeveralGoroutines(t *testing.T) {
+	queue := New(Config{Capacity: 1, Workers: 1, LogDisabled: true}, func(ctx context.Context, s string) (string, error) {
+		time.Sleep(10 * time.Millisecond)
+		return s + "!", nil
+	})
+	defer queue.Shutdown()
+
+	future, err := queue.Submit("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := future.Wait(context.Background()); err != nil || res != "hi!" {
+				t.Errorf("wait: %q, %v", res, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCancelAndCapacity(t *testing.T) {
+	queue := New(Config{Capacity: 2, Workers: 1, LogDisabled: true}, func(ctx context.Context, n int) (int, error) {
+		return n, nil
+	})
+	defer queue.Shutdown()
+	queue.Pause()
+
+	first, _ := queue.Submit(1)
+	second, _ := queue.Submit(2)
+	if _, err := queue.Submit(3); !errors.Is(err, internal.ErrQueueFull) {
+		t.Fatalf("submit over capacity: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := first.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait on a paused queue: %v", err)
+	}
+
+	first.Cancel()
+	if _, err := first.Wait(context.Background()); !errors.Is(err, internal.ErrCancelled) {
+		t.Fatalf("cancelled: %v", err)
+	}
+	queue.Resume()
+	if res, err := second.Wait(context.Background()); err != nil || res != 2 {
+		t.Fatalf("after cancelling the first: %d, %v", res, err)
+	}
+}
+
+func TestSubmitKeyRunsInOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var order []int
+	queue := New(Config{Capacity: 100, Workers: 8, LogDisabled: true}, func(ctx context.Context, n int) (struct{}, error) {
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		order = append(order, n)
+		mutex.Unlock()
+		return struct{}{}, nil
+	})
+	defer queue.Shutdown()
+
+	var futures []*Future[struct{}]
+	for i := 0; i < 20; i++ {
+		future, err := queue.SubmitKey("k", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, future)
+	}
+	for _, future := range futures {
+		future.Wait(context.Background())
+	}
+	if fmt.Sprint(order) != fmt.Sprint([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}) {
+		t.Errorf("ran in order %v", order)
+	}
+}
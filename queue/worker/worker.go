@@ -0,0 +1,309 @@
+// Package worker runs tasks for a queue server in a separate process, so
+// CPU-heavy work can be spread across machines. A worker connects to the
+// server, registers the task types it runs and its concurrency, pulls
+// tasks, which the server leases to it, and reports their outputs back.
+// Tasks leased over a connection that breaks, or whose lease runs out
+// because the worker hangs, are put back into the queue for other workers.
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vu/benchmark/queue/blob"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/tasks"
+)
+
+// Config collects the tunables of a worker.
+type Config struct {
+	// Addr is the queue server to work for, a TCP address or "unix:" and
+	// the path of a Unix socket.
+	Addr string
+	// Name identifies the worker in the server's logs, host-pid by default.
+	Name string
+	// Types are the task types to run, all of them if empty.
+	Types []string
+	// Concurrency is how many tasks run at once, GOMAXPROCS by default.
+	Concurrency int
+	// Visibility is the lease period of the tasks the worker pulls, 30s by
+	// default. A task whose worker hangs for longer runs elsewhere; the
+	// worker extends the leases of tasks running longer.
+	Visibility time.Duration
+	// Blobs is needed to run tasks with an InputBlob; it must be the
+	// server's blob directory, shared. Results larger than
+	// ResultBlobThreshold, 1 MiB by default, are stored there.
+	Blobs               *blob.Store
+	ResultBlobThreshold int
+	// RetryInterval is how long to wait before reconnecting to the server
+	// or pulling again after a failed pull.
+	RetryInterval time.Duration
+	LogDisabled   bool
+}
+
+// RegisterError is the server refusing the worker, e.g. for a task type it
+// does not know. Reconnecting would not help.
+type RegisterError struct {
+	Message string
+}
+
+func (e *RegisterError) Error() string {
+	return "register: " + e.Message
+}
+
+// Run works for the server until done is closed, reconnecting whenever the
+// connection breaks. Running tasks finish and are reported before it
+// returns.
+func Run(cfg Config, done <-chan struct{}) error {
+	if cfg.Name == "" {
+		host, _ := os.Hostname()
+		cfg.Name = host + "-" + strconv.Itoa(os.Getpid())
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if cfg.Visibility <= 0 {
+		cfg.Visibility = 30 * time.Second
+	}
+	if cfg.ResultBlobThreshold <= 0 {
+		cfg.ResultBlobThreshold = 1 << 20
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+
+	for {
+		err := runSession(cfg, done)
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		var rejected *RegisterError
+		if errors.As(err, &rejected) {
+			return err
+		}
+
+		logf(cfg, "worker %s: %v, reconnecting in %v\n", cfg.Name, err, cfg.RetryInterval)
+		select {
+		case <-time.After(cfg.RetryInterval):
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func logf(cfg Config, format string, args ...any) {
+	if cfg.LogDisabled {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// session is one connection to the server.
+type session struct {
+	cfg     Config
+	conn    net.Conn
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	pullSeq uint64
+	// leased receives the tasks pulls were answered with, nil for a
+	// failed pull.
+	leased chan *tasks.Task
+	// broken is closed when the connection breaks; ctx is cancelled with
+	// it to stop the tasks whose leases are gone.
+	broken chan struct{}
+	ctx    context.Context
+	// running cancels the tasks being run by id, when their lease turns out
+	// to have expired or they were cancelled.
+	running map[string]context.CancelFunc
+}
+
+func runSession(cfg Config, done <-chan struct{}) error {
+	network, addr := "tcp", cfg.Addr
+	if path, ok := strings.CutPrefix(cfg.Addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s := &session{
+		cfg:     cfg,
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		leased:  make(chan *tasks.Task, cfg.Concurrency),
+		broken:  make(chan struct{}),
+		running: make(map[string]context.CancelFunc),
+	}
+	decoder := json.NewDecoder(conn)
+
+	info := &protocol.WorkerInfo{Name: cfg.Name, Types: cfg.Types, Concurrency: cfg.Concurrency}
+	if err := s.send(protocol.Request{Op: protocol.OpRegister, Task: tasks.Task{Id: cfg.Name}, Worker: info}); err != nil {
+		return err
+	}
+	var resp protocol.Response
+	if err := decoder.Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return &RegisterError{Message: resp.Error}
+	}
+	logf(cfg, "worker %s: connected to %s\n", cfg.Name, cfg.Addr)
+
+	var cancel context.CancelFunc
+	s.ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- s.read(decoder)
+		close(s.broken)
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(done)
+		}()
+	}
+	wg.Wait()
+
+	// Closing the connection hands back whatever the outstanding pulls
+	// leased meanwhile.
+	conn.Close()
+	return <-readErr
+}
+
+func (s *session) send(req protocol.Request) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.encoder.Encode(req)
+}
+
+// read routes the server's responses until the connection breaks.
+func (s *session) read(decoder *json.Decoder) error {
+	for {
+		var resp protocol.Response
+		if err := decoder.Decode(&resp); err != nil {
+			return err
+		}
+
+		switch {
+		case resp.Op == protocol.OpPull && resp.Task != nil:
+			s.leased <- resp.Task
+		case resp.Op == protocol.OpPull:
+			logf(s.cfg, "worker %s: pull: %s\n", s.cfg.Name, resp.Error)
+			s.leased <- nil
+		case resp.Op == protocol.OpExtend && resp.Error != "":
+			// Somebody else runs the task by now.
+			logf(s.cfg, "worker %s: extend %s: %s, abandoning it\n", s.cfg.Name, resp.ID, resp.Error)
+			s.stop(resp.ID)
+		case resp.Op == protocol.OpCancel:
+			// The task was cancelled; it is reported with the error it
+			// stops with.
+			logf(s.cfg, "worker %s: task %s cancelled\n", s.cfg.Name, resp.ID)
+			s.stop(resp.ID)
+		case resp.Error != "":
+			logf(s.cfg, "worker %s: %s %s: %s\n", s.cfg.Name, resp.Op, resp.ID, resp.Error)
+		}
+	}
+}
+
+// stop cancels the context of task id if it is running.
+func (s *session) stop(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if cancel, ok := s.running[id]; ok {
+		cancel()
+	}
+}
+
+// work pulls and runs one task at a time until done is closed or the
+// connection breaks.
+func (s *session) work(done <-chan struct{}) {
+	for {
+		s.mutex.Lock()
+		s.pullSeq++
+		id := "pull-" + strconv.FormatUint(s.pullSeq, 10)
+		s.mutex.Unlock()
+		if err := s.send(protocol.Request{Op: protocol.OpPull, Task: tasks.Task{Id: id}, Visibility: s.cfg.Visibility}); err != nil {
+			return
+		}
+
+		var task *tasks.Task
+		select {
+		case task = <-s.leased:
+		case <-s.broken:
+			return
+		case <-done:
+			return
+		}
+
+		if task == nil {
+			select {
+			case <-time.After(s.cfg.RetryInterval):
+				continue
+			case <-s.broken:
+				return
+			case <-done:
+				return
+			}
+		}
+
+		output := s.run(task)
+		req := protocol.Request{Op: protocol.OpComplete, Task: tasks.Task{Id: task.Id}, Result: output.Res, Blob: output.Blob}
+		if output.Err != nil {
+			req.Result, req.Blob = nil, ""
+			req.Error = output.Err.Error()
+		}
+		if err := s.send(req); err != nil {
+			return
+		}
+	}
+}
+
+// run executes a leased task, extending its lease every third of the
+// visibility period until it is done.
+func (s *session) run(task *tasks.Task) internal.Output {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	s.mutex.Lock()
+	s.running[task.Id] = cancel
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.running, task.Id)
+		s.mutex.Unlock()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(s.cfg.Visibility / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.send(protocol.Request{Op: protocol.OpExtend, Task: tasks.Task{Id: task.Id}, Visibility: s.cfg.Visibility})
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return internal.Run(ctx, task, s.cfg.Blobs, s.cfg.ResultBlobThreshold)
+}
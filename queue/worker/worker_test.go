@@ -0,0 +1,305 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"vu/benchmark/queue/client"
+	"vu/benchmark/queue/internal"
+	"vu/benchmark/queue/mockserver"
+	"vu/benchmark/queue/protocol"
+	"vu/benchmark/queue/server"
+	"vu/benchmark/queue/tasks"
+)
+
+// startServer serves a queue without local workers, so every task runs on
+// a remote worker.
+func startServer(t *testing.T) (string, internal.IQueue) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	queue := internal.New(internal.Config{Capacity: 100, Workers: 0, LogDisabled: true})
+	done := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.Serve(addr, queue, done)
+	}()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		close(done)
+		<-served
+	})
+	return addr, queue
+}
+
+func startWorker(t *testing.T, cfg Config) {
+	t.Helper()
+
+	cfg.LogDisabled = true
+	cfg.RetryInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := Run(cfg, done); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+}
+
+func newClient(t *testing.T, addr string) *client.Client {
+	t.Helper()
+
+	c, err := client.New(client.Config{Addrs: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func sumTask(a int) tasks.Task {
+	input, _ := json.Marshal(tasks.SumTaskInput{A: a, B: 1})
+	return tasks.Task{Type: tasks.SumTaskType, Input: input}
+}
+
+func TestRemoteWorkersRunTasks(t *testing.T) {
+	addr, _ := startServer(t)
+	startWorker(t, Config{Addr: addr, Name: "a", Concurrency: 2})
+	startWorker(t, Config{Addr: addr, Name: "b", Concurrency: 2})
+	c := newClient(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := c.Submit(ctx, sumTask(i))
+			if err != nil {
+				t.Errorf("task %d: %v", i, err)
+				return
+			}
+			var output tasks.SumTaskOutput
+			if err := json.Unmarshal(result, &output); err != nil || output.Res != i+1 {
+				t.Errorf("task %d: got %s", i, result)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWorkersOnlyGetTheirTypes(t *testing.T) {
+	addr, queue := startServer(t)
+	startWorker(t, Config{Addr: addr, Types: []string{tasks.SumTaskType}, Concurrency: 1})
+	c := newClient(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Queued first, but nobody runs hash tasks.
+	hashCtx, cancelHash := context.WithCancel(ctx)
+	defer cancelHash()
+	go c.Submit(hashCtx, tasks.Task{Type: tasks.HashTaskType, Input: []byte(`{"iteration":1}`)})
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := c.Submit(ctx, sumTask(1)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := queue.Stats(); stats.Size != 1 || stats.Running != 0 {
+		t.Errorf("hash task should still be queued: %+v", stats)
+	}
+}
+
+func TestTasksOfDisconnectedWorkerAreReassigned(t *testing.T) {
+	addr, queue := startServer(t)
+	c := newClient(t, addr)
+
+	// A worker that leases a task and dies without reporting it.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	encoder.Encode(protocol.Request{Op: protocol.OpRegister, Task: tasks.Task{Id: "dead"}, Worker: &protocol.WorkerInfo{Name: "dead", Concurrency: 1}})
+	var resp protocol.Response
+	if err := decoder.Decode(&resp); err != nil || resp.Error != "" {
+		t.Fatalf("register: %v %s", err, resp.Error)
+	}
+	encoder.Encode(protocol.Request{Op: protocol.OpPull, Task: tasks.Task{Id: "1"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Submit(ctx, sumTask(41))
+		result <- err
+	}()
+
+	if err := decoder.Decode(&resp); err != nil || resp.Task == nil {
+		t.Fatalf("pull: %v %+v", err, resp)
+	}
+	// The lease counts against the worker's concurrency.
+	encoder.Encode(protocol.Request{Op: protocol.OpPull, Task: tasks.Task{Id: "2"}})
+	if err := decoder.Decode(&resp); err != nil || resp.Error == "" {
+		t.Fatalf("pull beyond concurrency: %v %+v", err, resp)
+	}
+	if stats := queue.Stats(); stats.Running != 1 {
+		t.Fatalf("leased task is not running: %+v", stats)
+	}
+	conn.Close()
+
+	startWorker(t, Config{Addr: addr, Concurrency: 1})
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownTypeIsRefused(t *testing.T) {
+	addr, _ := startServer(t)
+	err := Run(Config{Addr: addr, Types: []string{"nope"}, LogDisabled: true}, make(chan struct{}))
+	if _, ok := err.(*RegisterError); !ok {
+		t.Fatalf("got %v, want a RegisterError", err)
+	}
+}
+
+func TestHungWorkerLosesItsLease(t *testing.T) {
+	addr, queue := startServer(t)
+	c := newClient(t, addr)
+
+	// A worker that leases a task and hangs, still connected.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	encoder.Encode(protocol.Request{Op: protocol.OpRegister, Task: tasks.Task{Id: "hung"}, Worker: &protocol.WorkerInfo{Name: "hung", Concurrency: 1}})
+	var resp protocol.Response
+	if err := decoder.Decode(&resp); err != nil || resp.Error != "" {
+		t.Fatalf("register: %v %s", err, resp.Error)
+	}
+	encoder.Encode(protocol.Request{Op: protocol.OpPull, Task: tasks.Task{Id: "1"}, Visibility: 100 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Submit(ctx, sumTask(41))
+		result <- err
+	}()
+	if err := decoder.Decode(&resp); err != nil || resp.Task == nil {
+		t.Fatalf("pull: %v %+v", err, resp)
+	}
+	leased := resp.Task
+
+	startWorker(t, Config{Addr: addr, Concurrency: 1})
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	// Waking up too late, the hung worker's result is refused.
+	encoder.Encode(protocol.Request{Op: protocol.OpComplete, Task: tasks.Task{Id: leased.Id}, Result: []byte("late")})
+	if err := decoder.Decode(&resp); err != nil || resp.Error != internal.ErrLeaseExpired.Error() {
+		t.Errorf("late complete: %v %+v", err, resp)
+	}
+	if stats := queue.Stats(); stats.ExpiredLeases != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestCancelledTaskStopsOnWorker(t *testing.T) {
+	addr, queue := startServer(t)
+	startWorker(t, Config{Addr: addr, Concurrency: 1})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	// Far longer than the test, unless it is stopped.
+	input, _ := json.Marshal(tasks.BurnCPUTaskInput{Iteration: 1 << 50})
+	encoder.Encode(protocol.Request{Task: tasks.Task{Id: "burn", Type: tasks.BurnCPUTaskType, Input: input}})
+	for queue.Stats().Running == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	encoder.Encode(protocol.Request{Op: protocol.OpCancel, Task: tasks.Task{Id: "burn"}})
+	for i := 0; i < 2; i++ {
+		var resp protocol.Response
+		if err := decoder.Decode(&resp); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if resp.Op == "" && resp.Error != internal.ErrCancelled.Error() {
+			t.Fatalf("expected the task to be cancelled, got %+v", resp)
+		}
+	}
+
+	// The worker is free for the next task.
+	c := newClient(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Submit(ctx, sumTask(1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLongTaskKeepsItsLease(t *testing.T) {
+	api, err := mockserver.Start(mockserver.Config{
+		Latency:     mockserver.Latency{Base: 300 * time.Millisecond},
+		LogDisabled: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	addr, queue := startServer(t)
+	// Far shorter than the task, which only completes if the worker keeps
+	// extending its lease.
+	startWorker(t, Config{Addr: addr, Concurrency: 1, Visibility: 60 * time.Millisecond})
+	c := newClient(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	input, _ := json.Marshal(tasks.SlowAPITaskInput{Addr: api.Addr()})
+	if _, err := c.Submit(ctx, tasks.Task{Type: tasks.SlowAPITaskType, Input: input}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := queue.Stats(); stats.ExpiredLeases != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}